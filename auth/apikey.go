@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/samsyntax/go-lb/filewatch"
+)
+
+// APIKeys authenticates requests by an API key sent in a header or query
+// parameter. The keys file has one "<subject> <key>" pair per line; empty
+// lines and lines starting with # are ignored. The file is reloaded when it changes.
+type APIKeys struct {
+	header string
+	query  string
+	keys   *filewatch.File[map[[sha256.Size]byte]string] // subjects by key hash
+}
+
+// NewAPIKeys loads the keys file. header defaults to X-API-Key; query names
+// a query parameter also accepted, empty for none.
+func NewAPIKeys(file, header, query string) (*APIKeys, error) {
+	if header == "" {
+		header = "X-API-Key"
+	}
+	keys, err := filewatch.New(file, parseAPIKeys)
+	if err != nil {
+		return nil, err
+	}
+	return &APIKeys{header: header, query: query, keys: keys}, nil
+}
+
+func parseAPIKeys(data []byte) (map[[sha256.Size]byte]string, error) {
+	keys := make(map[[sha256.Size]byte]string)
+	err := eachLine(data, func(n int, line string) error {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("line %d: expected <subject> <key>", n)
+		}
+		sum := sha256.Sum256([]byte(fields[1]))
+		if _, ok := keys[sum]; ok {
+			return fmt.Errorf("line %d: duplicate key", n)
+		}
+		keys[sum] = fields[0]
+		return nil
+	})
+	return keys, err
+}
+
+func (a *APIKeys) Method() string {
+	return MethodAPIKey
+}
+
+func (a *APIKeys) Challenge() string {
+	return ""
+}
+
+func (a *APIKeys) Authenticate(r *http.Request) (*Identity, error) {
+	key := r.Header.Get(a.header)
+	if key == "" && a.query != "" {
+		key = r.URL.Query().Get(a.query)
+	}
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+	// Looking up the hash keeps the lookup time independent of the key
+	subject, ok := a.keys.Get()[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	return &Identity{Method: MethodAPIKey, Subject: subject, Claims: map[string]any{"sub": subject}}, nil
+}
+
+// eachLine calls fn with the number and trimmed content of every line that
+// isn't empty or a comment.
+func eachLine(data []byte, fn func(n int, line string) error) error {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := fn(n, line); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
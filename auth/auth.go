@@ -0,0 +1,223 @@
+// Package auth authenticates requests at the edge, before they are
+// forwarded: API keys looked up in a file, HTTP Basic credentials checked
+// against bcrypt hashes and JWTs verified with a shared secret or a JWKS. A
+// Policy combines providers with the subjects and claims a route requires,
+// and forwards verified claims to the servers as request headers.
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/samsyntax/go-lb/config"
+)
+
+// Authentication methods
+const (
+	MethodAPIKey = "api_key"
+	MethodBasic  = "basic"
+	MethodJWT    = "jwt"
+)
+
+var (
+	// ErrNoCredentials is returned by providers when a request carries none of their credentials.
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials is returned by providers for unknown keys and wrong passwords.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Identity is an authenticated client.
+type Identity struct {
+	Method  string
+	Subject string
+	Claims  map[string]any // verified claims, at least "sub"
+}
+
+// Provider authenticates requests with one method.
+type Provider interface {
+	// Method returns the authentication method, e.g. MethodJWT.
+	Method() string
+	// Authenticate returns the identity proven by r's credentials. It returns
+	// an error wrapping ErrNoCredentials when r has none for this provider.
+	Authenticate(r *http.Request) (*Identity, error)
+	// Challenge returns the WWW-Authenticate challenge of the provider, empty for none.
+	Challenge() string
+}
+
+// Error is a rejected request.
+type Error struct {
+	Status int    // http.StatusUnauthorized or http.StatusForbidden
+	Reason string // logged, not sent to the client
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, http.StatusText(e.Status), e.Reason)
+}
+
+// Policy decides which requests of a route are let through.
+type Policy struct {
+	Providers []Provider        // any of them can authenticate a request
+	Subjects  []string          // subjects allowed, empty for every authenticated one
+	Claims    map[string]string // claim values required, see hasClaim
+	Headers   map[string]string // request headers set from claims, by claim name
+}
+
+// Authorize authenticates r with the first provider it has credentials for.
+// Requests without valid credentials get an *Error with status 401, and
+// authenticated requests the policy doesn't allow one with status 403.
+func (p *Policy) Authorize(r *http.Request) (*Identity, error) {
+	var invalid error
+	for _, prov := range p.Providers {
+		id, err := prov.Authenticate(r)
+		if err == nil {
+			if reason := p.denied(id); reason != "" {
+				return id, &Error{Status: http.StatusForbidden, Reason: reason}
+			}
+			return id, nil
+		}
+		if !errors.Is(err, ErrNoCredentials) && invalid == nil {
+			invalid = fmt.Errorf("%s: %w", prov.Method(), err)
+		}
+	}
+	if invalid != nil {
+		return nil, &Error{Status: http.StatusUnauthorized, Reason: invalid.Error()}
+	}
+	return nil, &Error{Status: http.StatusUnauthorized, Reason: "no credentials"}
+}
+
+// denied returns why the policy doesn't allow id, empty when it does.
+func (p *Policy) denied(id *Identity) string {
+	if len(p.Subjects) > 0 && !slices.Contains(p.Subjects, id.Subject) {
+		return fmt.Sprintf("subject %q is not allowed", id.Subject)
+	}
+	for name, want := range p.Claims {
+		if !hasClaim(id.Claims[name], want) {
+			return fmt.Sprintf("claim %q does not grant %q", name, want)
+		}
+	}
+	return ""
+}
+
+// hasClaim reports whether a claim value grants want: it equals want, is a
+// list containing want, or a space-separated string (such as scope) containing it.
+func hasClaim(v any, want string) bool {
+	switch v := v.(type) {
+	case []any:
+		for _, item := range v {
+			if claimString(item) == want {
+				return true
+			}
+		}
+		return false
+	case string:
+		return v == want || slices.Contains(strings.Fields(v), want)
+	case nil:
+		return false
+	}
+	return claimString(v) == want
+}
+
+// Challenges returns the WWW-Authenticate challenges sent with 401 responses.
+func (p *Policy) Challenges() []string {
+	var res []string
+	for _, prov := range p.Providers {
+		if c := prov.Challenge(); c != "" {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// Forward sets the configured headers of r from the claims of id. Headers
+// sent by the client under those names are removed first, so servers can
+// trust them.
+func (p *Policy) Forward(r *http.Request, id *Identity) {
+	for claim, header := range p.Headers {
+		r.Header.Del(header)
+		if v, ok := id.Claims[claim]; ok && v != nil {
+			r.Header.Set(header, claimString(v))
+		}
+	}
+}
+
+// claimString formats a claim value for a header: lists are joined with
+// commas, objects are JSON.
+func claimString(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case []any:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			parts = append(parts, claimString(item))
+		}
+		return strings.Join(parts, ",")
+	case []string:
+		return strings.Join(v, ",")
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// ProvidersFromConfig creates the configured providers, by method.
+func ProvidersFromConfig(cfg config.AuthConfig) (map[string]Provider, error) {
+	providers := make(map[string]Provider)
+	if c := cfg.APIKeys; c.File != "" {
+		p, err := NewAPIKeys(c.File, c.Header, c.Query)
+		if err != nil {
+			return nil, fmt.Errorf("api keys: %w", err)
+		}
+		providers[MethodAPIKey] = p
+	}
+	if c := cfg.Basic; c.File != "" {
+		p, err := NewBasic(c.File, c.Realm)
+		if err != nil {
+			return nil, fmt.Errorf("basic auth: %w", err)
+		}
+		providers[MethodBasic] = p
+	}
+	if c := cfg.JWT; c.Secret != "" || c.JWKSFile != "" || c.JWKSURL != "" {
+		p, err := NewJWT(JWTOptions{
+			Secret:      c.Secret,
+			JWKSFile:    c.JWKSFile,
+			JWKSURL:     c.JWKSURL,
+			JWKSRefresh: c.JWKSRefresh.Std(),
+			Issuer:      c.Issuer,
+			Audience:    c.Audience,
+			Algorithms:  c.Algorithms,
+			Leeway:      c.Leeway.Std(),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("jwt: %w", err)
+		}
+		providers[MethodJWT] = p
+	}
+	return providers, nil
+}
+
+// PolicyFromConfig creates the policy of a route from the providers created by ProvidersFromConfig.
+func PolicyFromConfig(cfg config.RouteAuthConfig, providers map[string]Provider) (*Policy, error) {
+	if len(cfg.Methods) == 0 {
+		return nil, nil
+	}
+	p := &Policy{Subjects: cfg.Subjects, Claims: cfg.Claims, Headers: cfg.Headers}
+	for _, m := range cfg.Methods {
+		prov, ok := providers[m]
+		if !ok {
+			return nil, fmt.Errorf("authentication method %q is not configured", m)
+		}
+		p.Providers = append(p.Providers, prov)
+	}
+	return p, nil
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/samsyntax/go-lb/filewatch"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Basic authenticates requests with HTTP Basic credentials. The users file
+// has one "<user>:<bcrypt hash>" pair per line, as written by
+// "htpasswd -B"; empty lines and lines starting with # are ignored. The file
+// is reloaded when it changes.
+type Basic struct {
+	realm string
+	users *filewatch.File[map[string][]byte]
+}
+
+// NewBasic loads the users file. realm defaults to go-lb.
+func NewBasic(file, realm string) (*Basic, error) {
+	if realm == "" {
+		realm = "go-lb"
+	}
+	users, err := filewatch.New(file, parseUsers)
+	if err != nil {
+		return nil, err
+	}
+	return &Basic{realm: realm, users: users}, nil
+}
+
+func parseUsers(data []byte) (map[string][]byte, error) {
+	users := make(map[string][]byte)
+	err := eachLine(data, func(n int, line string) error {
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return fmt.Errorf("line %d: expected <user>:<bcrypt hash>", n)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("line %d: user %s: only bcrypt hashes are supported: %v", n, user, err)
+		}
+		users[user] = []byte(hash)
+		return nil
+	})
+	return users, err
+}
+
+// dummyHash is compared against for unknown users, so they take as long as known ones.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("go-lb"), bcrypt.DefaultCost)
+	return hash
+})
+
+func (b *Basic) Method() string {
+	return MethodBasic
+}
+
+func (b *Basic) Challenge() string {
+	return fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", b.realm)
+}
+
+func (b *Basic) Authenticate(r *http.Request) (*Identity, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	hash, known := b.users.Get()[user]
+	if !known {
+		hash = dummyHash()
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !known {
+		return nil, ErrInvalidCredentials
+	}
+	return &Identity{Method: MethodBasic, Subject: user, Claims: map[string]any{"sub": user}}, nil
+}
@@ -0,0 +1,302 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ForwardOptions configures a ForwardAuth.
+type ForwardOptions struct {
+	URL             string        // authorization service
+	Timeout         time.Duration // of the subrequest, 5s by default
+	RequestHeaders  []string      // request headers sent to the service, empty for all of them
+	ResponseHeaders []string      // headers of allowing responses copied onto the forwarded request
+	CacheTTL        time.Duration // how long decisions are reused, 0 to ask the service for every request
+	CacheKey        []string      // request headers decisions depend on besides method, host and URI; every header sent and the client address when empty
+	MaxCacheEntries int           // 10000 by default
+}
+
+// ForwardAuth delegates the authorization of requests to an external
+// service. Before a request is forwarded, a subrequest with its method and
+// headers is sent to the service, with the original host and URI in
+// X-Forwarded-Host and X-Forwarded-Uri. A 2xx response allows the request,
+// any other response is sent back to the client instead.
+type ForwardAuth struct {
+	opts   ForwardOptions
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]*Decision
+
+	allowed, denied, failed, cacheHits atomic.Int64
+}
+
+// Decision is the answer of the authorization service to a request.
+type Decision struct {
+	Status  int
+	Header  http.Header
+	Body    []byte // of denying responses
+	expires time.Time
+	noStore bool // the service asked not to reuse the decision
+}
+
+// Allowed reports whether the request may be forwarded.
+func (d *Decision) Allowed() bool {
+	return d.Status >= 200 && d.Status < 300
+}
+
+// ForwardStats counts the decisions of a ForwardAuth.
+type ForwardStats struct {
+	Allowed   int64 `json:"allowed"`
+	Denied    int64 `json:"denied"`
+	Errors    int64 `json:"errors"`     // subrequests that failed, answered with 503
+	CacheHits int64 `json:"cache_hits"` // decisions reused from the cache
+}
+
+// maxDenyBody limits the body of denying responses relayed to clients.
+const maxDenyBody = 64 << 10
+
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Connection",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length",
+}
+
+// NewForwardAuth creates a ForwardAuth.
+func NewForwardAuth(opts ForwardOptions) (*ForwardAuth, error) {
+	if opts.URL == "" {
+		return nil, errors.New("a URL is required")
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.MaxCacheEntries <= 0 {
+		opts.MaxCacheEntries = 10000
+	}
+	return &ForwardAuth{
+		opts: opts,
+		client: &http.Client{
+			Timeout: opts.Timeout,
+			// Redirects, e.g. to a login page, are for the client to follow
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		cache: make(map[string]*Decision),
+	}, nil
+}
+
+// Check asks the authorization service whether r is allowed, or reuses a
+// cached decision, in which case cached is true. It returns an error when the
+// service can't be reached or answers with a 5xx.
+func (f *ForwardAuth) Check(ctx context.Context, r *http.Request) (d *Decision, cached bool, err error) {
+	var key string
+	if f.opts.CacheTTL > 0 {
+		key = f.key(r)
+		if d = f.cached(key); d != nil {
+			f.cacheHits.Add(1)
+			f.count(d)
+			return d, true, nil
+		}
+	}
+	d, err = f.ask(ctx, r)
+	if err != nil {
+		f.failed.Add(1)
+		return nil, false, err
+	}
+	f.count(d)
+	if key != "" && !d.noStore {
+		f.store(key, d)
+	}
+	return d, false, nil
+}
+
+func (f *ForwardAuth) count(d *Decision) {
+	if d.Allowed() {
+		f.allowed.Add(1)
+	} else {
+		f.denied.Add(1)
+	}
+}
+
+func (f *ForwardAuth) ask(ctx context.Context, r *http.Request) (*Decision, error) {
+	req, err := http.NewRequestWithContext(ctx, r.Method, f.opts.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = f.forwardedHeader(r)
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	if xff := forwardedFor(r); xff != "" {
+		req.Header.Set("X-Forwarded-For", xff)
+	}
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 500 {
+		return nil, errors.New("authorization service answered " + res.Status)
+	}
+	d := &Decision{
+		Status:  res.StatusCode,
+		Header:  make(http.Header),
+		noStore: strings.Contains(strings.ToLower(res.Header.Get("Cache-Control")), "no-store"),
+	}
+	if d.Allowed() {
+		for _, name := range f.opts.ResponseHeaders {
+			if values := res.Header.Values(name); len(values) > 0 {
+				d.Header[http.CanonicalHeaderKey(name)] = values
+			}
+		}
+		return d, nil
+	}
+	d.Header = res.Header.Clone()
+	for _, h := range hopHeaders {
+		d.Header.Del(h)
+	}
+	if d.Body, err = io.ReadAll(io.LimitReader(res.Body, maxDenyBody)); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// forwardedHeader returns the headers of r sent to the service.
+func (f *ForwardAuth) forwardedHeader(r *http.Request) http.Header {
+	h := make(http.Header)
+	if len(f.opts.RequestHeaders) == 0 {
+		for name, values := range r.Header {
+			h[name] = append([]string(nil), values...)
+		}
+	} else {
+		for _, name := range f.opts.RequestHeaders {
+			if values := r.Header.Values(name); len(values) > 0 {
+				h[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+	return h
+}
+
+// forwardedFor returns the X-Forwarded-For value sent to the service: the
+// addresses r was forwarded for and its own.
+func forwardedFor(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		ip = strings.Join(prior, ", ") + ", " + ip
+	}
+	return ip
+}
+
+// Apply sets the headers an allowing decision copies onto the forwarded
+// request. Headers sent by the client under those names are removed.
+func (f *ForwardAuth) Apply(r *http.Request, d *Decision) {
+	for _, name := range f.opts.ResponseHeaders {
+		r.Header.Del(name)
+		for _, v := range d.Header.Values(name) {
+			r.Header.Add(name, v)
+		}
+	}
+}
+
+// Write sends a denying decision to the client.
+func (d *Decision) Write(w http.ResponseWriter) {
+	for name, values := range d.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(d.Status)
+	w.Write(d.Body)
+}
+
+// key identifies the requests a decision applies to. Without a configured
+// key, the service may decide on anything it is sent, so every header sent
+// and the client address are part of it.
+func (f *ForwardAuth) key(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte(' ')
+	b.WriteString(r.Host)
+	b.WriteString(r.URL.RequestURI())
+	if len(f.opts.CacheKey) > 0 {
+		for _, name := range f.opts.CacheKey {
+			b.WriteByte('\n')
+			b.WriteString(strings.Join(r.Header.Values(name), ", "))
+		}
+		return b.String()
+	}
+	h := f.forwardedHeader(r)
+	h.Set("X-Forwarded-For", forwardedFor(r))
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b.WriteByte('\n')
+		b.WriteString(name)
+		b.WriteString(": ")
+		b.WriteString(strings.Join(h[name], ", "))
+	}
+	return b.String()
+}
+
+func (f *ForwardAuth) cached(key string) *Decision {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.cache[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(d.expires) {
+		delete(f.cache, key)
+		return nil
+	}
+	return d
+}
+
+func (f *ForwardAuth) store(key string, d *Decision) {
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.cache) >= f.opts.MaxCacheEntries {
+		for k, c := range f.cache {
+			if now.After(c.expires) {
+				delete(f.cache, k)
+			}
+		}
+		// Still full of live decisions: the next requests ask the service
+		if len(f.cache) >= f.opts.MaxCacheEntries {
+			return
+		}
+	}
+	d.expires = now.Add(f.opts.CacheTTL)
+	f.cache[key] = d
+}
+
+// Stats returns the decision counters.
+func (f *ForwardAuth) Stats() ForwardStats {
+	return ForwardStats{
+		Allowed:   f.allowed.Load(),
+		Denied:    f.denied.Load(),
+		Errors:    f.failed.Load(),
+		CacheHits: f.cacheHits.Load(),
+	}
+}
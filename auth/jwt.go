@@ -0,0 +1,354 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/samsyntax/go-lb/filewatch"
+	log "github.com/sirupsen/logrus"
+)
+
+// JWT signing algorithms by family
+var (
+	hmacAlgorithms = []string{"HS256", "HS384", "HS512"}
+	keyAlgorithms  = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+)
+
+// ValidAlgorithm reports whether alg is a supported JWT signing algorithm.
+func ValidAlgorithm(alg string) bool {
+	return slices.Contains(hmacAlgorithms, alg) || slices.Contains(keyAlgorithms, alg)
+}
+
+// JWTOptions configures a JWT provider. Tokens are verified with Secret
+// (HS algorithms) or with the keys of a JWKS, loaded from JWKSFile or JWKSURL.
+type JWTOptions struct {
+	Secret      string
+	JWKSFile    string
+	JWKSURL     string
+	JWKSRefresh time.Duration // how long keys fetched from JWKSURL are cached, 1h by default
+	Issuer      string        // required iss, empty to accept any
+	Audience    []string      // aud has to contain one of them, empty to accept any
+	Algorithms  []string      // accepted algorithms; by default HS* with a secret and RS*, PS* and ES* with a JWKS
+	Leeway      time.Duration // clock skew allowed when checking exp and nbf
+}
+
+// JWT authenticates requests with a bearer token in the Authorization header.
+// Tokens must be signed with an accepted algorithm, be unexpired and match
+// the configured issuer and audience.
+type JWT struct {
+	opts   JWTOptions
+	parser *jwt.Parser
+	keys   *jwks
+}
+
+// NewJWT creates a JWT provider, loading its JWKS.
+func NewJWT(opts JWTOptions) (*JWT, error) {
+	if opts.Secret == "" && opts.JWKSFile == "" && opts.JWKSURL == "" {
+		return nil, errors.New("a secret, JWKS file or JWKS URL is required")
+	}
+	if len(opts.Algorithms) == 0 {
+		if opts.Secret != "" {
+			opts.Algorithms = append(opts.Algorithms, hmacAlgorithms...)
+		}
+		if opts.JWKSFile != "" || opts.JWKSURL != "" {
+			opts.Algorithms = append(opts.Algorithms, keyAlgorithms...)
+		}
+	}
+	for _, alg := range opts.Algorithms {
+		if !ValidAlgorithm(alg) {
+			return nil, fmt.Errorf("unsupported algorithm %q", alg)
+		}
+	}
+	if opts.JWKSRefresh <= 0 {
+		opts.JWKSRefresh = time.Hour
+	}
+	parserOpts := []jwt.ParserOption{
+		jwt.WithValidMethods(opts.Algorithms),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(opts.Leeway),
+	}
+	if opts.Issuer != "" {
+		parserOpts = append(parserOpts, jwt.WithIssuer(opts.Issuer))
+	}
+	j := &JWT{opts: opts, parser: jwt.NewParser(parserOpts...)}
+	switch {
+	case opts.JWKSFile != "":
+		f, err := filewatch.New(opts.JWKSFile, parseJWKS)
+		if err != nil {
+			return nil, fmt.Errorf("load JWKS: %w", err)
+		}
+		j.keys = &jwks{file: f}
+	case opts.JWKSURL != "":
+		j.keys = &jwks{url: opts.JWKSURL, refresh: opts.JWKSRefresh}
+		// Failures are logged: servers started while the identity provider
+		// is down fetch the keys once it's back
+		j.keys.fetch()
+	}
+	return j, nil
+}
+
+func (j *JWT) Method() string {
+	return MethodJWT
+}
+
+func (j *JWT) Challenge() string {
+	return "Bearer"
+}
+
+func (j *JWT) Authenticate(r *http.Request) (*Identity, error) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return nil, ErrNoCredentials
+	}
+	// A bearer token that isn't a JWT may be an API key
+	if strings.Count(token, ".") != 2 {
+		return nil, ErrNoCredentials
+	}
+	claims := jwt.MapClaims{}
+	if _, err := j.parser.ParseWithClaims(strings.TrimSpace(token), claims, j.key); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	if len(j.opts.Audience) > 0 {
+		aud, _ := claims.GetAudience()
+		if !slices.ContainsFunc(j.opts.Audience, func(a string) bool { return slices.Contains(aud, a) }) {
+			return nil, fmt.Errorf("%w: token has invalid audience", ErrInvalidCredentials)
+		}
+	}
+	sub, _ := claims.GetSubject()
+	return &Identity{Method: MethodJWT, Subject: sub, Claims: claims}, nil
+}
+
+// key returns the key verifying token.
+func (j *JWT) key(token *jwt.Token) (any, error) {
+	alg := token.Method.Alg()
+	if slices.Contains(hmacAlgorithms, alg) {
+		if j.opts.Secret == "" {
+			return nil, errors.New("no secret for HMAC signed tokens")
+		}
+		return []byte(j.opts.Secret), nil
+	}
+	if j.keys == nil {
+		return nil, errors.New("no JWKS for signed tokens")
+	}
+	kid, _ := token.Header["kid"].(string)
+	return j.keys.key(kid)
+}
+
+// jwks is a key set, read from a watched file or fetched from a URL.
+type jwks struct {
+	file *filewatch.File[map[string]any]
+
+	url     string
+	refresh time.Duration
+
+	mu        sync.Mutex
+	fetched   map[string]any
+	fetchedAt time.Time
+	missAt    time.Time // last refetch for an unknown key
+}
+
+// refetchInterval limits refetches for unknown keys, which tokens signed
+// with made-up key IDs could otherwise trigger on every request.
+const refetchInterval = time.Minute
+
+var jwksClient = &http.Client{Timeout: 10 * time.Second}
+
+// key returns the key with ID kid. Tokens without kid match a set with a single key.
+func (k *jwks) key(kid string) (any, error) {
+	keys := k.current()
+	if key, ok := lookupKey(keys, kid); ok {
+		return key, nil
+	}
+	if k.url != "" {
+		k.mu.Lock()
+		refetch := time.Since(k.missAt) > refetchInterval
+		if refetch {
+			k.missAt = time.Now()
+		}
+		k.mu.Unlock()
+		if refetch {
+			if keys, err := k.fetch(); err == nil {
+				if key, ok := lookupKey(keys, kid); ok {
+					return key, nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+func lookupKey(keys map[string]any, kid string) (any, bool) {
+	if key, ok := keys[kid]; ok {
+		return key, true
+	}
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// current returns the keys, refetching them from the URL once they expired.
+func (k *jwks) current() map[string]any {
+	if k.file != nil {
+		return k.file.Get()
+	}
+	k.mu.Lock()
+	keys, expired := k.fetched, time.Since(k.fetchedAt) > k.refresh
+	k.mu.Unlock()
+	if expired {
+		if fetched, err := k.fetch(); err == nil {
+			return fetched
+		}
+	}
+	return keys
+}
+
+// fetch downloads the key set. Failures keep the keys fetched before.
+func (k *jwks) fetch() (map[string]any, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	// Another request may have fetched the keys meanwhile
+	if k.fetched != nil && time.Since(k.fetchedAt) < time.Second {
+		return k.fetched, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), jwksClient.Timeout)
+	defer cancel()
+	keys, err := getJWKS(ctx, k.url)
+	if err != nil {
+		// Retry on the next request after refetchInterval, not on every one
+		k.fetchedAt = time.Now().Add(refetchInterval - k.refresh)
+		log.WithField("url", k.url).Errorf("Failed to fetch JWKS, keeping the last keys: %v", err)
+		return nil, err
+	}
+	k.fetched, k.fetchedAt = keys, time.Now()
+	log.WithFields(log.Fields{"url": k.url, "keys": len(keys)}).Info("JWKS fetched")
+	return keys, nil
+}
+
+func getJWKS(ctx context.Context, url string) (map[string]any, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := jwksClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
+
+// jwk is a JSON Web Key (RFC 7517).
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS returns the signing keys of a JSON Web Key Set by key ID.
+func parseJWKS(data []byte) (map[string]any, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]any, len(set.Keys))
+	for i, k := range set.Keys {
+		// Skip encryption keys and key types no supported algorithm uses
+		if (k.Use != "" && k.Use != "sig") || (k.Kty != "RSA" && k.Kty != "EC") {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %d (%s): %w", i, k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("n: %w", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("e: %w", err)
+		}
+		if !e.IsInt64() {
+			return nil, errors.New("e: too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x: %w", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("y: %w", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("missing")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
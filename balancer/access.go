@@ -0,0 +1,97 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+
+	"github.com/samsyntax/go-lb/config"
+	"github.com/samsyntax/go-lb/ipfilter"
+	"github.com/samsyntax/go-lb/pool"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+)
+
+// ipFilterFromConfig creates the IP filter of the access rules in c, nil
+// when there are none. Country rules use the GeoIP database at geoIPDB.
+func ipFilterFromConfig(geoIPDB string, c config.RouteAccessConfig) (*ipfilter.Filter, error) {
+	opts := ipfilter.Options{
+		Allow:          c.Allow,
+		Deny:           c.Deny,
+		AllowFile:      c.AllowFile,
+		DenyFile:       c.DenyFile,
+		AllowCountries: c.AllowCountries,
+		DenyCountries:  c.DenyCountries,
+	}
+	if len(c.AllowCountries) > 0 || len(c.DenyCountries) > 0 {
+		if geoIPDB == "" {
+			return nil, errors.New("country rules require a GeoIP database")
+		}
+		g, err := ipfilter.OpenGeoIP(geoIPDB)
+		if err != nil {
+			return nil, fmt.Errorf("GeoIP database: %w", err)
+		}
+		opts.GeoIP = g
+	}
+	return ipfilter.New(opts)
+}
+
+// admit applies the global, then the route's IP filter to the client of r.
+// Denied requests are answered with 403 and admit reports false.
+func (lb *LoadBalancer) admit(ctx context.Context, w http.ResponseWriter, r *http.Request, rt *Route) bool {
+	var routeFilter *ipfilter.Filter
+	if rt != nil {
+		routeFilter = rt.Access
+	}
+	if lb.ipFilter == nil && routeFilter == nil {
+		return true
+	}
+	ip, ok := lb.trustedProxies.ClientIP(r)
+	if !ok {
+		// Not a TCP client address, e.g. a unix socket or a test request
+		return true
+	}
+	for _, f := range []*ipfilter.Filter{lb.ipFilter, routeFilter} {
+		if f == nil {
+			continue
+		}
+		rule, allowed := f.Check(ip)
+		if allowed {
+			continue
+		}
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String("access.denied", rule))
+		fields := log.Fields{"client": ip.String(), "rule": rule}
+		if f == routeFilter {
+			fields["route"] = rt.Name
+		}
+		log.WithFields(fields).Warn("Request denied")
+		if lb.mode == ModeGRPC && pool.IsGRPCRequest(r) {
+			pool.WriteGRPCError(w, codes.PermissionDenied, "access denied")
+			return false
+		}
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// admitConn applies the global IP filter to a TCP mode connection.
+func (lb *LoadBalancer) admitConn(conn net.Conn) bool {
+	if lb.ipFilter == nil {
+		return true
+	}
+	addr, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return true
+	}
+	rule, allowed := lb.ipFilter.Check(addr.Addr())
+	if !allowed {
+		log.WithFields(log.Fields{"client": addr.Addr().String(), "rule": rule}).Warn("Connection denied")
+	}
+	return allowed
+}
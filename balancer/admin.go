@@ -0,0 +1,186 @@
+package balancer
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/samsyntax/go-lb/auth"
+	"github.com/samsyntax/go-lb/cache"
+	"github.com/samsyntax/go-lb/coalesce"
+	"github.com/samsyntax/go-lb/mirror"
+	"github.com/samsyntax/go-lb/pool"
+	"github.com/samsyntax/go-lb/waf"
+	log "github.com/sirupsen/logrus"
+)
+
+// Status is the state of a running balancer as reported by the admin API.
+type Status struct {
+	Method  string        `json:"method"`
+	Mode    string        `json:"mode"`
+	Servers []pool.Status `json:"servers"`
+	Split   *SplitStatus  `json:"split,omitempty"`  // group weights, when traffic is split
+	Mirror  *mirror.Stats `json:"mirror,omitempty"` // shadow pool, when mirroring
+	Cache   *cache.Stats  `json:"cache,omitempty"`  // response cache, when enabled
+	WAF     *waf.Stats    `json:"waf,omitempty"`    // firewall decisions and rule hits, when enabled
+
+	Coalesce    map[string]coalesce.Stats    `json:"coalesce,omitempty"`     // by name of the routes collapsing requests
+	ForwardAuth map[string]auth.ForwardStats `json:"forward_auth,omitempty"` // by name of the routes with forward auth
+}
+
+// Status returns the current state of the balancer and its pool.
+func (lb *LoadBalancer) Status() Status {
+	st := Status{Method: lb.method, Mode: lb.mode, Servers: []pool.Status{}}
+	for _, s := range lb.pool.Servers() {
+		st.Servers = append(st.Servers, s.Status())
+	}
+	if lb.split != nil {
+		ss := lb.split.status()
+		st.Split = &ss
+	}
+	if lb.mirror != nil {
+		ms := lb.mirror.Stats()
+		st.Mirror = &ms
+	}
+	if lb.cache != nil {
+		cs := lb.cache.Stats()
+		st.Cache = &cs
+	}
+	if lb.waf != nil {
+		ws := lb.waf.Stats()
+		st.WAF = &ws
+	}
+	for _, rt := range lb.routes {
+		if rt.Coalesce == nil {
+			continue
+		}
+		if st.Coalesce == nil {
+			st.Coalesce = make(map[string]coalesce.Stats)
+		}
+		st.Coalesce[rt.Name] = rt.Coalesce.Stats()
+	}
+	for _, rt := range lb.routes {
+		if rt.Forward == nil {
+			continue
+		}
+		if st.ForwardAuth == nil {
+			st.ForwardAuth = make(map[string]auth.ForwardStats)
+		}
+		st.ForwardAuth[rt.Name] = rt.Forward.Stats()
+	}
+	return st
+}
+
+// AdminHandler returns the admin API. It is meant to be served on a
+// separate, private address:
+//
+//	GET    /status               balancer and server status
+//	POST   /drain?server=<addr>  stop sending new requests to a server
+//	DELETE /drain?server=<addr>  put a drained server back into rotation
+//	GET    /split                group weights of the traffic split
+//	PUT    /split                change group weights, e.g. {"stable": 90, "canary": 10}
+//	GET    /cache                response cache hits, misses and size
+//	POST   /cache/purge          remove cached responses, all or by ?host=<host>&prefix=<path>
+//	GET    /waf                  firewall decisions and hits per rule
+//
+// Servers are identified by address or name.
+func (lb *LoadBalancer) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, lb.Status())
+	})
+	mux.HandleFunc("POST /drain", func(w http.ResponseWriter, r *http.Request) {
+		lb.adminDrain(w, r, true)
+	})
+	mux.HandleFunc("DELETE /drain", func(w http.ResponseWriter, r *http.Request) {
+		lb.adminDrain(w, r, false)
+	})
+	mux.HandleFunc("GET /split", func(w http.ResponseWriter, r *http.Request) {
+		if lb.split == nil {
+			writeJSON(w, http.StatusNotFound, adminError{Error: "traffic is not split"})
+			return
+		}
+		writeJSON(w, http.StatusOK, lb.split.status())
+	})
+	mux.HandleFunc("PUT /split", lb.adminSplit)
+	mux.HandleFunc("GET /cache", func(w http.ResponseWriter, r *http.Request) {
+		if lb.cache == nil {
+			writeJSON(w, http.StatusNotFound, adminError{Error: "responses are not cached"})
+			return
+		}
+		writeJSON(w, http.StatusOK, lb.cache.Stats())
+	})
+	mux.HandleFunc("POST /cache/purge", func(w http.ResponseWriter, r *http.Request) {
+		if lb.cache == nil {
+			writeJSON(w, http.StatusNotFound, adminError{Error: "responses are not cached"})
+			return
+		}
+		q := r.URL.Query()
+		n := lb.cache.Purge(cache.PurgeOptions{Host: q.Get("host"), Prefix: q.Get("prefix")})
+		writeJSON(w, http.StatusOK, PurgeResult{Purged: n})
+	})
+	mux.HandleFunc("GET /waf", func(w http.ResponseWriter, r *http.Request) {
+		if lb.waf == nil {
+			writeJSON(w, http.StatusNotFound, adminError{Error: "the WAF is not enabled"})
+			return
+		}
+		writeJSON(w, http.StatusOK, lb.waf.Stats())
+	})
+	return mux
+}
+
+func (lb *LoadBalancer) adminDrain(w http.ResponseWriter, r *http.Request, drain bool) {
+	name := r.URL.Query().Get("server")
+	if name == "" {
+		writeJSON(w, http.StatusBadRequest, adminError{Error: "server query parameter is required"})
+		return
+	}
+	s := lb.pool.Find(name)
+	if s == nil {
+		writeJSON(w, http.StatusNotFound, adminError{Error: "unknown server: " + name})
+		return
+	}
+	s.Drain(drain)
+	state := "draining"
+	if !drain {
+		state = "undrained"
+	}
+	log.WithFields(log.Fields{"server": s.Address(), "client": r.RemoteAddr}).Infof("Server %s", state)
+	writeJSON(w, http.StatusOK, s.Status())
+}
+
+func (lb *LoadBalancer) adminSplit(w http.ResponseWriter, r *http.Request) {
+	if lb.split == nil {
+		writeJSON(w, http.StatusNotFound, adminError{Error: "traffic is not split"})
+		return
+	}
+	var weights map[string]int
+	if err := json.NewDecoder(r.Body).Decode(&weights); err != nil {
+		writeJSON(w, http.StatusBadRequest, adminError{Error: "body must map group names to weights: " + err.Error()})
+		return
+	}
+	if err := lb.split.SetWeights(weights); err != nil {
+		writeJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+		return
+	}
+	st := lb.split.status()
+	log.WithFields(log.Fields{"groups": st.Groups, "client": r.RemoteAddr}).Info("Traffic split changed")
+	writeJSON(w, http.StatusOK, st)
+}
+
+// PurgeResult is the response of a cache purge.
+type PurgeResult struct {
+	Purged int `json:"purged"`
+}
+
+// adminError is the body of failed admin API requests.
+type adminError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Failed to write admin response: %v", err)
+	}
+}
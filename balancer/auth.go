@@ -0,0 +1,121 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/samsyntax/go-lb/auth"
+	"github.com/samsyntax/go-lb/pool"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+)
+
+// authorize applies the route's auth policy, then its forward auth, to r.
+// It reports false when the request was rejected and answered.
+func (lb *LoadBalancer) authorize(ctx context.Context, w http.ResponseWriter, r *http.Request, rt *Route) bool {
+	if rt == nil {
+		return true
+	}
+	if rt.Auth != nil && !lb.authenticate(ctx, w, r, rt) {
+		return false
+	}
+	if rt.Forward != nil && !lb.forwardAuth(ctx, w, r, rt) {
+		return false
+	}
+	return true
+}
+
+// authenticate checks r against the route's auth policy. Rejected requests
+// are answered with 401 or 403; let through ones get the configured claim headers.
+func (lb *LoadBalancer) authenticate(ctx context.Context, w http.ResponseWriter, r *http.Request, rt *Route) bool {
+	span := trace.SpanFromContext(ctx)
+	id, err := rt.Auth.Authorize(r)
+	if err == nil {
+		span.SetAttributes(
+			attribute.String("auth.method", id.Method),
+			attribute.String("auth.subject", id.Subject),
+		)
+		rt.Auth.Forward(r, id)
+		return true
+	}
+
+	status := http.StatusUnauthorized
+	var ae *auth.Error
+	if errors.As(err, &ae) {
+		status = ae.Status
+	}
+	span.SetAttributes(attribute.Int("auth.status", status))
+	fields := log.Fields{"client": r.RemoteAddr, "route": rt.Name, "status": status, "reason": err}
+	if id != nil {
+		fields["subject"] = id.Subject
+	}
+	log.WithFields(fields).Warn("Request rejected")
+
+	if lb.mode == ModeGRPC && pool.IsGRPCRequest(r) {
+		code := codes.Unauthenticated
+		if status == http.StatusForbidden {
+			code = codes.PermissionDenied
+		}
+		pool.WriteGRPCError(w, code, http.StatusText(status))
+		return false
+	}
+	if status == http.StatusUnauthorized {
+		for _, c := range rt.Auth.Challenges() {
+			w.Header().Add("WWW-Authenticate", c)
+		}
+	}
+	http.Error(w, http.StatusText(status), status)
+	return false
+}
+
+// forwardAuth asks the route's authorization service about r. Allowed
+// requests get the configured headers of its answer, denied ones the answer
+// itself, and requests the service fails to answer 503.
+func (lb *LoadBalancer) forwardAuth(ctx context.Context, w http.ResponseWriter, r *http.Request, rt *Route) bool {
+	span := trace.SpanFromContext(ctx)
+	grpc := lb.mode == ModeGRPC && pool.IsGRPCRequest(r)
+	d, cached, err := rt.Forward.Check(ctx, r)
+	if err != nil {
+		if ctx.Err() != nil {
+			return false
+		}
+		span.SetAttributes(attribute.Int("auth.status", http.StatusServiceUnavailable))
+		log.WithFields(log.Fields{"client": r.RemoteAddr, "route": rt.Name}).Errorf("Forward auth failed: %v", err)
+		if grpc {
+			pool.WriteGRPCError(w, codes.Unavailable, "authorization service unavailable")
+			return false
+		}
+		http.Error(w, "authorization service unavailable", http.StatusServiceUnavailable)
+		return false
+	}
+	span.SetAttributes(
+		attribute.Int("forward_auth.status", d.Status),
+		attribute.Bool("forward_auth.cached", cached),
+	)
+	if d.Allowed() {
+		rt.Forward.Apply(r, d)
+		return true
+	}
+
+	span.SetAttributes(attribute.Int("auth.status", d.Status))
+	log.WithFields(log.Fields{
+		"client": r.RemoteAddr,
+		"route":  rt.Name,
+		"status": d.Status,
+		"cached": cached,
+		"reason": "denied by authorization service",
+	}).Warn("Request rejected")
+	if grpc {
+		code := codes.PermissionDenied
+		if d.Status == http.StatusUnauthorized {
+			code = codes.Unauthenticated
+		}
+		pool.WriteGRPCError(w, code, http.StatusText(d.Status))
+		return false
+	}
+	d.Write(w)
+	return false
+}
@@ -0,0 +1,577 @@
+// Package balancer is the embeddable load balancer. A LoadBalancer is an
+// http.Handler forwarding every request to the next server of its pool,
+// with optional gRPC call balancing, TCP forwarding and discovery:
+//
+//	lb, err := balancer.New(
+//		balancer.WithServers(a, b),
+//		balancer.WithMethod(balancer.MethodWeighted),
+//	)
+//	if err != nil { ... }
+//	lb.Start(ctx)
+//	http.ListenAndServe(":7000", lb)
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/samsyntax/go-lb/cache"
+	"github.com/samsyntax/go-lb/compress"
+	"github.com/samsyntax/go-lb/config"
+	"github.com/samsyntax/go-lb/discovery"
+	"github.com/samsyntax/go-lb/ipfilter"
+	"github.com/samsyntax/go-lb/mirror"
+	"github.com/samsyntax/go-lb/pool"
+	"github.com/samsyntax/go-lb/recorder"
+	"github.com/samsyntax/go-lb/telemetry"
+	"github.com/samsyntax/go-lb/waf"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Balancing methods
+const (
+	MethodRoundRobin = "rr"  // every server in turn
+	MethodWeighted   = "wrr" // servers in turn, proportionally to their weight
+)
+
+// Proxy modes
+const (
+	ModeHTTP = "http" // forward HTTP requests
+	ModeGRPC = "grpc" // balance individual gRPC calls and use gRPC health checks
+	ModeTCP  = "tcp"  // forward raw TCP connections
+)
+
+type LoadBalancer struct {
+	pool   *pool.Pool
+	method string
+	mode   string
+	tracer trace.Tracer
+
+	backendHeader       string
+	recorder            *recorder.Recorder
+	healthCheckInterval time.Duration
+	discovery           discovery.Discovery
+	discoveryInterval   time.Duration
+	routes              []Route
+	mirror              *mirror.Mirror
+	split               *Split
+	cache               *cache.Cache
+	compressor          *compress.Compressor
+	ipFilter            *ipfilter.Filter
+	trustedProxies      ipfilter.TrustedProxies
+	limits              Limits
+	waf                 *waf.WAF
+}
+
+type options struct {
+	servers             []*pool.Server
+	method              string
+	mode                string
+	tracer              trace.Tracer
+	backendHeader       string
+	recorder            *recorder.Recorder
+	healthCheckInterval time.Duration
+	discovery           discovery.Discovery
+	discoveryInterval   time.Duration
+	routes              []Route
+	mirror              *mirror.Mirror
+	split               *Split
+	cache               *cache.Options
+	compressor          *compress.Compressor
+	ipFilter            *ipfilter.Filter
+	trustedProxies      ipfilter.TrustedProxies
+	limits              Limits
+	waf                 *waf.WAF
+	transport           config.TransportConfig
+}
+
+// Option configures a LoadBalancer created with New.
+type Option func(*options)
+
+// WithServers sets the initial servers of the pool.
+func WithServers(servers ...*pool.Server) Option {
+	return func(o *options) { o.servers = append(o.servers, servers...) }
+}
+
+// WithMethod sets the balancing method, MethodRoundRobin by default.
+func WithMethod(method string) Option {
+	return func(o *options) { o.method = method }
+}
+
+// WithMode sets the proxy mode, ModeHTTP by default.
+func WithMode(mode string) Option {
+	return func(o *options) { o.mode = mode }
+}
+
+// WithTracer sets the tracer spans are started with, the global "go-lb"
+// tracer by default.
+func WithTracer(tracer trace.Tracer) Option {
+	return func(o *options) { o.tracer = tracer }
+}
+
+// WithBackendHeader adds a response header with the name of the server that
+// answered, e.g. to see the distribution of requests from a client.
+func WithBackendHeader(name string) Option {
+	return func(o *options) { o.backendHeader = name }
+}
+
+// WithRecorder records sampled requests with r. The balancer closes r in Close.
+func WithRecorder(r *recorder.Recorder) Option {
+	return func(o *options) { o.recorder = r }
+}
+
+// WithHealthCheckInterval makes Start check every server each interval. Zero disables periodic checks.
+func WithHealthCheckInterval(interval time.Duration) Option {
+	return func(o *options) { o.healthCheckInterval = interval }
+}
+
+// WithDiscovery fills the pool from d when Start is called and, with a
+// non-zero interval, keeps it in sync afterwards.
+func WithDiscovery(d discovery.Discovery, interval time.Duration) Option {
+	return func(o *options) {
+		o.discovery = d
+		o.discoveryInterval = interval
+	}
+}
+
+// WithTransport sets the transport settings of servers discovery adds to
+// the pool; fields their entries set take precedence. Servers passed with
+// WithServers keep their own.
+func WithTransport(t config.TransportConfig) Option {
+	return func(o *options) { o.transport = t }
+}
+
+// WithMirror sends copies of sampled requests to m's shadow pool. Start
+// health checks the shadow pool along with the primary one.
+func WithMirror(m *mirror.Mirror) Option {
+	return func(o *options) { o.mirror = m }
+}
+
+// WithCache answers requests from a response cache where possible. Unless
+// set, opts.Available reports whether the pool has servers available.
+func WithCache(opts cache.Options) Option {
+	return func(o *options) { o.cache = &opts }
+}
+
+// WithCompression compresses responses, and decompresses requests if enabled, with c.
+func WithCompression(c *compress.Compressor) Option {
+	return func(o *options) { o.compressor = c }
+}
+
+// WithIPFilter rejects requests, or connections in TCP mode, from client
+// addresses f doesn't allow. Routes can add their own filters.
+func WithIPFilter(f *ipfilter.Filter) Option {
+	return func(o *options) { o.ipFilter = f }
+}
+
+// WithTrustedProxies makes IP filters take the client address from
+// X-Forwarded-For when a request comes from one of the proxies.
+func WithTrustedProxies(proxies ipfilter.TrustedProxies) Option {
+	return func(o *options) { o.trustedProxies = proxies }
+}
+
+// WithWAF inspects requests with f before they are forwarded. Routes can
+// change its mode and disable rules.
+func WithWAF(f *waf.WAF) Option {
+	return func(o *options) { o.waf = f }
+}
+
+// New creates a load balancer. It serves requests right away; call Start to
+// run discovery and health checks in the background.
+func New(opts ...Option) (*LoadBalancer, error) {
+	o := options{method: MethodRoundRobin, mode: ModeHTTP}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.method != MethodRoundRobin && o.method != MethodWeighted {
+		return nil, fmt.Errorf("unknown balancing method: %s", o.method)
+	}
+	tracer := o.tracer
+	if tracer == nil {
+		tracer = otel.Tracer(telemetry.ServiceName)
+	}
+	lb := &LoadBalancer{
+		pool:                pool.New(o.servers, o.method == MethodWeighted),
+		method:              o.method,
+		mode:                o.mode,
+		tracer:              tracer,
+		backendHeader:       o.backendHeader,
+		recorder:            o.recorder,
+		healthCheckInterval: o.healthCheckInterval,
+		discovery:           o.discovery,
+		discoveryInterval:   o.discoveryInterval,
+		routes:              o.routes,
+		mirror:              o.mirror,
+		split:               o.split,
+		compressor:          o.compressor,
+		ipFilter:            o.ipFilter,
+		trustedProxies:      o.trustedProxies,
+		limits:              o.limits,
+		waf:                 o.waf,
+	}
+	lb.pool.SetTransport(o.transport)
+	switch o.mode {
+	case ModeHTTP:
+	case ModeGRPC:
+		lb.pool.EnableGRPC()
+	case ModeTCP:
+		lb.pool.EnableTCP()
+	default:
+		return nil, fmt.Errorf("unknown proxy mode: %s", o.mode)
+	}
+	if o.cache != nil {
+		opts := *o.cache
+		if opts.Available == nil {
+			opts.Available = lb.pool.Available
+		}
+		if opts.Detach == nil {
+			// Background revalidations record nothing on the request they were started by
+			opts.Detach = func(ctx context.Context) context.Context {
+				return context.WithValue(context.WithoutCancel(ctx), requestInfoKey{}, &requestInfo{})
+			}
+		}
+		c, err := cache.New(opts)
+		if err != nil {
+			return nil, fmt.Errorf("cache: %w", err)
+		}
+		lb.cache = c
+	}
+	return lb, nil
+}
+
+// NewFromConfig creates a load balancer from a loaded config. Every
+// environment except local gets its discovery provider; servers of the local
+// environment have to be passed with WithServers. opts are applied last.
+func NewFromConfig(cfg *config.Config, opts ...Option) (*LoadBalancer, error) {
+	routes, err := RoutesFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	base := []Option{
+		WithMethod(cfg.Balancer.Method),
+		WithMode(cfg.Balancer.Mode),
+		WithBackendHeader(cfg.Balancer.BackendHeader),
+		WithHealthCheckInterval(cfg.HealthCheck.Interval.Std()),
+		WithRoutes(routes...),
+		WithTransport(cfg.Transport),
+		WithLimits(LimitsFromConfig(config.RouteLimitsConfig{
+			ReadTimeout:           cfg.Limits.ReadTimeout,
+			WriteTimeout:          cfg.Limits.WriteTimeout,
+			MaxBodySize:           cfg.Limits.MaxBodySize,
+			UpstreamTimeout:       cfg.Limits.UpstreamTimeout,
+			UpstreamHeaderTimeout: cfg.Limits.UpstreamHeaderTimeout,
+		})),
+	}
+	if cfg.Environment != "local" {
+		d, interval, err := discovery.FromConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		base = append(base, WithDiscovery(d, interval))
+	}
+	split, err := SplitFromConfig(cfg.Split)
+	if err != nil {
+		return nil, err
+	}
+	if split != nil {
+		base = append(base, WithSplit(split))
+	}
+	if mc := cfg.Mirror; mc.Percentage > 0 {
+		shadows := make([]*pool.Server, 0, len(mc.Servers))
+		for k, spec := range mc.Servers {
+			spec.Transport = cfg.Transport.Merge(spec.Transport)
+			srv, err := pool.FromConfig(spec, pool.WithName("Shadow "+strconv.Itoa(k)))
+			if err != nil {
+				return nil, fmt.Errorf("mirror: %w", err)
+			}
+			shadows = append(shadows, srv)
+		}
+		base = append(base, WithMirror(mirror.New(pool.New(shadows, cfg.Balancer.Method == MethodWeighted), mirror.Options{
+			Percentage:  mc.Percentage,
+			MaxBodySize: mc.MaxBodySize,
+			Timeout:     mc.Timeout.Std(),
+			MaxInFlight: mc.MaxInFlight,
+		})))
+	}
+	if cc := cfg.Cache; cc.Enabled {
+		base = append(base, WithCache(cache.Options{
+			MaxSize:      cc.MaxSize,
+			MaxEntrySize: cc.MaxEntrySize,
+			Dir:          cc.Dir,
+			MaxDiskSize:  cc.MaxDiskSize,
+			StaleIfError: cc.StaleIfError.Std(),
+		}))
+	}
+	if cc := cfg.Compression; cc.Enabled {
+		c, err := compress.New(compress.Options{
+			Encodings:          cc.Encodings,
+			MinSize:            cc.MinSize,
+			ContentTypes:       cc.ContentTypes,
+			DecompressRequests: cc.DecompressRequests,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("compression: %w", err)
+		}
+		base = append(base, WithCompression(c))
+	}
+	ac := cfg.Access
+	if len(ac.TrustedProxies) > 0 {
+		proxies, err := ipfilter.ParseTrustedProxies(ac.TrustedProxies)
+		if err != nil {
+			return nil, fmt.Errorf("access: trusted proxies: %w", err)
+		}
+		base = append(base, WithTrustedProxies(proxies))
+	}
+	f, err := ipFilterFromConfig(ac.GeoIPDB, config.RouteAccessConfig{
+		Allow:          ac.Allow,
+		Deny:           ac.Deny,
+		AllowFile:      ac.AllowFile,
+		DenyFile:       ac.DenyFile,
+		AllowCountries: ac.AllowCountries,
+		DenyCountries:  ac.DenyCountries,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("access: %w", err)
+	}
+	if f != nil {
+		base = append(base, WithIPFilter(f))
+	}
+	if wc := cfg.WAF; wc.Enabled {
+		f, err := waf.New(waf.Options{
+			RulesFile:       wc.RulesFile,
+			Mode:            waf.Mode(wc.Mode),
+			Threshold:       wc.Threshold,
+			MaxBodySize:     wc.MaxBodySize,
+			ChallengeSecret: []byte(wc.ChallengeSecret),
+			ChallengeTTL:    wc.ChallengeTTL.Std(),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("waf: %w", err)
+		}
+		warnUnknownRules(f, routes)
+		base = append(base, WithWAF(f))
+	}
+	var rec *recorder.Recorder
+	if rc := cfg.Recording; rc.File != "" {
+		var err error
+		rec, err = recorder.New(recorder.Options{
+			File:          rc.File,
+			SampleRate:    rc.SampleRate,
+			RedactHeaders: rc.RedactHeaders,
+			MaxBodySize:   rc.MaxBodySize,
+			Responses:     rc.Responses,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("open recording: %w", err)
+		}
+		base = append(base, WithRecorder(rec))
+	}
+	lb, err := New(append(base, opts...)...)
+	if err != nil && rec != nil {
+		rec.Close()
+	}
+	return lb, err
+}
+
+// Pool returns the server pool the balancer forwards to.
+func (lb *LoadBalancer) Pool() *pool.Pool {
+	return lb.pool
+}
+
+// Method returns the balancing method.
+func (lb *LoadBalancer) Method() string {
+	return lb.method
+}
+
+// Mode returns the proxy mode.
+func (lb *LoadBalancer) Mode() string {
+	return lb.mode
+}
+
+// Servers returns a snapshot of the current pool.
+func (lb *LoadBalancer) Servers() []*pool.Server {
+	return lb.pool.Servers()
+}
+
+// Refresh fills the pool from discovery once. It does nothing when the
+// balancer has no discovery provider.
+func (lb *LoadBalancer) Refresh(ctx context.Context) error {
+	if lb.discovery == nil {
+		return nil
+	}
+	return discovery.Sync(ctx, lb.discovery, lb.pool)
+}
+
+// Close releases what the balancer holds open, e.g. the recording file.
+// Background work is stopped by cancelling the context passed to Start.
+func (lb *LoadBalancer) Close() error {
+	if lb.recorder != nil {
+		return lb.recorder.Close()
+	}
+	return nil
+}
+
+// Start fills the pool from discovery, checks every server once and keeps
+// discovery and health checks running in the background until ctx is done.
+func (lb *LoadBalancer) Start(ctx context.Context) {
+	// Failures are logged, the pool keeps its servers and discovery retries
+	_ = lb.Refresh(ctx)
+	lb.pool.CheckAll()
+	if lb.mirror != nil {
+		lb.mirror.Pool().CheckAll()
+	}
+	if lb.discovery != nil && lb.discoveryInterval > 0 {
+		go discovery.Run(ctx, lb.discovery, lb.pool, lb.discoveryInterval)
+	}
+	if lb.healthCheckInterval > 0 {
+		lb.pool.HealthCheck(ctx, lb.healthCheckInterval)
+		if lb.mirror != nil {
+			lb.mirror.Pool().HealthCheck(ctx, lb.healthCheckInterval)
+		}
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, span := lb.tracer.Start(r.Context(), "HTTP "+r.Method)
+	defer span.End()
+
+	info := &requestInfo{}
+	ctx = context.WithValue(ctx, requestInfoKey{}, info)
+	if lb.recorder != nil && lb.recorder.Sample() {
+		var c *recorder.Capture
+		c, w, r = lb.recorder.Capture(w, r)
+		defer func() { c.Done(info.backend) }()
+	}
+	rt := lb.route(ctx, r)
+	if !lb.admit(ctx, w, r, rt) {
+		return
+	}
+	if rt != nil && rt.CORS != nil {
+		// Before authentication: preflights carry no credentials, and
+		// browsers only let scripts read rejections with CORS headers
+		rt.CORS.Serve(w, r, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lb.serveRoute(ctx, w, r, rt)
+		}))
+		return
+	}
+	lb.serveRoute(ctx, w, r, rt)
+}
+
+// serveRoute authorizes, limits and inspects r, then passes it through the
+// response layers to the proxy.
+func (lb *LoadBalancer) serveRoute(ctx context.Context, w http.ResponseWriter, r *http.Request, rt *Route) {
+	// Bodies are decoded before the WAF reads them, so its rules see what
+	// the servers get
+	if !lb.authorize(ctx, w, r, rt) || !lb.limit(w, r, rt) || !lb.decompress(w, r, rt) || !lb.inspect(ctx, w, r, rt) {
+		return
+	}
+
+	// Layers from the client inwards: compression, cache, coalescing and the proxy.
+	// Responses to authenticated requests belong to their subject, whatever
+	// header carried the credentials, so they are neither cached nor shared.
+	authenticated := rt != nil && (rt.Auth != nil || rt.Forward != nil)
+	var next http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lb.ServeProxy(w, r, r.Context())
+	})
+	if rt != nil && rt.Coalesce != nil && !authenticated {
+		next = layer(next, rt.Coalesce.Serve)
+	}
+	if !pool.IsGRPCRequest(r) {
+		if lb.cache != nil && !authenticated {
+			next = layer(next, lb.cache.Serve)
+		}
+		if lb.compressor != nil {
+			next = layer(next, lb.compressor.Serve)
+		}
+	}
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// decompress decodes the body of r when the compressor decompresses
+// requests, applying the body size limit of rt to the decoded body too.
+// gRPC messages carry their own compression and are left alone.
+func (lb *LoadBalancer) decompress(w http.ResponseWriter, r *http.Request, rt *Route) bool {
+	if lb.compressor == nil || pool.IsGRPCRequest(r) {
+		return true
+	}
+	return lb.compressor.Decompress(w, r, lb.limitsFor(rt).MaxBodySize)
+}
+
+// layer wraps next in serve, a middleware such as cache.Cache.Serve.
+func layer(next http.Handler, serve func(http.ResponseWriter, *http.Request, http.Handler)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serve(w, r, next)
+	})
+}
+
+// Cache returns the response cache, nil when responses aren't cached.
+func (lb *LoadBalancer) Cache() *cache.Cache {
+	return lb.cache
+}
+
+// requestInfo collects what the balancer decided for a request while it is served.
+type requestInfo struct {
+	backend string // address of the server the request was forwarded to
+	group   string // server group picked by the split, empty when traffic isn't split
+	route   *Route // route the request matched, nil for none
+	routed  bool   // set once the route was matched
+}
+
+type requestInfoKey struct{}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// ServeProxy forwards r to the next server, starting spans under ctx.
+// Faults of the matching route are injected first, and sampled requests are
+// mirrored to the shadow pool once they were served.
+func (lb *LoadBalancer) ServeProxy(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+	rt := lb.route(ctx, r)
+	if lb.injectFault(ctx, w, r, rt) {
+		return
+	}
+	ctx, r, release := upstreamDeadline(ctx, r, lb.limitsFor(rt))
+	defer release()
+	if lb.mode == ModeGRPC && pool.IsGRPCRequest(r) {
+		lb.serveGRPC(w, r, ctx)
+		return
+	}
+	if lb.mirror != nil && lb.mirror.Sample(r) {
+		var shadow *mirror.Shadow
+		shadow, r = lb.mirror.Capture(r)
+		defer shadow.Send()
+	}
+	targetServer := lb.next(ctx, r)
+	if targetServer == nil {
+		http.Error(w, "no servers available", http.StatusServiceUnavailable)
+		return
+	}
+	msg := fmt.Sprintf("Forwarding to %s\n", targetServer.Address())
+	_, span := lb.tracer.Start(ctx, msg)
+	defer span.End()
+	fields := log.Fields{"client": r.RemoteAddr}
+	if info := requestInfoFrom(ctx); info != nil && info.group != "" {
+		fields["group"] = info.group
+	}
+	log.WithFields(fields).Info(msg)
+	lb.forwarding(ctx, w, targetServer)
+	targetServer.Serve(w, r)
+}
+
+// forwarding notes that the request is about to be forwarded to s.
+func (lb *LoadBalancer) forwarding(ctx context.Context, w http.ResponseWriter, s *pool.Server) {
+	if info := requestInfoFrom(ctx); info != nil {
+		info.backend = s.Address()
+	}
+	if lb.backendHeader != "" {
+		w.Header().Set(lb.backendHeader, s.Name())
+	}
+}
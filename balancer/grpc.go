@@ -0,0 +1,184 @@
+package balancer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/samsyntax/go-lb/pool"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	grpcMaxAttempts   = 2        // attempts per call, retries go to the next server
+	grpcMaxReplayBody = 64 << 10 // calls with larger request bodies are never retried
+)
+
+// errReplayOverflow fails a retry whose request body couldn't be recorded in full.
+var errReplayOverflow = errors.New("request body too large to replay")
+
+// serveGRPC proxies a single gRPC call. Every call picks its own server, so
+// calls multiplexed over one client connection spread across the pool.
+func (lb *LoadBalancer) serveGRPC(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+	body := newReplayBody(r.Body)
+	for i := 0; i < grpcMaxAttempts; i++ {
+		target := lb.next(ctx, r)
+		if target == nil {
+			pool.WriteGRPCError(w, codes.Unavailable, "no servers available")
+			return
+		}
+		ctx, span := lb.tracer.Start(ctx, "Forwarding to "+target.Address())
+		span.SetAttributes(
+			attribute.String("rpc.system", "grpc"),
+			attribute.String("grpc.method", r.URL.Path),
+			attribute.Int("grpc.attempt", i+1),
+		)
+
+		var a *pool.Attempt
+		if i < grpcMaxAttempts-1 {
+			ctx, a = pool.WithAttempt(ctx)
+		}
+		req := r.Clone(ctx)
+		if r.Body != nil && r.Body != http.NoBody {
+			req.Body = body.reader()
+		}
+		log.WithFields(log.Fields{"grpc.method": r.URL.Path}).Infof("Forwarding to %s", target.Address())
+		lb.forwarding(ctx, w, target)
+		target.Serve(w, req)
+
+		if a != nil && a.Err != nil {
+			status, code := pool.ErrorStatus(ctx, a.Err)
+			target.RecordGRPC(code)
+			span.SetAttributes(attribute.String("grpc.status_code", code.String()))
+			span.RecordError(a.Err)
+			span.End()
+			// Only calls the server failed are retried, not timed out or oversized ones
+			if code == codes.Unavailable && body.replayable() {
+				continue
+			}
+			msg := "upstream unavailable"
+			if code != codes.Unavailable {
+				msg = http.StatusText(status)
+			}
+			pool.WriteGRPCError(w, code, msg)
+			return
+		}
+		code, ok := pool.GRPCStatus(w.Header())
+		if !ok {
+			code = codes.Unknown
+		}
+		target.RecordGRPC(code)
+		span.SetAttributes(attribute.String("grpc.status_code", code.String()))
+		span.End()
+		return
+	}
+}
+
+// replayBody records the request stream as it is consumed so a failed
+// attempt can be replayed on another server without buffering the whole
+// body up front, which would deadlock client and bidi streaming calls.
+type replayBody struct {
+	mu       sync.Mutex
+	cond     *sync.Cond // broadcast when a read of src returns or a new reader starts
+	src      io.ReadCloser
+	buf      bytes.Buffer
+	read     int   // bytes read from src, more than buf holds once it overflowed
+	err      error // returned by src, given to readers once they replayed buf
+	reading  bool  // a reader is blocked in src.Read, without holding mu
+	overflow bool  // more than grpcMaxReplayBody was read, the call can't be replayed
+	gen      int   // generation of the active reader, older readers are cut off
+}
+
+func newReplayBody(src io.ReadCloser) *replayBody {
+	b := &replayBody{src: src}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *replayBody) replayable() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.overflow
+}
+
+// reader returns a fresh reader that replays what was recorded so far and
+// continues with the rest of the stream.
+func (b *replayBody) reader() io.ReadCloser {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.gen++
+	b.cond.Broadcast()
+	return &replayReader{b: b, gen: b.gen}
+}
+
+type replayReader struct {
+	b   *replayBody
+	gen int
+	off int
+}
+
+// Read replays the recorded stream, then reads src. The failed attempt's
+// transport may still be blocked in src.Read, so src is read without holding
+// the lock, one reader at a time, and what a cut off reader gets is recorded
+// for the active one.
+func (rr *replayReader) Read(p []byte) (int, error) {
+	b := rr.b
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		switch {
+		case rr.gen != b.gen:
+			return 0, io.ErrClosedPipe
+		case rr.off < b.buf.Len():
+			n := copy(p, b.buf.Bytes()[rr.off:])
+			rr.off += n
+			return n, nil
+		case rr.off < b.read:
+			// A cut off reader consumed more than could be recorded
+			return 0, errReplayOverflow
+		case b.err != nil:
+			return 0, b.err
+		case !b.reading:
+			return rr.readSrc(p)
+		}
+		b.cond.Wait()
+	}
+}
+
+// readSrc reads src with b.mu held on entry and on return, but not meanwhile.
+func (rr *replayReader) readSrc(p []byte) (int, error) {
+	b := rr.b
+	b.reading = true
+	b.mu.Unlock()
+	n, err := b.src.Read(p)
+	b.mu.Lock()
+	b.reading = false
+	b.cond.Broadcast()
+
+	b.read += n
+	if n > 0 && !b.overflow {
+		if b.buf.Len()+n > grpcMaxReplayBody {
+			b.overflow = true
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err != nil {
+		b.err = err
+	}
+	if rr.gen != b.gen {
+		return 0, io.ErrClosedPipe
+	}
+	rr.off += n
+	return n, err
+}
+
+// Close only releases the underlying stream once the active attempt is done with it.
+func (rr *replayReader) Close() error {
+	return nil
+}
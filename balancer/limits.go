@@ -0,0 +1,190 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/samsyntax/go-lb/config"
+	"github.com/samsyntax/go-lb/pool"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+)
+
+// Limits bound the size of requests and the time spent on them. Zero fields
+// are unlimited for the balancer, and keep the balancer's limits for routes.
+type Limits struct {
+	ReadTimeout           time.Duration // to receive the request body, answered with 408 after
+	WriteTimeout          time.Duration // to send the response
+	MaxBodySize           int64         // larger request bodies are answered with 413
+	UpstreamTimeout       time.Duration // for the server's whole response, answered with 504 unless it started
+	UpstreamHeaderTimeout time.Duration // for the server's response headers, answered with 504
+}
+
+// WithLimits sets the limits of every request. Routes can override them.
+func WithLimits(l Limits) Option {
+	return func(o *options) { o.limits = l }
+}
+
+// LimitsFromConfig converts configured limits.
+func LimitsFromConfig(c config.RouteLimitsConfig) Limits {
+	return Limits{
+		ReadTimeout:           c.ReadTimeout.Std(),
+		WriteTimeout:          c.WriteTimeout.Std(),
+		MaxBodySize:           c.MaxBodySize,
+		UpstreamTimeout:       c.UpstreamTimeout.Std(),
+		UpstreamHeaderTimeout: c.UpstreamHeaderTimeout.Std(),
+	}
+}
+
+// override returns l with the non-zero limits of o.
+func (l Limits) override(o Limits) Limits {
+	if o.ReadTimeout != 0 {
+		l.ReadTimeout = o.ReadTimeout
+	}
+	if o.WriteTimeout != 0 {
+		l.WriteTimeout = o.WriteTimeout
+	}
+	if o.MaxBodySize != 0 {
+		l.MaxBodySize = o.MaxBodySize
+	}
+	if o.UpstreamTimeout != 0 {
+		l.UpstreamTimeout = o.UpstreamTimeout
+	}
+	if o.UpstreamHeaderTimeout != 0 {
+		l.UpstreamHeaderTimeout = o.UpstreamHeaderTimeout
+	}
+	return l
+}
+
+// limitsFor returns the limits of requests matching rt.
+func (lb *LoadBalancer) limitsFor(rt *Route) Limits {
+	if rt == nil {
+		return lb.limits
+	}
+	return lb.limits.override(rt.Limits)
+}
+
+// limit applies the read and write timeouts and the body size limit of rt
+// to r. Requests announcing a body over the limit are answered with 413 and
+// limit reports false. The server clears the deadlines after the request.
+func (lb *LoadBalancer) limit(w http.ResponseWriter, r *http.Request, rt *Route) bool {
+	l := lb.limitsFor(rt)
+	if l.MaxBodySize > 0 && r.ContentLength > l.MaxBodySize {
+		log.WithFields(log.Fields{"client": r.RemoteAddr, "size": r.ContentLength, "limit": l.MaxBodySize}).Warn("Request body too large")
+		if lb.mode == ModeGRPC && pool.IsGRPCRequest(r) {
+			pool.WriteGRPCError(w, codes.ResourceExhausted, http.StatusText(http.StatusRequestEntityTooLarge))
+			return false
+		}
+		w.Header().Set("Connection", "close")
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return false
+	}
+	rc := http.NewResponseController(w)
+	if r.Body != nil && r.Body != http.NoBody {
+		if l.MaxBodySize > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, l.MaxBodySize)
+		}
+		body := &deadlineBody{ReadCloser: r.Body}
+		// The read deadline only covers the body: once it was read, the
+		// server's background read would cancel the request when it passes.
+		if l.ReadTimeout > 0 {
+			if err := rc.SetReadDeadline(time.Now().Add(l.ReadTimeout)); err == nil {
+				body.rc = rc
+			} else if !errors.Is(err, http.ErrNotSupported) {
+				log.Debugf("Failed to set read deadline: %v", err)
+			}
+		}
+		r.Body = body
+	}
+
+	if l.WriteTimeout > 0 {
+		if err := rc.SetWriteDeadline(time.Now().Add(l.WriteTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			log.Debugf("Failed to set write deadline: %v", err)
+		}
+	}
+	return true
+}
+
+// deadlineBody reports read deadlines passing while the body is received as
+// pool.ErrBodyTimeout, and clears the deadline once the body was read.
+type deadlineBody struct {
+	io.ReadCloser
+	rc *http.ResponseController // set while a read deadline is active
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	switch {
+	case err == io.EOF && b.rc != nil:
+		b.rc.SetReadDeadline(time.Time{})
+		b.rc = nil
+	case err != nil && errors.Is(err, os.ErrDeadlineExceeded):
+		err = pool.ErrBodyTimeout
+	}
+	return n, err
+}
+
+// upstreamDeadline derives a context from ctx that is canceled with
+// pool.ErrUpstreamTimeout once the upstream timeouts of l pass, and returns
+// it with r using it. The returned func releases the timers.
+func upstreamDeadline(ctx context.Context, r *http.Request, l Limits) (context.Context, *http.Request, func()) {
+	if l.UpstreamTimeout <= 0 && l.UpstreamHeaderTimeout <= 0 {
+		return ctx, r, func() {}
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	var timers []*time.Timer
+	timeout := func() { cancel(pool.ErrUpstreamTimeout) }
+	if l.UpstreamTimeout > 0 {
+		timers = append(timers, time.AfterFunc(l.UpstreamTimeout, timeout))
+	}
+	var header headerTimer
+	if l.UpstreamHeaderTimeout > 0 {
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			WroteRequest:         func(httptrace.WroteRequestInfo) { header.start(l.UpstreamHeaderTimeout, timeout) },
+			GotFirstResponseByte: header.stop,
+		})
+	}
+	return ctx, r.WithContext(ctx), func() {
+		for _, t := range timers {
+			t.Stop()
+		}
+		header.stop()
+		cancel(context.Canceled)
+	}
+}
+
+// headerTimer bounds the wait for response headers, from when the request
+// was fully written, like http.Transport.ResponseHeaderTimeout but per request.
+type headerTimer struct {
+	mu      sync.Mutex
+	t       *time.Timer
+	stopped bool
+}
+
+func (h *headerTimer) start(d time.Duration, f func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stopped {
+		return
+	}
+	if h.t != nil {
+		// The transport retried the request on a new connection
+		h.t.Stop()
+	}
+	h.t = time.AfterFunc(d, f)
+}
+
+func (h *headerTimer) stop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stopped = true
+	if h.t != nil {
+		h.t.Stop()
+	}
+}
@@ -0,0 +1,135 @@
+package balancer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/samsyntax/go-lb/config"
+	"github.com/samsyntax/go-lb/proxyproto"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// ListenerConfig describes how the balancer port accepts connections.
+type ListenerConfig struct {
+	Port     int    // port the balancer listens on
+	CertFile string // TLS certificate, enables HTTP/2 over TLS together with KeyFile
+	KeyFile  string // TLS private key
+	H2C      bool   // accept cleartext HTTP/2 (prior knowledge and Upgrade: h2c)
+
+	ProxyProtocol  bool         // accept PROXY protocol v1/v2 headers
+	TrustedProxies []*net.IPNet // sources allowed to send PROXY protocol headers
+
+	ReadHeaderTimeout time.Duration // clients sending their request headers slower are disconnected
+	IdleTimeout       time.Duration // keep-alive connections are closed after being idle this long
+	MaxHeaderBytes    int           // larger request headers are answered with 431
+}
+
+// NewListenerConfig derives the listener settings from a loaded config.
+// gRPC mode always accepts h2c, gRPC clients need HTTP/2 on the balancer port.
+func NewListenerConfig(cfg *config.Config) (ListenerConfig, error) {
+	trusted, err := proxyproto.ParseTrustedProxies(cfg.Balancer.ProxyProtocol.TrustedProxies)
+	if err != nil {
+		return ListenerConfig{}, fmt.Errorf("parse trusted proxies: %w", err)
+	}
+	return ListenerConfig{
+		Port:           cfg.Balancer.Port,
+		CertFile:       cfg.Balancer.TLS.CertFile,
+		KeyFile:        cfg.Balancer.TLS.KeyFile,
+		H2C:            cfg.Balancer.H2C || cfg.Balancer.Mode == ModeGRPC,
+		ProxyProtocol:  cfg.Balancer.ProxyProtocol.Enabled,
+		TrustedProxies: trusted,
+
+		ReadHeaderTimeout: cfg.Limits.ReadHeaderTimeout.Std(),
+		IdleTimeout:       cfg.Limits.IdleTimeout.Std(),
+		MaxHeaderBytes:    cfg.Limits.MaxHeaderBytes,
+	}, nil
+}
+
+func (c ListenerConfig) tls() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+// NewListenerServer builds the http.Server for the balancer port with HTTP/2
+// enabled over TLS and, optionally, over cleartext. Request timeouts and body
+// limits are applied by the balancer per route, the server only bounds
+// reading request headers and idle connections.
+func NewListenerServer(cfg ListenerConfig, handler http.Handler) (*http.Server, error) {
+	idle := cfg.IdleTimeout
+	if idle == 0 {
+		idle = 2 * time.Minute
+	}
+	h2s := &http2.Server{
+		IdleTimeout: idle,
+	}
+	if cfg.H2C && !cfg.tls() {
+		handler = h2c.NewHandler(handler, h2s)
+	}
+	srv := &http.Server{
+		Addr:              ":" + strconv.Itoa(cfg.Port),
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		IdleTimeout:       idle,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+	if err := http2.ConfigureServer(srv, h2s); err != nil {
+		return nil, fmt.Errorf("configure http2: %w", err)
+	}
+	return srv, nil
+}
+
+// Listen opens the balancer port, accepting PROXY protocol headers from
+// trusted sources when enabled.
+func Listen(cfg ListenerConfig) (net.Listener, error) {
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(cfg.Port))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ProxyProtocol {
+		log.WithFields(log.Fields{"trusted": len(cfg.TrustedProxies)}).Info("Accepting PROXY protocol headers")
+		l = proxyproto.NewListener(l, cfg.TrustedProxies)
+	}
+	return l, nil
+}
+
+// ServeListener starts serving on the configured listener until it fails.
+func ServeListener(srv *http.Server, cfg ListenerConfig) error {
+	l, err := Listen(cfg)
+	if err != nil {
+		return err
+	}
+	if cfg.tls() {
+		log.WithFields(log.Fields{"protocols": "h2,http/1.1"}).Infof("Serving TLS on %s", srv.Addr)
+		return srv.ServeTLS(l, cfg.CertFile, cfg.KeyFile)
+	}
+	if cfg.H2C {
+		log.WithFields(log.Fields{"protocols": "h2c,http/1.1"}).Infof("Serving cleartext on %s", srv.Addr)
+	}
+	return srv.Serve(l)
+}
+
+// ListenAndServe serves the balancer on the port described by cfg until it
+// fails: connections are piped in TCP mode, HTTP requests otherwise.
+func (lb *LoadBalancer) ListenAndServe(cfg ListenerConfig) error {
+	if lb.mode == ModeTCP {
+		l, err := Listen(cfg)
+		if err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{"port": cfg.Port}).Print("Forwarding TCP connections at\n")
+		return lb.ServeTCP(l)
+	}
+	srv, err := NewListenerServer(cfg, lb)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"port":    cfg.Port,
+		"address": "127.0.0.1",
+	}).Print("Serving requests at\n")
+	return ServeListener(srv, cfg)
+}
@@ -0,0 +1,238 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/samsyntax/go-lb/auth"
+	"github.com/samsyntax/go-lb/coalesce"
+	"github.com/samsyntax/go-lb/config"
+	"github.com/samsyntax/go-lb/cors"
+	"github.com/samsyntax/go-lb/fault"
+	"github.com/samsyntax/go-lb/ipfilter"
+	"github.com/samsyntax/go-lb/pool"
+	"github.com/samsyntax/go-lb/waf"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+)
+
+// Route applies per-route behaviour to the requests it matches. Empty match
+// fields match every request.
+type Route struct {
+	Name       string
+	PathPrefix string
+	Host       string   // request host without port, compared case-insensitively
+	Methods    []string // compared case-insensitively
+	Fault      *fault.Fault
+	Coalesce   *coalesce.Coalescer // collapses identical concurrent requests, nil to forward each
+	Auth       *auth.Policy        // authenticates requests before they are forwarded, nil to let every request through
+	Forward    *auth.ForwardAuth   // asks an authorization service about requests after Auth, nil to skip
+	Access     *ipfilter.Filter    // allows and denies requests by client IP after the global filter, nil to allow all
+	Limits     Limits              // overrides the balancer's limits where set
+	WAF        waf.Policy          // how the balancer's WAF inspects requests, the zero value uses its mode and every rule
+	CORS       *cors.CORS          // answers preflights and sets CORS headers on responses, nil to leave CORS to the servers
+}
+
+// WithRoutes sets the routes requests are matched against. The first
+// matching route applies; requests matching none are forwarded as they are.
+func WithRoutes(routes ...Route) Option {
+	return func(o *options) { o.routes = append(o.routes, routes...) }
+}
+
+// RoutesFromConfig builds the routes of cfg, with the authentication
+// methods it configures. Unnamed routes are named by index.
+func RoutesFromConfig(cfg *config.Config) ([]Route, error) {
+	var providers map[string]auth.Provider
+	for _, rc := range cfg.Routes {
+		if len(rc.Auth.Methods) > 0 {
+			var err error
+			if providers, err = auth.ProvidersFromConfig(cfg.Auth); err != nil {
+				return nil, fmt.Errorf("auth: %w", err)
+			}
+			break
+		}
+	}
+	routes := make([]Route, 0, len(cfg.Routes))
+	for i, rc := range cfg.Routes {
+		name := rc.Name
+		if name == "" {
+			name = fmt.Sprintf("route %d", i)
+		}
+		var co *coalesce.Coalescer
+		if rc.Coalesce.Enabled && (len(rc.Auth.Methods) > 0 || rc.ForwardAuth.URL != "") {
+			log.WithFields(log.Fields{"route": name}).Warn("Requests of authenticated routes are never coalesced")
+		}
+		if rc.Coalesce.Enabled {
+			var err error
+			co, err = coalesce.New(coalesce.Options{
+				Key:         rc.Coalesce.Key,
+				Timeout:     rc.Coalesce.Timeout.Std(),
+				MaxBodySize: rc.Coalesce.MaxBodySize,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("route %s: coalesce: %w", name, err)
+			}
+		}
+		policy, err := auth.PolicyFromConfig(rc.Auth, providers)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: auth: %w", name, err)
+		}
+		var fa *auth.ForwardAuth
+		if c := rc.ForwardAuth; c.URL != "" {
+			fa, err = auth.NewForwardAuth(auth.ForwardOptions{
+				URL:             c.URL,
+				Timeout:         c.Timeout.Std(),
+				RequestHeaders:  c.RequestHeaders,
+				ResponseHeaders: c.ResponseHeaders,
+				CacheTTL:        c.CacheTTL.Std(),
+				CacheKey:        c.CacheKey,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("route %s: forward auth: %w", name, err)
+			}
+		}
+		access, err := ipFilterFromConfig(cfg.Access.GeoIPDB, rc.Access)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: access: %w", name, err)
+		}
+		var cp *cors.CORS
+		if c := rc.CORS; len(c.AllowedOrigins) > 0 || len(c.AllowedOriginPatterns) > 0 {
+			cp, err = cors.New(cors.Options{
+				AllowedOrigins:        c.AllowedOrigins,
+				AllowedOriginPatterns: c.AllowedOriginPatterns,
+				AllowedMethods:        c.AllowedMethods,
+				AllowedHeaders:        c.AllowedHeaders,
+				ExposedHeaders:        c.ExposedHeaders,
+				AllowCredentials:      c.AllowCredentials,
+				MaxAge:                c.MaxAge.Std(),
+			})
+			if err != nil {
+				return nil, fmt.Errorf("route %s: cors: %w", name, err)
+			}
+		}
+		routes = append(routes, Route{
+			Name:       name,
+			PathPrefix: rc.Match.PathPrefix,
+			Host:       rc.Match.Host,
+			Methods:    rc.Match.Methods,
+			Fault: fault.New(fault.Options{
+				Percentage: rc.Fault.Percentage,
+				Header:     rc.Fault.Header,
+				Delay:      rc.Fault.Delay.Std(),
+				DelayMax:   rc.Fault.DelayMax.Std(),
+				Abort:      rc.Fault.Abort,
+				Reset:      rc.Fault.Reset,
+			}),
+			Coalesce: co,
+			Auth:     policy,
+			Forward:  fa,
+			Access:   access,
+			Limits:   LimitsFromConfig(rc.Limits),
+			WAF:      waf.Policy{Mode: waf.Mode(rc.WAF.Mode), DisabledRules: rc.WAF.DisabledRules},
+			CORS:     cp,
+		})
+	}
+	return routes, nil
+}
+
+func (rt *Route) matches(r *http.Request) bool {
+	if rt.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, rt.PathPrefix) {
+		return false
+	}
+	if rt.Host != "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !strings.EqualFold(host, rt.Host) {
+			return false
+		}
+	}
+	if len(rt.Methods) == 0 {
+		return true
+	}
+	method := r.Method
+	if rt.CORS != nil && cors.IsPreflight(r) {
+		// Preflights belong to the route of the request they ask about
+		method = r.Header.Get("Access-Control-Request-Method")
+	}
+	for _, m := range rt.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// route returns the route r matches, nil for none. The match is kept with
+// the request info so it is only made once per request.
+func (lb *LoadBalancer) route(ctx context.Context, r *http.Request) *Route {
+	info := requestInfoFrom(ctx)
+	if info != nil && info.routed {
+		return info.route
+	}
+	var res *Route
+	for i := range lb.routes {
+		if lb.routes[i].matches(r) {
+			res = &lb.routes[i]
+			break
+		}
+	}
+	if info != nil {
+		info.route, info.routed = res, true
+	}
+	return res
+}
+
+// injectFault applies the route's fault to r, if one is injected. It reports
+// whether the request was answered and must not be forwarded.
+func (lb *LoadBalancer) injectFault(ctx context.Context, w http.ResponseWriter, r *http.Request, rt *Route) bool {
+	if rt == nil {
+		return false
+	}
+	in, ok := rt.Fault.Decide(r)
+	if !ok {
+		return false
+	}
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		attribute.String("fault.injected", in.String()),
+		attribute.String("fault.route", rt.Name),
+	)
+	log.WithFields(log.Fields{
+		"client": r.RemoteAddr,
+		"route":  rt.Name,
+		"fault":  in.String(),
+		"delay":  in.Delay,
+		"abort":  in.Abort,
+	}).Warn("Injecting fault")
+
+	if in.Delay > 0 {
+		t := time.NewTimer(in.Delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return true
+		}
+	}
+	switch {
+	case in.Reset:
+		// Closes the connection without a response (resets the stream on HTTP/2)
+		panic(http.ErrAbortHandler)
+	case in.Abort != 0:
+		if lb.mode == ModeGRPC && pool.IsGRPCRequest(r) {
+			pool.WriteGRPCError(w, codes.Unavailable, "fault injected")
+			return true
+		}
+		http.Error(w, "fault injected", in.Abort)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+
+	"github.com/samsyntax/go-lb/config"
+	"github.com/samsyntax/go-lb/pool"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Group is a named set of servers (see pool.WithGroup) and its share of traffic.
+type Group struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+}
+
+// Split divides traffic between server groups by weight. A request can
+// force a group by naming it in the split header or cookie. Weights can be
+// changed while requests are served.
+type Split struct {
+	header string
+	cookie string
+
+	mu     sync.RWMutex
+	groups []Group
+}
+
+// NewSplit creates a split between groups. header and cookie name the
+// request header and cookie forcing a group, empty to disable them.
+func NewSplit(groups []Group, header, cookie string) (*Split, error) {
+	s := &Split{header: header, cookie: cookie}
+	if err := s.SetGroups(groups); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SplitFromConfig creates the configured split, nil when no groups are configured.
+func SplitFromConfig(cfg config.SplitConfig) (*Split, error) {
+	if len(cfg.Groups) == 0 {
+		return nil, nil
+	}
+	groups := make([]Group, 0, len(cfg.Groups))
+	for _, g := range cfg.Groups {
+		groups = append(groups, Group{Name: g.Name, Weight: g.Weight})
+	}
+	return NewSplit(groups, cfg.Header, cfg.Cookie)
+}
+
+// WithSplit splits traffic between the server groups of the pool.
+func WithSplit(s *Split) Option {
+	return func(o *options) { o.split = s }
+}
+
+// Groups returns the groups and their current weights.
+func (s *Split) Groups() []Group {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Group(nil), s.groups...)
+}
+
+// SetGroups replaces every group.
+func (s *Split) SetGroups(groups []Group) error {
+	seen := make(map[string]bool, len(groups))
+	total := 0
+	for _, g := range groups {
+		if g.Name == "" {
+			return fmt.Errorf("group without a name")
+		}
+		if seen[g.Name] {
+			return fmt.Errorf("duplicate group %q", g.Name)
+		}
+		seen[g.Name] = true
+		if g.Weight < 0 {
+			return fmt.Errorf("group %q: weight must not be negative, got %d", g.Name, g.Weight)
+		}
+		total += g.Weight
+	}
+	if total == 0 {
+		return fmt.Errorf("at least one group needs a positive weight")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.groups = append([]Group(nil), groups...)
+	return nil
+}
+
+// SetWeights changes the weights of the named groups and keeps the others.
+func (s *Split) SetWeights(weights map[string]int) error {
+	groups := s.Groups()
+	for name, w := range weights {
+		found := false
+		for i := range groups {
+			if groups[i].Name == name {
+				groups[i].Weight = w
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown group %q", name)
+		}
+	}
+	return s.SetGroups(groups)
+}
+
+// pick returns the group for r and whether the request forced it. r may be
+// nil, e.g. for TCP connections, which are only split by weight.
+func (s *Split) pick(r *http.Request) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if r != nil {
+		if g := s.forced(r); g != "" {
+			return g, true
+		}
+	}
+	total := 0
+	for _, g := range s.groups {
+		total += g.Weight
+	}
+	n := rand.N(total)
+	for _, g := range s.groups {
+		if n < g.Weight {
+			return g.Name, false
+		}
+		n -= g.Weight
+	}
+	return "", false
+}
+
+// forced returns the known group named by r's header or cookie, empty for none.
+func (s *Split) forced(r *http.Request) string {
+	var name string
+	if s.header != "" {
+		name = r.Header.Get(s.header)
+	}
+	if name == "" && s.cookie != "" {
+		if c, err := r.Cookie(s.cookie); err == nil {
+			name = c.Value
+		}
+	}
+	for _, g := range s.groups {
+		if name != "" && g.Name == name {
+			return name
+		}
+	}
+	return ""
+}
+
+// SplitStatus is the split as reported by the admin API.
+type SplitStatus struct {
+	Header string  `json:"header,omitempty"`
+	Cookie string  `json:"cookie,omitempty"`
+	Groups []Group `json:"groups"`
+}
+
+func (s *Split) status() SplitStatus {
+	return SplitStatus{Header: s.header, Cookie: s.cookie, Groups: s.Groups()}
+}
+
+// next picks the server for r, from the group the split picks when traffic
+// is split. A group without available servers falls back to the whole pool,
+// so traffic keeps flowing while e.g. no canary is deployed.
+func (lb *LoadBalancer) next(ctx context.Context, r *http.Request) *pool.Server {
+	if lb.split == nil {
+		return lb.pool.Next()
+	}
+	group, forced := lb.split.pick(r)
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("split.group", group),
+		attribute.Bool("split.forced", forced),
+	)
+	if info := requestInfoFrom(ctx); info != nil {
+		info.group = group
+	}
+	if s := lb.pool.NextIn(group); s != nil && s.Alive() && !s.Draining() {
+		return s
+	}
+	return lb.pool.Next()
+}
@@ -0,0 +1,64 @@
+package balancer
+
+import (
+	"context"
+	"io"
+	"net"
+
+	"github.com/samsyntax/go-lb/pool"
+	"github.com/samsyntax/go-lb/proxyproto"
+	log "github.com/sirupsen/logrus"
+)
+
+// ServeTCP accepts connections on l and pipes each one to the next available server.
+func (lb *LoadBalancer) ServeTCP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go lb.proxyTCP(conn)
+	}
+}
+
+func (lb *LoadBalancer) proxyTCP(client net.Conn) {
+	defer client.Close()
+	if !lb.admitConn(client) {
+		return
+	}
+	target := lb.next(context.Background(), nil)
+	if target == nil {
+		log.WithFields(log.Fields{"client": client.RemoteAddr().String()}).Error("No servers available")
+		return
+	}
+	fields := log.Fields{"client": client.RemoteAddr().String(), "server": target.Address()}
+
+	upstream, err := net.DialTimeout("tcp", pool.HostPort(target.Address()), pool.DialTimeout)
+	if err != nil {
+		log.WithFields(fields).Errorf("Failed to dial upstream: %v", err)
+		return
+	}
+	defer upstream.Close()
+	defer target.Track()()
+	if target.SendProxy() != "" {
+		if err := proxyproto.WriteHeader(upstream, target.SendProxy(), client.RemoteAddr(), client.LocalAddr()); err != nil {
+			log.WithFields(fields).Errorf("Failed to send PROXY header: %v", err)
+			return
+		}
+	}
+	log.WithFields(fields).Info("Forwarding connection")
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		// Half-close so the other side sees EOF while the reverse direction drains
+		if c, ok := dst.(interface{ CloseWrite() error }); ok {
+			c.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go pipe(upstream, client)
+	go pipe(client, upstream)
+	<-done
+	<-done
+}
@@ -0,0 +1,93 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/samsyntax/go-lb/pool"
+	"github.com/samsyntax/go-lb/waf"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+)
+
+// inspect checks r with the WAF using the route's policy. Blocked and
+// challenged requests are answered and inspect reports false.
+func (lb *LoadBalancer) inspect(ctx context.Context, w http.ResponseWriter, r *http.Request, rt *Route) bool {
+	if lb.waf == nil {
+		return true
+	}
+	var p waf.Policy
+	fields := log.Fields{}
+	if rt != nil {
+		p = rt.WAF
+		fields["route"] = rt.Name
+	}
+	client := r.RemoteAddr
+	if ip, ok := lb.trustedProxies.ClientIP(r); ok {
+		client = ip.String()
+	}
+	res := lb.waf.Check(r, p, client)
+	if len(res.Matches) == 0 {
+		return true
+	}
+
+	rules := make([]string, 0, len(res.Matches))
+	matches := make([]string, 0, len(res.Matches))
+	for _, m := range res.Matches {
+		rules = append(rules, m.Rule)
+		matches = append(matches, fmt.Sprintf("%s %s=%q", m.Rule, m.Target, m.Value))
+	}
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("waf.action", res.Action.String()),
+		attribute.Int("waf.score", res.Score),
+		attribute.StringSlice("waf.rules", rules),
+	)
+	fields["client"] = client
+	fields["action"] = res.Action.String()
+	fields["score"] = res.Score
+	fields["matches"] = strings.Join(matches, ", ")
+	entry := log.WithFields(fields)
+
+	switch res.Action {
+	case waf.Block, waf.Challenge:
+		entry.Warn("WAF rejected request")
+	case waf.Log, waf.Passed:
+		entry.Info("WAF let request through")
+		return true
+	default:
+		entry.Debug("WAF rules matched below the threshold")
+		return true
+	}
+	if lb.mode == ModeGRPC && pool.IsGRPCRequest(r) {
+		// gRPC clients can't run the challenge
+		pool.WriteGRPCError(w, codes.PermissionDenied, "request blocked")
+		return false
+	}
+	if res.Action == waf.Challenge {
+		lb.waf.WriteChallenge(w, client)
+		return false
+	}
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	return false
+}
+
+// warnUnknownRules logs rules routes disable that f doesn't have, most
+// likely typos.
+func warnUnknownRules(f *waf.WAF, routes []Route) {
+	var ids []string
+	for _, rule := range f.Rules() {
+		ids = append(ids, rule.ID)
+	}
+	for _, rt := range routes {
+		for _, id := range rt.WAF.DisabledRules {
+			if !slices.Contains(ids, id) {
+				log.WithFields(log.Fields{"route": rt.Name, "rule": id}).Warn("Disabled WAF rule doesn't exist")
+			}
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Package bench generates load against a balancer, either by replaying
+// captured requests from a JSONL file or with synthetic requests at a target
+// rate and concurrency, and reports latency, errors and the distribution of
+// requests across backends.
+package bench
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request is a single request to send. Replay files hold one per line:
+//
+//	{"method": "POST", "path": "/api/items", "headers": {"Content-Type": "application/json"}, "body": "{}"}
+type Request struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+
+	// BodyEncoding is "base64" when Body holds base64 encoded binary data,
+	// as written by the recorder.
+	BodyEncoding string `json:"body_encoding,omitempty"`
+}
+
+// ReadRequests reads a JSONL file of requests. Blank lines are skipped and
+// unknown fields are ignored, so recorded traffic can be replayed as-is.
+func ReadRequests(path string) ([]Request, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var res []Request
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64<<10), 16<<20)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" {
+			continue
+		}
+		var r Request
+		if err := json.Unmarshal([]byte(text), &r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if r.Method == "" {
+			r.Method = http.MethodGet
+		}
+		if r.Path == "" {
+			r.Path = "/"
+		}
+		switch r.BodyEncoding {
+		case "":
+		case "base64":
+			body, err := base64.StdEncoding.DecodeString(r.Body)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: body: %v", path, line, err)
+			}
+			r.Body, r.BodyEncoding = string(body), ""
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown body_encoding %q", path, line, r.BodyEncoding)
+		}
+		res = append(res, r)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("%s: no requests", path)
+	}
+	return res, nil
+}
+
+// Options describes a benchmark run.
+type Options struct {
+	Target        string        // base URL of the balancer, e.g. http://localhost:7000
+	Requests      []Request     // requests sent in turn
+	Concurrency   int           // requests in flight at most, 1 by default
+	RPS           float64       // requests started per second, 0 for as fast as possible
+	Count         int           // stop after this many requests, 0 for no limit
+	Duration      time.Duration // stop after this long, 0 for no limit
+	BackendHeader string        // response header naming the backend that answered
+	Client        *http.Client  // client used to send requests, a 10s timeout client by default
+}
+
+// Run sends requests until Count requests were sent, Duration has passed or
+// ctx is done, whichever comes first. At least one of Count and Duration
+// must be set.
+func Run(ctx context.Context, opts Options) (*Result, error) {
+	if len(opts.Requests) == 0 {
+		return nil, fmt.Errorf("no requests to send")
+	}
+	if opts.Count <= 0 && opts.Duration <= 0 {
+		return nil, fmt.Errorf("either a request count or a duration is required")
+	}
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+	client := opts.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if opts.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Duration)
+		defer cancel()
+	}
+	target := strings.TrimSuffix(opts.Target, "/")
+
+	jobs := make(chan Request)
+	go func() {
+		defer close(jobs)
+		var tick <-chan time.Time
+		if opts.RPS > 0 {
+			ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.RPS))
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for i := 0; opts.Count <= 0 || i < opts.Count; i++ {
+			if tick != nil {
+				select {
+				case <-ctx.Done():
+					return
+				case <-tick:
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case jobs <- opts.Requests[i%len(opts.Requests)]:
+			}
+		}
+	}()
+
+	res := newResult()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range jobs {
+				s := send(client, target, r, opts.BackendHeader)
+				mu.Lock()
+				res.add(s)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	res.Elapsed = time.Since(start)
+	if opts.BackendHeader == "" {
+		res.Backends = nil
+	}
+	res.finish()
+	return res, nil
+}
+
+// sample is the outcome of a single request.
+type sample struct {
+	latency time.Duration
+	status  int    // 0 when the request failed before a response
+	backend string // value of the backend header
+	err     error
+}
+
+func send(client *http.Client, target string, r Request, backendHeader string) sample {
+	var body io.Reader
+	if r.Body != "" {
+		body = strings.NewReader(r.Body)
+	}
+	req, err := http.NewRequest(r.Method, target+r.Path, body)
+	if err != nil {
+		return sample{err: err}
+	}
+	for k, v := range r.Headers {
+		if strings.EqualFold(k, "Host") {
+			req.Host = v
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+	start := time.Now()
+	res, err := client.Do(req)
+	if err != nil {
+		return sample{latency: time.Since(start), err: err}
+	}
+	// The whole body is part of the latency, like for a real client
+	_, err = io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	s := sample{latency: time.Since(start), status: res.StatusCode, err: err}
+	if backendHeader != "" {
+		s.backend = res.Header.Get(backendHeader)
+	}
+	return s
+}
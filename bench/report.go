@@ -0,0 +1,141 @@
+package bench
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Result summarizes a benchmark run.
+type Result struct {
+	Requests  int            `json:"requests"`
+	Errors    int            `json:"errors"`     // requests without a response or with a 5xx status
+	ErrorRate float64        `json:"error_rate"` // Errors / Requests
+	Elapsed   time.Duration  `json:"elapsed"`
+	RPS       float64        `json:"rps"` // achieved requests per second
+	Latency   Latency        `json:"latency"`
+	Status    map[string]int `json:"status"`   // requests by status code, "error" for failed requests
+	Backends  map[string]int `json:"backends"` // requests by backend header value, "-" when it was missing
+	ErrorMsgs map[string]int `json:"error_messages,omitempty"`
+
+	latencies []time.Duration
+}
+
+// Latency holds latency percentiles over every request.
+type Latency struct {
+	Min  time.Duration `json:"min"`
+	Mean time.Duration `json:"mean"`
+	P50  time.Duration `json:"p50"`
+	P90  time.Duration `json:"p90"`
+	P95  time.Duration `json:"p95"`
+	P99  time.Duration `json:"p99"`
+	Max  time.Duration `json:"max"`
+}
+
+func newResult() *Result {
+	return &Result{
+		Status:    make(map[string]int),
+		Backends:  make(map[string]int),
+		ErrorMsgs: make(map[string]int),
+	}
+}
+
+func (r *Result) add(s sample) {
+	r.Requests++
+	r.latencies = append(r.latencies, s.latency)
+	switch {
+	case s.status == 0:
+		r.Errors++
+		r.Status["error"]++
+		r.ErrorMsgs[s.err.Error()]++
+		return
+	case s.status >= 500:
+		r.Errors++
+	}
+	r.Status[strconv.Itoa(s.status)]++
+	backend := s.backend
+	if backend == "" {
+		backend = "-"
+	}
+	r.Backends[backend]++
+}
+
+func (r *Result) finish() {
+	if r.Requests > 0 {
+		r.ErrorRate = float64(r.Errors) / float64(r.Requests)
+	}
+	if r.Elapsed > 0 {
+		r.RPS = float64(r.Requests) / r.Elapsed.Seconds()
+	}
+	if len(r.latencies) == 0 {
+		return
+	}
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+	var total time.Duration
+	for _, l := range r.latencies {
+		total += l
+	}
+	r.Latency = Latency{
+		Min:  r.latencies[0],
+		Mean: total / time.Duration(len(r.latencies)),
+		P50:  percentile(r.latencies, 50),
+		P90:  percentile(r.latencies, 90),
+		P95:  percentile(r.latencies, 95),
+		P99:  percentile(r.latencies, 99),
+		Max:  r.latencies[len(r.latencies)-1],
+	}
+}
+
+// percentile returns the p-th percentile of sorted latencies (nearest rank).
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Print writes a human readable report of r to w.
+func (r *Result) Print(w io.Writer) {
+	fmt.Fprintf(w, "requests: %d in %s (%.1f req/s)\n", r.Requests, r.Elapsed.Round(time.Millisecond), r.RPS)
+	fmt.Fprintf(w, "errors:   %d (%.2f%%)\n\n", r.Errors, r.ErrorRate*100)
+
+	l := r.Latency
+	fmt.Fprintln(w, "latency:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  min\tmean\tp50\tp90\tp95\tp99\tmax")
+	fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%s\t%s\t%s\n", round(l.Min), round(l.Mean), round(l.P50), round(l.P90), round(l.P95), round(l.P99), round(l.Max))
+	tw.Flush()
+
+	fmt.Fprintln(w, "\nstatus:")
+	printCounts(w, r.Status, r.Requests)
+	if len(r.Backends) > 0 {
+		fmt.Fprintln(w, "\nbackends:")
+		printCounts(w, r.Backends, r.Requests)
+	}
+	if len(r.ErrorMsgs) > 0 {
+		fmt.Fprintln(w, "\nerrors:")
+		printCounts(w, r.ErrorMsgs, r.Requests)
+	}
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(10 * time.Microsecond)
+}
+
+// printCounts prints counts sorted by key with their share of total.
+func printCounts(w io.Writer, counts map[string]int, total int) {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, k := range keys {
+		fmt.Fprintf(tw, "  %s\t%d\t%.1f%%\n", k, counts[k], float64(counts[k])*100/float64(total))
+	}
+	tw.Flush()
+}
@@ -0,0 +1,385 @@
+// Package cache is an HTTP response cache in front of the balancer's pool.
+// It follows the shared cache rules of Cache-Control, Expires and Vary,
+// revalidates stale responses with ETag and Last-Modified, answers
+// conditional requests itself and serves stale responses while revalidating
+// (stale-while-revalidate) or while the backends are failing
+// (stale-if-error). Responses are kept in a bounded in-memory LRU, optionally
+// backed by a directory on disk.
+package cache
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Header tells clients how the cache answered: HIT, MISS, STALE,
+// REVALIDATED or BYPASS.
+const Header = "X-Cache"
+
+// Options configures a Cache.
+type Options struct {
+	MaxSize      int           // bytes of responses kept in memory
+	MaxEntrySize int           // larger responses are not stored
+	Dir          string        // directory responses are also stored in, empty for memory only
+	MaxDiskSize  int           // bytes of responses kept on disk
+	StaleIfError time.Duration // serve stale responses this long past their freshness while backends fail, unless they set stale-if-error themselves
+
+	// Available reports whether any backend can take requests. Without
+	// available backends stale responses are served right away.
+	Available func() bool
+
+	// Detach returns the context background revalidations run with, after the
+	// request that triggered them was answered. context.WithoutCancel by default.
+	Detach func(ctx context.Context) context.Context
+}
+
+// Cache answers requests from stored responses and forwards the rest.
+type Cache struct {
+	opts  Options
+	store *store
+
+	mu           sync.Mutex
+	revalidating map[string]bool // keys revalidated in the background
+
+	hits, misses, stale, revalidated, bypassed atomic.Int64
+}
+
+// New creates a cache, loading the responses stored in opts.Dir.
+func New(opts Options) (*Cache, error) {
+	if opts.Available == nil {
+		opts.Available = func() bool { return true }
+	}
+	if opts.Detach == nil {
+		opts.Detach = context.WithoutCancel
+	}
+	var disk *diskStore
+	if opts.Dir != "" {
+		var err error
+		if disk, err = openDisk(opts.Dir, opts.MaxDiskSize); err != nil {
+			return nil, err
+		}
+	}
+	return &Cache{
+		opts:         opts,
+		store:        newStore(opts.MaxSize, disk),
+		revalidating: make(map[string]bool),
+	}, nil
+}
+
+// Serve answers r from the cache or forwards it to next, storing the response when allowed.
+func (c *Cache) Serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	reqCC := parseCacheControl(r.Header)
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || r.Header.Get("Upgrade") != "" ||
+		r.Header.Get("Range") != "" || reqCC.has("no-store") {
+		c.bypassed.Add(1)
+		w.Header().Set(Header, "BYPASS")
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	e := c.store.lookup(r)
+	if e == nil {
+		if reqCC.has("only-if-cached") {
+			c.misses.Add(1)
+			w.Header().Set(Header, "MISS")
+			http.Error(w, "not cached", http.StatusGatewayTimeout)
+			return
+		}
+		c.fetch(w, r, next, nil)
+		return
+	}
+
+	now := time.Now()
+	age := e.age(now)
+	fresh := lifetime(e.Header, e.Stored)
+	noCache := reqCC.has("no-cache") || r.Header.Get("Pragma") == "no-cache"
+	acceptable := true
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		acceptable = false
+	}
+	if age < fresh && acceptable && !noCache {
+		c.hits.Add(1)
+		c.serve(w, r, e, "HIT", now)
+		return
+	}
+
+	cc := parseCacheControl(e.Header)
+	staleFor := age - fresh
+	if !noCache && !cc.has("must-revalidate") && !cc.has("proxy-revalidate") {
+		if swr, ok := cc.seconds("stale-while-revalidate"); ok && staleFor < swr && r.Method == http.MethodGet {
+			c.stale.Add(1)
+			c.serve(w, r, e, "STALE", now)
+			c.revalidate(r, next, e)
+			return
+		}
+		if !c.opts.Available() && c.staleIfError(e, staleFor) {
+			c.stale.Add(1)
+			c.serve(w, r, e, "STALE", now)
+			return
+		}
+	}
+	if r.Method == http.MethodHead {
+		c.bypassed.Add(1)
+		w.Header().Set(Header, "BYPASS")
+		next.ServeHTTP(w, r)
+		return
+	}
+	c.fetch(w, r, next, e)
+}
+
+// staleIfError reports whether e may be served staleFor past its freshness while backends fail.
+func (c *Cache) staleIfError(e *entry, staleFor time.Duration) bool {
+	if d, ok := parseCacheControl(e.Header).seconds("stale-if-error"); ok {
+		return staleFor < d
+	}
+	return staleFor < c.opts.StaleIfError
+}
+
+// fetch forwards r, revalidating the stale entry when there is one, and
+// stores the response when allowed.
+func (c *Cache) fetch(w http.ResponseWriter, r *http.Request, next http.Handler, stale *entry) {
+	req := r
+	if stale != nil {
+		req = conditional(r, stale)
+	}
+	staleFor := time.Duration(0)
+	if stale != nil {
+		staleFor = stale.age(time.Now()) - lifetime(stale.Header, stale.Stored)
+	}
+	fw := &fetchWriter{w: w, header: http.Header{}, max: c.opts.MaxEntrySize, cacheStatus: "MISS"}
+	fw.intercept = func(status int) bool {
+		if stale == nil {
+			return false
+		}
+		if status == http.StatusNotModified && stale.Header.Get("ETag")+stale.Header.Get("Last-Modified") != "" {
+			return true
+		}
+		return status >= 500 && c.staleIfError(stale, staleFor)
+	}
+	start := time.Now()
+	next.ServeHTTP(fw, req)
+	c.finish(w, r, fw, stale, start)
+}
+
+// finish handles the response of a forwarded request once it was received.
+// w is nil for background revalidations.
+func (c *Cache) finish(w http.ResponseWriter, r *http.Request, fw *fetchWriter, stale *entry, start time.Time) {
+	now := time.Now()
+	switch {
+	case fw.intercepted && fw.status == http.StatusNotModified:
+		updated := *stale
+		updated.Header = stale.Header.Clone()
+		for k, v := range fw.header {
+			if k != "Content-Length" {
+				updated.Header[k] = v
+			}
+		}
+		updated.Stored = start.Add(-initialAge(fw.header))
+		c.store.put(&updated)
+		c.revalidated.Add(1)
+		if w != nil {
+			c.serve(w, r, &updated, "REVALIDATED", now)
+		}
+		return
+	case fw.intercepted && fw.status >= 500:
+		c.stale.Add(1)
+		log.WithFields(log.Fields{"status": fw.status, "url": stale.URI}).Warn("Serving stale response, backend failed")
+		if w != nil {
+			c.serve(w, r, stale, "STALE", now)
+		}
+		return
+	}
+	if w != nil {
+		c.misses.Add(1)
+	}
+	if fw.tooLarge || fw.status == 0 || !storable(r, fw.status, fw.header) {
+		return
+	}
+	primary := primaryKey(r)
+	vary := varyHeaders(fw.header)
+	header := fw.header.Clone()
+	header.Del(Header)
+	c.store.put(&entry{
+		Key:    variantKey(primary, vary, r),
+		Host:   r.Host,
+		URI:    r.URL.RequestURI(),
+		Vary:   vary,
+		Status: fw.status,
+		Header: header,
+		Stored: start.Add(-initialAge(fw.header)),
+		body:   fw.body.Bytes(),
+	})
+}
+
+// revalidate refreshes e in the background, at most once at a time per entry.
+func (c *Cache) revalidate(r *http.Request, next http.Handler, e *entry) {
+	c.mu.Lock()
+	if c.revalidating[e.Key] {
+		c.mu.Unlock()
+		return
+	}
+	c.revalidating[e.Key] = true
+	c.mu.Unlock()
+
+	req := conditional(r.WithContext(c.opts.Detach(r.Context())), e)
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.revalidating, e.Key)
+			c.mu.Unlock()
+		}()
+		fw := &fetchWriter{header: http.Header{}, max: c.opts.MaxEntrySize}
+		start := time.Now()
+		next.ServeHTTP(fw, req)
+		if fw.intercepted && fw.status >= 500 {
+			log.WithFields(log.Fields{"status": fw.status, "url": e.URI}).Warn("Background revalidation failed")
+			return
+		}
+		c.finish(nil, r, fw, e, start)
+	}()
+}
+
+// conditional returns a copy of r revalidating e with its validators.
+func conditional(r *http.Request, e *entry) *http.Request {
+	req := r.Clone(r.Context())
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+	if etag := e.Header.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lm := e.Header.Get("Last-Modified"); lm != "" {
+		req.Header.Set("If-Modified-Since", lm)
+	}
+	return req
+}
+
+// serve answers r with e, or with 304 when r is a conditional request e satisfies.
+func (c *Cache) serve(w http.ResponseWriter, r *http.Request, e *entry, status string, now time.Time) {
+	h := w.Header()
+	for k, v := range e.Header {
+		h[k] = v
+	}
+	h.Set("Age", strconv.Itoa(int(e.age(now).Seconds())))
+	h.Set(Header, status)
+	if notModified(r, e.Header) {
+		for _, k := range []string{"Content-Length", "Content-Type", "Content-Encoding"} {
+			h.Del(k)
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(e.Status)
+	if r.Method != http.MethodHead {
+		w.Write(e.body)
+	}
+}
+
+// PurgeOptions selects the entries removed by Purge. Empty fields match every entry.
+type PurgeOptions struct {
+	Host   string // request host, e.g. example.com:8080
+	Prefix string // prefix of the path and query
+}
+
+// Purge removes the matching entries and returns how many were removed.
+func (c *Cache) Purge(opts PurgeOptions) int {
+	n := c.store.purge(func(e *entry) bool {
+		return (opts.Host == "" || strings.EqualFold(e.Host, opts.Host)) && strings.HasPrefix(e.URI, opts.Prefix)
+	})
+	log.WithFields(log.Fields{"host": opts.Host, "prefix": opts.Prefix, "purged": n}).Info("Cache purged")
+	return n
+}
+
+// Stats are the cache counters reported by the admin API.
+type Stats struct {
+	Hits        int64 `json:"hits"`
+	Misses      int64 `json:"misses"`
+	Stale       int64 `json:"stale"`       // stale responses served
+	Revalidated int64 `json:"revalidated"` // stale responses confirmed by the backend
+	Bypassed    int64 `json:"bypassed"`    // requests that can't be cached, e.g. POST
+	Entries     int   `json:"entries"`
+	Bytes       int   `json:"bytes"`
+	DiskEntries int   `json:"disk_entries"`
+	DiskBytes   int   `json:"disk_bytes"`
+}
+
+// Stats returns the current counters.
+func (c *Cache) Stats() Stats {
+	st := Stats{
+		Hits:        c.hits.Load(),
+		Misses:      c.misses.Load(),
+		Stale:       c.stale.Load(),
+		Revalidated: c.revalidated.Load(),
+		Bypassed:    c.bypassed.Load(),
+	}
+	st.Entries, st.Bytes, st.DiskEntries, st.DiskBytes = c.store.stats()
+	return st
+}
+
+// fetchWriter receives a forwarded response. Unless intercept decides
+// otherwise once the status is known, it is passed through to w while the
+// body is kept for storing.
+type fetchWriter struct {
+	w           http.ResponseWriter // client, nil for background revalidations
+	header      http.Header
+	status      int
+	cacheStatus string // X-Cache value of passed through responses
+	intercept   func(status int) bool
+	intercepted bool // the response is not passed to the client
+	body        bytes.Buffer
+	max         int
+	tooLarge    bool
+}
+
+func (fw *fetchWriter) Header() http.Header {
+	return fw.header
+}
+
+func (fw *fetchWriter) WriteHeader(code int) {
+	if fw.status != 0 || code < 200 {
+		return
+	}
+	fw.status = code
+	fw.intercepted = fw.w == nil || fw.intercept(code)
+	if fw.intercepted {
+		return
+	}
+	h := fw.w.Header()
+	for k, v := range fw.header {
+		h[k] = v
+	}
+	h.Set(Header, fw.cacheStatus)
+	fw.w.WriteHeader(code)
+}
+
+func (fw *fetchWriter) Write(p []byte) (int, error) {
+	if fw.status == 0 {
+		fw.WriteHeader(http.StatusOK)
+	}
+	if !fw.tooLarge {
+		if fw.body.Len()+len(p) > fw.max {
+			fw.tooLarge = true
+			fw.body = bytes.Buffer{}
+		} else {
+			fw.body.Write(p)
+		}
+	}
+	if fw.intercepted {
+		return len(p), nil
+	}
+	return fw.w.Write(p)
+}
+
+// Flush keeps streamed responses streaming through the cache.
+func (fw *fetchWriter) Flush() {
+	if !fw.intercepted && fw.w != nil {
+		http.NewResponseController(fw.w).Flush()
+	}
+}
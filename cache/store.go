@@ -0,0 +1,436 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// entry is a stored response.
+type entry struct {
+	Key    string      `json:"key"` // primary key and variant
+	Host   string      `json:"host"`
+	URI    string      `json:"uri"`  // path and query
+	Vary   []string    `json:"vary"` // request headers selecting the variant
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Stored time.Time   `json:"stored"` // when the response was generated, from the receive time and its Age
+	body   []byte
+}
+
+func (e *entry) size() int {
+	n := len(e.body) + len(e.Key)
+	for k, vs := range e.Header {
+		for _, v := range vs {
+			n += len(k) + len(v)
+		}
+	}
+	return n
+}
+
+func (e *entry) age(now time.Time) time.Duration {
+	return max(now.Sub(e.Stored), 0)
+}
+
+// primaryKey identifies the resource r asks for.
+func primaryKey(r *http.Request) string {
+	return r.Host + r.URL.RequestURI()
+}
+
+// variantKey identifies the variant of the resource selected by r's headers named in vary.
+func variantKey(primary string, vary []string, r *http.Request) string {
+	if len(vary) == 0 {
+		return primary
+	}
+	var b strings.Builder
+	b.WriteString(primary)
+	for _, name := range vary {
+		b.WriteString("\n" + name + ": " + strings.Join(r.Header.Values(name), ", "))
+	}
+	return b.String()
+}
+
+// varyHeaders returns the sorted, canonical header names of h's Vary header.
+func varyHeaders(h http.Header) []string {
+	var res []string
+	for _, line := range h.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				res = append(res, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// resource is what the store knows about a URL: the request headers its
+// variants are selected by and the keys of the variants in memory or on disk.
+type resource struct {
+	vary []string
+	keys map[string]bool
+}
+
+// store keeps entries in a memory LRU bounded by size, backed by an
+// optional disk store. With a disk store every entry is written to disk and
+// entries evicted from memory are read back from it.
+type store struct {
+	mu        sync.Mutex
+	maxBytes  int
+	bytes     int
+	lru       *list.List // of *entry, most recently used first
+	items     map[string]*list.Element
+	resources map[string]*resource // by primary key
+	disk      *diskStore
+	purges    int // incremented by every purge, so background writes of purged entries are dropped
+}
+
+func newStore(maxBytes int, disk *diskStore) *store {
+	s := &store{
+		maxBytes:  maxBytes,
+		lru:       list.New(),
+		items:     make(map[string]*list.Element),
+		resources: make(map[string]*resource),
+		disk:      disk,
+	}
+	if disk != nil {
+		for el := disk.lru.Front(); el != nil; el = el.Next() {
+			s.added(el.Value.(*diskItem).meta)
+		}
+		s.evictDisk()
+	}
+	return s
+}
+
+// added notes a variant of e's resource. mu must be held.
+func (s *store) added(e *entry) {
+	res, ok := s.resources[e.Host+e.URI]
+	if !ok {
+		res = &resource{vary: e.Vary, keys: make(map[string]bool)}
+		s.resources[e.Host+e.URI] = res
+	}
+	res.keys[e.Key] = true
+}
+
+// removed forgets a variant of e's resource once it is neither in memory
+// nor on disk, and the resource once no variant is left. mu must be held.
+func (s *store) removed(e *entry) {
+	if _, ok := s.items[e.Key]; ok {
+		return
+	}
+	if s.disk != nil {
+		if _, ok := s.disk.items[e.Key]; ok {
+			return
+		}
+	}
+	if res, ok := s.resources[e.Host+e.URI]; ok {
+		delete(res.keys, e.Key)
+		if len(res.keys) == 0 {
+			delete(s.resources, e.Host+e.URI)
+		}
+	}
+}
+
+// lookup returns the entry matching r, nil when there is none.
+func (s *store) lookup(r *http.Request) *entry {
+	primary := primaryKey(r)
+	s.mu.Lock()
+	res, ok := s.resources[primary]
+	if !ok {
+		s.mu.Unlock()
+		return nil
+	}
+	key := variantKey(primary, res.vary, r)
+	if el, ok := s.items[key]; ok {
+		s.lru.MoveToFront(el)
+		s.mu.Unlock()
+		return el.Value.(*entry)
+	}
+	var file string
+	if s.disk != nil {
+		file = s.disk.lookup(key)
+	}
+	s.mu.Unlock()
+	if file == "" {
+		return nil
+	}
+	e := readEntry(file, key)
+	if e != nil {
+		s.mu.Lock()
+		s.insert(e)
+		s.mu.Unlock()
+	}
+	return e
+}
+
+// put stores e, replacing the entry with the same key.
+func (s *store) put(e *entry) {
+	s.mu.Lock()
+	primary := e.Host + e.URI
+	if res, ok := s.resources[primary]; ok && strings.Join(res.vary, ",") != strings.Join(e.Vary, ",") {
+		// The resource varies on other headers now, older variants can't be selected anymore
+		s.purgeLocked(func(o *entry) bool { return o.Host+o.URI == primary })
+	}
+	s.insert(e)
+	purges := s.purges
+	s.mu.Unlock()
+	if s.disk != nil {
+		// Written in the background, the response is already complete
+		go s.writeDisk(e, purges)
+	}
+}
+
+func (s *store) writeDisk(e *entry, purges int) {
+	file, size, err := s.disk.write(e)
+	if err != nil {
+		log.Errorf("Failed to write cache file: %v", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.purges != purges {
+		if _, ok := s.items[e.Key]; !ok {
+			os.Remove(file)
+			return
+		}
+	}
+	s.disk.add(e, file, size)
+	s.added(e)
+	s.evictDisk()
+}
+
+// evictDisk removes the least recently used files over the disk limit. mu must be held.
+func (s *store) evictDisk() {
+	for s.disk.bytes > s.disk.maxBytes && s.disk.lru.Len() > 0 {
+		s.removed(s.disk.remove(s.disk.lru.Back()))
+	}
+}
+
+// insert adds e to memory and evicts least recently used entries over the limit. mu must be held.
+func (s *store) insert(e *entry) {
+	if el, ok := s.items[e.Key]; ok {
+		s.bytes -= el.Value.(*entry).size()
+		s.lru.Remove(el)
+	}
+	s.items[e.Key] = s.lru.PushFront(e)
+	s.bytes += e.size()
+	s.added(e)
+	for s.bytes > s.maxBytes && s.lru.Len() > 0 {
+		s.drop(s.lru.Back())
+	}
+}
+
+// drop removes an entry from memory. mu must be held.
+func (s *store) drop(el *list.Element) {
+	e := el.Value.(*entry)
+	s.lru.Remove(el)
+	delete(s.items, e.Key)
+	s.bytes -= e.size()
+	s.removed(e)
+}
+
+// purge removes every entry match returns true for and returns how many were removed.
+func (s *store) purge(match func(e *entry) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.purgeLocked(match)
+}
+
+func (s *store) purgeLocked(match func(e *entry) bool) int {
+	s.purges++
+	purged := make(map[string]bool)
+	for key, el := range s.items {
+		if match(el.Value.(*entry)) {
+			s.drop(el)
+			purged[key] = true
+		}
+	}
+	if s.disk != nil {
+		for key, el := range s.disk.items {
+			if match(el.Value.(*diskItem).meta) {
+				s.removed(s.disk.remove(el))
+				purged[key] = true
+			}
+		}
+	}
+	return len(purged)
+}
+
+// stats returns the entries and bytes in memory and on disk.
+func (s *store) stats() (entries, bytes, diskEntries, diskBytes int) {
+	s.mu.Lock()
+	entries, bytes = s.lru.Len(), s.bytes
+	if s.disk != nil {
+		diskEntries, diskBytes = s.disk.lru.Len(), s.disk.bytes
+	}
+	s.mu.Unlock()
+	return
+}
+
+// diskStore keeps entries in files named after the hash of their key: a
+// line of JSON metadata followed by the body. It is bounded by size, the
+// least recently used files are removed first. Its index is guarded by the
+// store's mutex, files are read and written outside of it.
+type diskStore struct {
+	dir      string
+	maxBytes int
+	bytes    int
+	lru      *list.List // of *diskItem, most recently used first
+	items    map[string]*list.Element
+}
+
+type diskItem struct {
+	meta *entry // without body
+	file string
+	size int
+}
+
+func openDisk(dir string, maxBytes int) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	d := &diskStore{dir: dir, maxBytes: maxBytes, lru: list.New(), items: make(map[string]*list.Element)}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type loaded struct {
+		item *diskItem
+		mod  time.Time
+	}
+	var found []loaded
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		if strings.HasPrefix(f.Name(), ".tmp-") {
+			os.Remove(path)
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		meta, err := readMeta(path)
+		if err != nil {
+			log.WithFields(log.Fields{"file": path}).Warnf("Removing unreadable cache file: %v", err)
+			os.Remove(path)
+			continue
+		}
+		found = append(found, loaded{&diskItem{meta: meta, file: path, size: int(info.Size())}, info.ModTime()})
+	}
+	// Oldest first, so the most recently written files end up in front
+	sort.Slice(found, func(i, j int) bool { return found[i].mod.Before(found[j].mod) })
+	for _, l := range found {
+		d.items[l.item.meta.Key] = d.lru.PushFront(l.item)
+		d.bytes += l.item.size
+	}
+	return d, nil
+}
+
+func readMeta(path string) (*entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var meta entry
+	if err := json.Unmarshal(line, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// readEntry reads the entry with key from file, nil when it is missing or damaged.
+func readEntry(file, key string) *entry {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	line, body, ok := bytes.Cut(data, []byte("\n"))
+	if !ok {
+		return nil
+	}
+	var e entry
+	if err := json.Unmarshal(line, &e); err != nil || e.Key != key {
+		return nil
+	}
+	e.body = body
+	return &e
+}
+
+// write writes e to its file and returns the file and its size.
+func (d *diskStore) write(e *entry) (string, int, error) {
+	meta, err := json.Marshal(e)
+	if err != nil {
+		return "", 0, err
+	}
+	sum := sha256.Sum256([]byte(e.Key))
+	file := filepath.Join(d.dir, hex.EncodeToString(sum[:]))
+	// Written to a temporary file first, so readers never see a partial entry
+	tmp, err := os.CreateTemp(d.dir, ".tmp-")
+	if err != nil {
+		return "", 0, err
+	}
+	_, err = tmp.Write(append(append(meta, '\n'), e.body...))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", 0, err
+	}
+	return file, len(meta) + 1 + len(e.body), nil
+}
+
+// lookup returns the file holding key, empty when it isn't on disk. The store's mutex must be held.
+func (d *diskStore) lookup(key string) string {
+	el, ok := d.items[key]
+	if !ok {
+		return ""
+	}
+	d.lru.MoveToFront(el)
+	return el.Value.(*diskItem).file
+}
+
+// add indexes a written file. The store's mutex must be held.
+func (d *diskStore) add(e *entry, file string, size int) {
+	item := &diskItem{meta: &entry{Key: e.Key, Host: e.Host, URI: e.URI, Vary: e.Vary}, file: file, size: size}
+	el, exists := d.items[e.Key]
+	if exists {
+		d.bytes -= el.Value.(*diskItem).size
+		d.lru.Remove(el)
+	}
+	d.items[e.Key] = d.lru.PushFront(item)
+	d.bytes += size
+}
+
+// remove drops an item and its file. The store's mutex must be held.
+func (d *diskStore) remove(el *list.Element) *entry {
+	item := el.Value.(*diskItem)
+	d.lru.Remove(el)
+	delete(d.items, item.meta.Key)
+	d.bytes -= item.size
+	os.Remove(item.file)
+	return item.meta
+}
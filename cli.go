@@ -0,0 +1,612 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/samsyntax/go-lb/balancer"
+	"github.com/samsyntax/go-lb/bench"
+	"github.com/samsyntax/go-lb/cache"
+	"github.com/samsyntax/go-lb/config"
+	"github.com/samsyntax/go-lb/pool"
+	"github.com/samsyntax/go-lb/waf"
+	log "github.com/sirupsen/logrus"
+)
+
+// Exit codes of the check command
+const (
+	exitOK        = 0 // every server is healthy
+	exitUnhealthy = 1 // at least one server failed its health check
+	exitError     = 2 // the check couldn't run, e.g. because of an invalid config
+)
+
+// runCheck implements the check command: a one-shot health check of every
+// server in the config.
+func runCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	configPath := addConfigFlags(fs)
+	format := fs.String("format", "table", "Output format: 'table' | 'json'")
+	verbose := fs.Bool("v", false, "Log every health check")
+	fs.Parse(args)
+
+	if !*verbose {
+		log.SetLevel(log.WarnLevel)
+	}
+	return checkServers(fs, *configPath, *format)
+}
+
+// checkResult is a single line of the check report.
+type checkResult struct {
+	Name     string `json:"name"`
+	Address  string `json:"address"`
+	Healthy  bool   `json:"healthy"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+func checkServers(flags *flag.FlagSet, configPath, format string) int {
+	if format != "table" && format != "json" {
+		fmt.Fprintf(os.Stderr, "unknown format %q, use 'table' or 'json'\n", format)
+		return exitError
+	}
+	cfg, err := loadConfig(flags, configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if cfg.Environment == "local" {
+		fmt.Fprintln(os.Stderr, "environment 'local' has no servers to check")
+		return exitError
+	}
+	// Requests are never served here, so nothing is recorded
+	cfg.Recording.File = ""
+	lb, err := balancer.NewFromConfig(cfg, balancer.WithHealthCheckInterval(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if err := lb.Refresh(context.Background()); err != nil {
+		fmt.Fprintf(os.Stderr, "resolving servers: %v\n", err)
+		return exitError
+	}
+
+	code := exitOK
+	var report []checkResult
+	for _, r := range lb.Pool().CheckAll() {
+		res := checkResult{
+			Name:     r.Server.Name(),
+			Address:  r.Server.Address(),
+			Healthy:  r.Err == nil,
+			Duration: r.Duration.Round(time.Millisecond).String(),
+		}
+		if r.Err != nil {
+			res.Error = r.Err.Error()
+			code = exitUnhealthy
+		}
+		report = append(report, res)
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+		return code
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tADDRESS\tSTATUS\tTIME\tERROR")
+	for _, r := range report {
+		status := "online"
+		if !r.Healthy {
+			status = "offline"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Name, r.Address, status, r.Duration, r.Error)
+	}
+	tw.Flush()
+	return code
+}
+
+// runValidate implements the validate command: it checks a config file
+// without starting the balancer and reports every problem found.
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	configFile := fs.String("config", "./config.json", "Specify a path to balancer config file in json, yaml or toml format")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		*configFile = fs.Arg(0)
+	}
+
+	cfg, err := config.Load(*configFile)
+	if err == nil && cfg.ServersFile != "" {
+		err = config.ValidateServersFile(cfg.ServersFile, cfg.Balancer.Mode)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s: OK\n", *configFile)
+	return 0
+}
+
+// addAdminFlags registers the flags used to reach a running balancer's admin
+// API and returns a func resolving its address.
+func addAdminFlags(fs *flag.FlagSet) func() (string, error) {
+	admin := fs.String("admin", "", "Address (host:port) of the admin API, admin.address from the config by default")
+	configPath := fs.String("config", "./config.json", "Specify a path to balancer config file in json, yaml or toml format")
+	return func() (string, error) {
+		if *admin != "" {
+			return *admin, nil
+		}
+		log.SetLevel(log.WarnLevel)
+		cfg, err := loadConfig(fs, *configPath)
+		if err != nil {
+			return "", err
+		}
+		if cfg.Admin.Address == "" {
+			return "", fmt.Errorf("admin API address not set, pass -admin or set admin.address")
+		}
+		return cfg.Admin.Address, nil
+	}
+}
+
+var adminClient = &http.Client{Timeout: 5 * time.Second}
+
+// adminRequest sends a request to the admin API, with body encoded as JSON
+// unless it is nil, and decodes its JSON answer into v.
+func adminRequest(method, addr, path string, body, v any) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, "http://"+addr+path, reqBody)
+	if err != nil {
+		return err
+	}
+	res, err := adminClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(resBody, &e) == nil && e.Error != "" {
+			return fmt.Errorf("%s", e.Error)
+		}
+		return fmt.Errorf("admin API: unexpected status %s", res.Status)
+	}
+	return json.Unmarshal(resBody, v)
+}
+
+// runStatus implements the status command: it prints the state of a running balancer.
+func runStatus(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	adminAddr := addAdminFlags(fs)
+	format := fs.String("format", "table", "Output format: 'table' | 'json'")
+	fs.Parse(args)
+
+	addr, err := adminAddr()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var st balancer.Status
+	if err := adminRequest(http.MethodGet, addr, "/status", nil, &st); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(st)
+		return 0
+	}
+	fmt.Printf("method: %s  mode: %s  servers: %d\n", st.Method, st.Mode, len(st.Servers))
+	if st.Split != nil {
+		fmt.Printf("split: %s\n", formatGroups(st.Split.Groups))
+	}
+	fmt.Println()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	// TCP mode dials servers per client connection, there is no pool to report
+	conns := st.Mode != balancer.ModeTCP
+	header := "NAME\tADDRESS\tSTATUS\tWEIGHT\tREQUESTS\tACTIVE"
+	if st.Split != nil {
+		header = "NAME\tADDRESS\tGROUP\tSTATUS\tWEIGHT\tREQUESTS\tACTIVE"
+	}
+	if conns {
+		header += "\tCONNS\tREUSED"
+	}
+	fmt.Fprintln(tw, header)
+	for _, s := range st.Servers {
+		row := fmt.Sprintf("%s\t%s\t%s\t%d\t%d\t%d", s.Name, s.Address, serverState(s), s.Weight, s.Requests, s.Active)
+		if st.Split != nil {
+			row = fmt.Sprintf("%s\t%s\t%s\t%s\t%d\t%d\t%d", s.Name, s.Address, s.Group, serverState(s), s.Weight, s.Requests, s.Active)
+		}
+		if conns {
+			row += "\t" + formatConns(s)
+		}
+		fmt.Fprintln(tw, row)
+	}
+	tw.Flush()
+	if m := st.Mirror; m != nil {
+		fmt.Printf("\nmirror: %g%%  mirrored: %d  errors: %d  skipped: %d  dropped: %d  latency mean: %.2fms  max: %.2fms\n\n",
+			m.Percentage, m.Mirrored, m.Errors, m.Skipped, m.Dropped, m.LatencyMeanMs, m.LatencyMaxMs)
+		fmt.Fprintln(tw, "NAME\tADDRESS\tSTATUS\tREQUESTS\tACTIVE")
+		for _, s := range m.Servers {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\n", s.Name, s.Address, serverState(s), s.Requests, s.Active)
+		}
+		tw.Flush()
+	}
+	if c := st.Cache; c != nil {
+		fmt.Printf("\ncache: %s\n", formatCacheStats(*c))
+	}
+	if w := st.WAF; w != nil {
+		fmt.Printf("\nwaf: %s\n", formatWAFStats(*w))
+	}
+	if len(st.Coalesce) > 0 {
+		fmt.Println()
+		fmt.Fprintln(tw, "ROUTE\tFORWARDED\tCOALESCED\tTIMEOUTS\tFALLBACKS")
+		names := make([]string, 0, len(st.Coalesce))
+		for name := range st.Coalesce {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			c := st.Coalesce[name]
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\n", name, c.Forwarded, c.Coalesced, c.Timeouts, c.Fallbacks)
+		}
+		tw.Flush()
+	}
+	if len(st.ForwardAuth) > 0 {
+		fmt.Println()
+		fmt.Fprintln(tw, "ROUTE\tALLOWED\tDENIED\tERRORS\tCACHE HITS")
+		names := make([]string, 0, len(st.ForwardAuth))
+		for name := range st.ForwardAuth {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			f := st.ForwardAuth[name]
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\n", name, f.Allowed, f.Denied, f.Errors, f.CacheHits)
+		}
+		tw.Flush()
+	}
+	return 0
+}
+
+// formatConns shows a server's open connections, with their limit, and the
+// share of requests sent over reused connections.
+func formatConns(s pool.Status) string {
+	open := strconv.Itoa(s.Conns.Open)
+	if s.Conns.Max > 0 {
+		open += "/" + strconv.Itoa(s.Conns.Max)
+	}
+	if s.Requests == 0 {
+		return open + "\t-"
+	}
+	return fmt.Sprintf("%s\t%.0f%%", open, min(100, 100*float64(s.Conns.Reused)/float64(s.Requests)))
+}
+
+func serverState(s pool.Status) string {
+	switch {
+	case s.Draining:
+		return "draining"
+	case s.Alive:
+		return "online"
+	default:
+		return "offline"
+	}
+}
+
+// runDrain implements the drain command: the server stops receiving new
+// requests while requests in flight complete.
+func runDrain(args []string) int {
+	fs := flag.NewFlagSet("drain", flag.ExitOnError)
+	adminAddr := addAdminFlags(fs)
+	undo := fs.Bool("undo", false, "Put a drained server back into rotation")
+	wait := fs.Duration("wait", 0, "Wait up to this long for requests in flight to complete")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: lb drain [flags] <server address or name>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	addr, err := adminAddr()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	method := http.MethodPost
+	if *undo {
+		method = http.MethodDelete
+	}
+	path := "/drain?server=" + url.QueryEscape(fs.Arg(0))
+	var st pool.Status
+	if err := adminRequest(method, addr, path, nil, &st); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *undo {
+		fmt.Printf("%s: back in rotation\n", st.Address)
+		return 0
+	}
+	fmt.Printf("%s: draining, %d in flight\n", st.Address, st.Active)
+
+	deadline := time.Now().Add(*wait)
+	for st.Active > 0 && time.Now().Before(deadline) {
+		time.Sleep(500 * time.Millisecond)
+		var status balancer.Status
+		if err := adminRequest(http.MethodGet, addr, "/status", nil, &status); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, s := range status.Servers {
+			if s.Address == st.Address {
+				st = s
+			}
+		}
+	}
+	if *wait > 0 {
+		if st.Active > 0 {
+			fmt.Fprintf(os.Stderr, "%s: %d still in flight after %s\n", st.Address, st.Active, *wait)
+			return 1
+		}
+		fmt.Printf("%s: drained\n", st.Address)
+	}
+	return 0
+}
+
+// runSplit implements the split command: it shows or changes the traffic
+// split between server groups of a running balancer.
+func runSplit(args []string) int {
+	fs := flag.NewFlagSet("split", flag.ExitOnError)
+	adminAddr := addAdminFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: lb split [flags] [group=weight ...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	weights := make(map[string]int)
+	for _, arg := range fs.Args() {
+		name, value, ok := strings.Cut(arg, "=")
+		w, err := strconv.Atoi(value)
+		if !ok || name == "" || err != nil {
+			fmt.Fprintf(os.Stderr, "expected group=weight, got %q\n", arg)
+			return 2
+		}
+		weights[name] = w
+	}
+	addr, err := adminAddr()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var st balancer.SplitStatus
+	if len(weights) == 0 {
+		err = adminRequest(http.MethodGet, addr, "/split", nil, &st)
+	} else {
+		err = adminRequest(http.MethodPut, addr, "/split", weights, &st)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(formatGroups(st.Groups))
+	return 0
+}
+
+// runCache implements the cache command: it shows the response cache stats
+// of a running balancer or purges cached responses.
+func runCache(args []string) int {
+	fs := flag.NewFlagSet("cache", flag.ExitOnError)
+	adminAddr := addAdminFlags(fs)
+	purge := fs.Bool("purge", false, "Remove cached responses, all unless -host or -prefix is set")
+	host := fs.String("host", "", "Purge the responses of this request host only, e.g. example.com")
+	prefix := fs.String("prefix", "", "Purge the responses whose path and query start with this prefix only, e.g. /static/")
+	fs.Parse(args)
+
+	addr, err := adminAddr()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *purge {
+		q := url.Values{}
+		if *host != "" {
+			q.Set("host", *host)
+		}
+		if *prefix != "" {
+			q.Set("prefix", *prefix)
+		}
+		var res balancer.PurgeResult
+		if err := adminRequest(http.MethodPost, addr, "/cache/purge?"+q.Encode(), nil, &res); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("purged %d responses\n", res.Purged)
+		return 0
+	}
+	var st cache.Stats
+	if err := adminRequest(http.MethodGet, addr, "/cache", nil, &st); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(formatCacheStats(st))
+	return 0
+}
+
+// runWAF implements the waf command: firewall decisions and the hits of
+// every rule, or the starter ruleset to base a rules file on.
+func runWAF(args []string) int {
+	fs := flag.NewFlagSet("waf", flag.ExitOnError)
+	adminAddr := addAdminFlags(fs)
+	rules := fs.Bool("starter-rules", false, "Print the built-in starter rules, to copy into a rules file")
+	fs.Parse(args)
+
+	if *rules {
+		os.Stdout.Write(waf.StarterRules)
+		return 0
+	}
+	addr, err := adminAddr()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var st waf.Stats
+	if err := adminRequest(http.MethodGet, addr, "/waf", nil, &st); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(formatWAFStats(st))
+	fmt.Println()
+	// Most hit rules first, they are the ones to check for false positives
+	sort.SliceStable(st.Rules, func(i, j int) bool { return st.Rules[i].Hits > st.Rules[j].Hits })
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RULE\tHITS")
+	for _, r := range st.Rules {
+		fmt.Fprintf(tw, "%s\t%d\n", r.ID, r.Hits)
+	}
+	tw.Flush()
+	return 0
+}
+
+func formatWAFStats(st waf.Stats) string {
+	return fmt.Sprintf("inspected: %d  blocked: %d  challenged: %d  passed: %d  logged: %d",
+		st.Inspected, st.Blocked, st.Challenged, st.Passed, st.Logged)
+}
+
+// formatCacheStats prints cache counters on one line, with the hit ratio of cacheable requests.
+func formatCacheStats(st cache.Stats) string {
+	served := st.Hits + st.Misses + st.Stale + st.Revalidated
+	ratio := 0.0
+	if served > 0 {
+		ratio = 100 * float64(st.Hits+st.Stale+st.Revalidated) / float64(served)
+	}
+	line := fmt.Sprintf("hits: %d  misses: %d  stale: %d  revalidated: %d  bypassed: %d  hit ratio: %.1f%%  entries: %d (%d bytes)",
+		st.Hits, st.Misses, st.Stale, st.Revalidated, st.Bypassed, ratio, st.Entries, st.Bytes)
+	if st.DiskEntries > 0 || st.DiskBytes > 0 {
+		line += fmt.Sprintf("  disk: %d (%d bytes)", st.DiskEntries, st.DiskBytes)
+	}
+	return line
+}
+
+// formatGroups prints group weights as shares of traffic, e.g. "stable=95 (95%) canary=5 (5%)".
+func formatGroups(groups []balancer.Group) string {
+	total := 0
+	for _, g := range groups {
+		total += g.Weight
+	}
+	parts := make([]string, 0, len(groups))
+	for _, g := range groups {
+		parts = append(parts, fmt.Sprintf("%s=%d (%.1f%%)", g.Name, g.Weight, 100*float64(g.Weight)/float64(max(total, 1))))
+	}
+	return strings.Join(parts, "  ")
+}
+
+// headerFlags collects repeated -H "Name: value" flags.
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+	return fmt.Sprint(map[string]string(h))
+}
+
+func (h headerFlags) Set(v string) error {
+	name, value, ok := strings.Cut(v, ":")
+	if !ok {
+		return fmt.Errorf("header must be 'Name: value', got %q", v)
+	}
+	h[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	return nil
+}
+
+// runBench implements the bench command: it replays a JSONL file of requests
+// or sends synthetic requests against a balancer and reports the results.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	target := fs.String("target", "http://localhost:7000", "Base URL of the balancer")
+	file := fs.String("file", "", "Replay requests from a JSONL file (one {\"method\", \"path\", \"headers\", \"body\"} object per line)")
+	method := fs.String("method", http.MethodGet, "Method of synthetic requests")
+	path := fs.String("path", "/", "Path of synthetic requests")
+	body := fs.String("body", "", "Body of synthetic requests")
+	headers := headerFlags{}
+	fs.Var(headers, "H", "Header of synthetic requests as 'Name: value', can be repeated")
+	concurrency := fs.Int("c", 10, "Requests in flight at most")
+	rps := fs.Float64("rps", 0, "Requests started per second, 0 for as fast as possible")
+	count := fs.Int("n", 0, "Stop after this many requests (every request of -file once by default)")
+	duration := fs.Duration("d", 0, "Stop after this long (10s for synthetic requests by default)")
+	backendHeader := fs.String("backend-header", "X-Backend", "Response header naming the backend, see balancer.backend_header")
+	format := fs.String("format", "text", "Output format: 'text' | 'json'")
+	fs.Parse(args)
+
+	opts := bench.Options{
+		Target:        *target,
+		Concurrency:   *concurrency,
+		RPS:           *rps,
+		Count:         *count,
+		Duration:      *duration,
+		BackendHeader: *backendHeader,
+	}
+	if *file != "" {
+		reqs, err := bench.ReadRequests(*file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		opts.Requests = reqs
+		if opts.Count == 0 && opts.Duration == 0 {
+			opts.Count = len(reqs)
+		}
+	} else {
+		opts.Requests = []bench.Request{{Method: *method, Path: *path, Headers: headers, Body: *body}}
+		if opts.Count == 0 && opts.Duration == 0 {
+			opts.Duration = 10 * time.Second
+		}
+	}
+
+	// Stop early on Ctrl+C and still print what was measured
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	res, err := bench.Run(ctx, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(res)
+	} else {
+		res.Print(os.Stdout)
+	}
+	if res.Errors > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,301 @@
+// Package coalesce collapses identical concurrent requests: while a request
+// is forwarded, further requests with the same key wait for it and get a
+// copy of its response instead of being forwarded too. This keeps a burst of
+// requests for a popular resource, e.g. right after it expired from caches,
+// from reaching the backends all at once.
+package coalesce
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Key parts a request key can be built from. Header and cookie parts name
+// the header or cookie, e.g. "header:Accept-Encoding" or "cookie:lang".
+const (
+	KeyHost         = "host"
+	KeyPath         = "path"
+	KeyQuery        = "query"
+	KeyHeaderPrefix = "header:"
+	KeyCookiePrefix = "cookie:"
+)
+
+// DefaultKey is the key used when Options.Key is empty. The request method
+// is always part of the key.
+var DefaultKey = []string{KeyHost, KeyPath, KeyQuery}
+
+// ValidKeyPart reports whether part is a known key part.
+func ValidKeyPart(part string) bool {
+	switch part {
+	case KeyHost, KeyPath, KeyQuery:
+		return true
+	}
+	name, ok := strings.CutPrefix(part, KeyHeaderPrefix)
+	if !ok {
+		name, ok = strings.CutPrefix(part, KeyCookiePrefix)
+	}
+	return ok && name != ""
+}
+
+// Options configures a Coalescer.
+type Options struct {
+	Key         []string      // parts of the request key, DefaultKey when empty
+	Timeout     time.Duration // waiting requests are forwarded on their own after this long
+	MaxBodySize int           // larger responses aren't shared, waiting requests are forwarded on their own
+}
+
+// Coalescer forwards one request per key at a time and shares its response.
+type Coalescer struct {
+	opts          Options
+	authorization bool            // Authorization is part of the key
+	cookies       bool            // cookies are part of the key
+	headers       map[string]bool // canonical names of the request headers the key holds in full
+
+	mu    sync.Mutex
+	calls map[string]*call
+
+	forwarded, coalesced, timeouts, fallbacks atomic.Int64
+}
+
+// call is a forwarded request other requests wait for.
+type call struct {
+	done   chan struct{}
+	shared bool // the response can be replayed to the waiting requests
+	status int
+	header http.Header
+	body   []byte
+}
+
+// New creates a coalescer.
+func New(opts Options) (*Coalescer, error) {
+	if len(opts.Key) == 0 {
+		opts.Key = DefaultKey
+	}
+	c := &Coalescer{
+		opts:    opts,
+		calls:   make(map[string]*call),
+		headers: map[string]bool{"If-None-Match": true, "If-Modified-Since": true},
+	}
+	for _, part := range opts.Key {
+		if !ValidKeyPart(part) {
+			return nil, fmt.Errorf("unknown key part %q", part)
+		}
+		if part == KeyHost {
+			c.headers["Host"] = true
+		}
+		if name, ok := strings.CutPrefix(part, KeyHeaderPrefix); ok {
+			c.headers[http.CanonicalHeaderKey(name)] = true
+			c.authorization = c.authorization || http.CanonicalHeaderKey(name) == "Authorization"
+			c.cookies = c.cookies || http.CanonicalHeaderKey(name) == "Cookie"
+		}
+		c.cookies = c.cookies || strings.HasPrefix(part, KeyCookiePrefix)
+	}
+	return c, nil
+}
+
+// Serve forwards r to next, unless an identical request is already being
+// forwarded: then r waits for its response.
+func (c *Coalescer) Serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	if !c.eligible(r) {
+		next.ServeHTTP(w, r)
+		return
+	}
+	key := c.key(r)
+	c.mu.Lock()
+	if cl, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		c.wait(w, r, next, cl)
+		return
+	}
+	cl := &call{done: make(chan struct{})}
+	c.calls[key] = cl
+	c.mu.Unlock()
+
+	c.forwarded.Add(1)
+	cw := &captureWriter{w: w, header: http.Header{}, max: c.opts.MaxBodySize}
+	completed := false
+	defer func() {
+		// Also runs when next panics for an aborted response, which isn't shared
+		cl.shared = completed && cw.status != 0 && !cw.tooLarge && r.Context().Err() == nil && c.shareable(cw.header)
+		if cl.shared {
+			cl.status, cl.header, cl.body = cw.status, cw.header.Clone(), cw.body.Bytes()
+		}
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(cl.done)
+	}()
+	next.ServeHTTP(cw, r)
+	completed = true
+}
+
+// wait answers r with the response of cl, or forwards it on its own when
+// that response can't be shared or doesn't arrive in time.
+func (c *Coalescer) wait(w http.ResponseWriter, r *http.Request, next http.Handler, cl *call) {
+	t := time.NewTimer(c.opts.Timeout)
+	defer t.Stop()
+	select {
+	case <-cl.done:
+	case <-t.C:
+		c.timeouts.Add(1)
+		log.WithFields(log.Fields{"url": r.URL.RequestURI(), "timeout": c.opts.Timeout}).Debug("Coalesced request timed out, forwarding it")
+		next.ServeHTTP(w, r)
+		return
+	case <-r.Context().Done():
+		return
+	}
+	if !cl.shared {
+		c.fallbacks.Add(1)
+		next.ServeHTTP(w, r)
+		return
+	}
+	c.coalesced.Add(1)
+	h := w.Header()
+	for k, v := range cl.header {
+		h[k] = v
+	}
+	w.WriteHeader(cl.status)
+	w.Write(cl.body)
+}
+
+// eligible reports whether r can share the response of an identical request:
+// a GET or HEAD without body, and with credentials only when they are part of the key.
+func (c *Coalescer) eligible(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.ContentLength > 0 || len(r.TransferEncoding) > 0 || r.Header.Get("Upgrade") != "" || r.Header.Get("Range") != "" {
+		return false
+	}
+	if strings.Contains(r.Header.Get("Cache-Control"), "no-store") {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" && !c.authorization {
+		return false
+	}
+	return r.Header.Get("Cookie") == "" || c.cookies
+}
+
+// key returns the key of r, from the method, the configured parts and the
+// validators of conditional requests, which change the response.
+func (c *Coalescer) key(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	for _, name := range []string{"If-None-Match", "If-Modified-Since"} {
+		b.WriteByte(0)
+		b.WriteString(r.Header.Get(name))
+	}
+	for _, part := range c.opts.Key {
+		b.WriteByte(0)
+		switch part {
+		case KeyHost:
+			b.WriteString(strings.ToLower(r.Host))
+		case KeyPath:
+			b.WriteString(r.URL.Path)
+		case KeyQuery:
+			b.WriteString(r.URL.RawQuery)
+		default:
+			if name, ok := strings.CutPrefix(part, KeyHeaderPrefix); ok {
+				b.WriteString(strings.Join(r.Header.Values(name), ","))
+			} else if cookie, err := r.Cookie(strings.TrimPrefix(part, KeyCookiePrefix)); err == nil {
+				b.WriteString(cookie.Value)
+			}
+		}
+	}
+	return b.String()
+}
+
+// shareable reports whether a response with header h may be given to other
+// clients. Responses varying on a request header outside the key would
+// answer waiters whose header differs with the wrong variant.
+func (c *Coalescer) shareable(h http.Header) bool {
+	if len(h.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	for _, line := range h.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" || (name != "" && !c.headers[http.CanonicalHeaderKey(name)]) {
+				return false
+			}
+		}
+	}
+	cc := strings.ToLower(strings.Join(h.Values("Cache-Control"), ","))
+	return !strings.Contains(cc, "private") && !strings.Contains(cc, "no-store")
+}
+
+// Stats are the coalescing counters reported by the admin API.
+type Stats struct {
+	Forwarded int64 `json:"forwarded"` // requests forwarded for themselves and their waiters
+	Coalesced int64 `json:"coalesced"` // requests answered with the response of another
+	Timeouts  int64 `json:"timeouts"`  // waiting requests forwarded after the timeout
+	Fallbacks int64 `json:"fallbacks"` // waiting requests forwarded because the response couldn't be shared
+}
+
+// Stats returns the current counters.
+func (c *Coalescer) Stats() Stats {
+	return Stats{
+		Forwarded: c.forwarded.Load(),
+		Coalesced: c.coalesced.Load(),
+		Timeouts:  c.timeouts.Load(),
+		Fallbacks: c.fallbacks.Load(),
+	}
+}
+
+// captureWriter passes a response through to w and keeps a copy of its body.
+// Its header is its own and copied to w when the status is written, so
+// handlers between the coalescer and the client, such as the compressor,
+// can change w's header without changing what waiters are answered with.
+type captureWriter struct {
+	w        http.ResponseWriter
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	max      int
+	tooLarge bool
+}
+
+func (cw *captureWriter) Header() http.Header {
+	return cw.header
+}
+
+func (cw *captureWriter) WriteHeader(code int) {
+	if cw.status == 0 && code >= 200 {
+		cw.status = code
+	}
+	h := cw.w.Header()
+	for k, v := range cw.header {
+		h[k] = v
+	}
+	cw.w.WriteHeader(code)
+}
+
+func (cw *captureWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.tooLarge {
+		if cw.body.Len()+len(p) > cw.max {
+			cw.tooLarge = true
+			cw.body = bytes.Buffer{}
+		} else {
+			cw.body.Write(p)
+		}
+	}
+	return cw.w.Write(p)
+}
+
+// Flush keeps streamed responses streaming.
+func (cw *captureWriter) Flush() {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(cw.w).Flush()
+}
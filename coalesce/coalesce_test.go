@@ -0,0 +1,141 @@
+package coalesce_test
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/samsyntax/go-lb/coalesce"
+	"github.com/samsyntax/go-lb/compress"
+)
+
+// Waiters of a coalesced request are compressed on their own, the shared
+// response must not carry the leader's Content-Encoding.
+func TestCompressedWaiters(t *testing.T) {
+	body := strings.Repeat("coalesced and compressed\n", 200)
+	var forwarded atomic.Int32
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("ETag", `"v1"`)
+		io.WriteString(w, body)
+	})
+	co, err := coalesce.New(coalesce.Options{Timeout: 5 * time.Second, MaxBodySize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp, err := compress.New(compress.Options{Encodings: []string{"gzip"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		cp.Serve(w, r, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			co.Serve(w, r, backend)
+		}))
+	}
+
+	const clients = 5
+	recs := make([]*httptest.ResponseRecorder, clients)
+	var wg sync.WaitGroup
+	for i := range recs {
+		recs[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(rec *httptest.ResponseRecorder) {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/popular", nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			handler(rec, r)
+		}(recs[i])
+		if i == 0 {
+			// Let the first request be forwarded before the others arrive
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	wg.Wait()
+
+	if n := forwarded.Load(); n != 1 {
+		t.Fatalf("forwarded %d requests, want 1", n)
+	}
+	if st := co.Stats(); st.Coalesced != clients-1 {
+		t.Fatalf("coalesced %d requests, want %d", st.Coalesced, clients-1)
+	}
+	for i, rec := range recs {
+		if enc := rec.Header().Get("Content-Encoding"); enc != "gzip" {
+			t.Fatalf("client %d: Content-Encoding %q, want gzip", i, enc)
+		}
+		zr, err := gzip.NewReader(rec.Body)
+		if err != nil {
+			t.Fatalf("client %d: %v", i, err)
+		}
+		got, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("client %d: %v", i, err)
+		}
+		if string(got) != body {
+			t.Fatalf("client %d: body differs from the backend's", i)
+		}
+	}
+}
+
+// Responses varying on a header outside the key aren't shared: every waiter
+// is forwarded and gets the variant for its own header. Varying on a header
+// of the key is fine, requests of a call all send the same value.
+func TestVary(t *testing.T) {
+	var forwarded atomic.Int32
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		w.Header().Set("Vary", "Accept-Language")
+		io.WriteString(w, r.Header.Get("Accept-Language"))
+	})
+	for _, tc := range []struct {
+		key       []string
+		langs     []string
+		coalesced int64
+	}{
+		{key: nil, langs: []string{"en", "de", "fr"}, coalesced: 0},
+		{key: nil, langs: []string{"en", "en", "en"}, coalesced: 0},
+		{key: []string{coalesce.KeyPath, "header:accept-language"}, langs: []string{"en", "en", "en"}, coalesced: 2},
+	} {
+		forwarded.Store(0)
+		co, err := coalesce.New(coalesce.Options{Key: tc.key, Timeout: 5 * time.Second, MaxBodySize: 1 << 20})
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs := make([]*httptest.ResponseRecorder, len(tc.langs))
+		var wg sync.WaitGroup
+		for i, lang := range tc.langs {
+			recs[i] = httptest.NewRecorder()
+			wg.Add(1)
+			go func(rec *httptest.ResponseRecorder, lang string) {
+				defer wg.Done()
+				r := httptest.NewRequest(http.MethodGet, "http://example.com/page", nil)
+				r.Header.Set("Accept-Language", lang)
+				co.Serve(rec, r, backend)
+			}(recs[i], lang)
+			if i == 0 {
+				time.Sleep(50 * time.Millisecond)
+			}
+		}
+		wg.Wait()
+
+		if st := co.Stats(); st.Coalesced != tc.coalesced {
+			t.Errorf("key %v, %v: coalesced %d requests, want %d", tc.key, tc.langs, st.Coalesced, tc.coalesced)
+		}
+		if n, want := int64(forwarded.Load()), int64(len(tc.langs))-tc.coalesced; n != want {
+			t.Errorf("key %v, %v: forwarded %d requests, want %d", tc.key, tc.langs, n, want)
+		}
+		for i, rec := range recs {
+			if got := rec.Body.String(); got != tc.langs[i] {
+				t.Errorf("key %v: client %d got the %q variant, want %q", tc.key, i, got, tc.langs[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,352 @@
+// Package compress negotiates Accept-Encoding and compresses responses with
+// zstd, brotli or gzip while they stream through the balancer, and can
+// decompress request bodies for backends that only accept plain ones.
+package compress
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+)
+
+// Supported content codings
+const (
+	Zstd   = "zstd"
+	Brotli = "br"
+	Gzip   = "gzip"
+)
+
+// DefaultEncodings are the encodings used when Options.Encodings is empty, by preference.
+var DefaultEncodings = []string{Zstd, Brotli, Gzip}
+
+// DefaultContentTypes are the types compressed when Options.ContentTypes is empty.
+var DefaultContentTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// Supported reports whether encoding is a supported content coding.
+func Supported(encoding string) bool {
+	return encoding == Zstd || encoding == Brotli || encoding == Gzip
+}
+
+// Options configures a Compressor.
+type Options struct {
+	Encodings    []string // encodings offered, by preference; DefaultEncodings when empty
+	MinSize      int      // smaller responses are sent as they are
+	ContentTypes []string // media types compressed, or type prefixes ending in "/"; DefaultContentTypes when empty
+
+	// DecompressRequests decodes request bodies sent with a supported
+	// Content-Encoding before they are forwarded.
+	DecompressRequests bool
+}
+
+// Compressor compresses responses and decompresses requests.
+type Compressor struct {
+	opts     Options
+	encoders map[string]*sync.Pool
+}
+
+// encoder is implemented by the writers of every supported encoding.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// New creates a compressor.
+func New(opts Options) (*Compressor, error) {
+	if len(opts.Encodings) == 0 {
+		opts.Encodings = DefaultEncodings
+	}
+	if len(opts.ContentTypes) == 0 {
+		opts.ContentTypes = DefaultContentTypes
+	}
+	c := &Compressor{opts: opts, encoders: make(map[string]*sync.Pool)}
+	for _, enc := range opts.Encodings {
+		var newEncoder func() any
+		switch enc {
+		case Zstd:
+			newEncoder = func() any {
+				e, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+				return e
+			}
+		case Brotli:
+			// Level 4 compresses better than gzip at a similar speed
+			newEncoder = func() any { return brotli.NewWriterLevel(nil, 4) }
+		case Gzip:
+			newEncoder = func() any { return gzip.NewWriter(nil) }
+		default:
+			return nil, fmt.Errorf("unsupported encoding %q", enc)
+		}
+		c.encoders[enc] = &sync.Pool{New: newEncoder}
+	}
+	return c, nil
+}
+
+// Serve passes r to next, decompressing its body if enabled and compressing
+// the response with the best encoding the client accepts.
+func (c *Compressor) Serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	if !c.Decompress(w, r, 0) {
+		return
+	}
+	encoding := c.negotiate(r.Header.Get("Accept-Encoding"))
+	if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" {
+		next.ServeHTTP(w, r)
+		return
+	}
+	cw := &responseWriter{w: w, c: c, encoding: encoding}
+	defer cw.close()
+	next.ServeHTTP(cw, r)
+}
+
+// Decompress decodes the body of r if requests are decompressed, for
+// handlers that have to see the plain body before Serve runs, such as the
+// WAF. Decoded requests lose their Content-Encoding, so Serve leaves them be.
+// Bodies that can't be decoded are answered with 400 and Decompress reports
+// false. Decoded bodies over maxSize bytes fail with *http.MaxBytesError,
+// unless maxSize is 0.
+func (c *Compressor) Decompress(w http.ResponseWriter, r *http.Request, maxSize int64) bool {
+	if !c.opts.DecompressRequests {
+		return true
+	}
+	if err := decompress(w, r, maxSize); err != nil {
+		log.WithFields(log.Fields{"client": r.RemoteAddr, "encoding": r.Header.Get("Content-Encoding")}).Warnf("Failed to decompress request: %v", err)
+		http.Error(w, "invalid request body encoding", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// negotiate returns the encoding an Accept-Encoding header weighs highest,
+// empty when none is accepted.
+func (c *Compressor) negotiate(accept string) string {
+	if accept == "" {
+		return ""
+	}
+	q := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		weight := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				weight = f
+			}
+		}
+		q[strings.ToLower(strings.TrimSpace(name))] = weight
+	}
+	best, bestWeight := "", 0.0
+	for _, enc := range c.opts.Encodings {
+		weight, ok := q[enc]
+		if !ok {
+			weight = q["*"]
+		}
+		// Ties go to the encoding offered first
+		if weight > bestWeight {
+			best, bestWeight = enc, weight
+		}
+	}
+	return best
+}
+
+// compressible reports whether a response with header h may be compressed.
+func (c *Compressor) compressible(h http.Header) bool {
+	if ce := h.Get("Content-Encoding"); ce != "" && ce != "identity" {
+		return false
+	}
+	if strings.Contains(h.Get("Cache-Control"), "no-transform") || h.Get("Content-Range") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, t := range c.opts.ContentTypes {
+		if mediaType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// responseWriter compresses a response once it is known to be large enough,
+// from its Content-Length or from the first MinSize bytes of its body.
+type responseWriter struct {
+	w        http.ResponseWriter
+	c        *Compressor
+	encoding string
+
+	status  int
+	decided bool    // the header was written, compressed or not
+	enc     encoder // nil when the response is sent as it is
+	buf     []byte  // body written before the decision
+}
+
+func (cw *responseWriter) Header() http.Header {
+	return cw.w.Header()
+}
+
+func (cw *responseWriter) WriteHeader(code int) {
+	if code < 200 {
+		cw.w.WriteHeader(code)
+		return
+	}
+	if cw.status != 0 {
+		return
+	}
+	cw.status = code
+	if code == http.StatusNoContent || code == http.StatusNotModified || code == http.StatusPartialContent {
+		cw.decide(false)
+		return
+	}
+	if cl := cw.Header().Get("Content-Length"); cl != "" {
+		n, err := strconv.Atoi(cl)
+		cw.decide(err == nil && n >= cw.c.opts.MinSize)
+	}
+}
+
+func (cw *responseWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		cw.buf = append(cw.buf, p...)
+		if len(cw.buf) >= cw.c.opts.MinSize {
+			if err := cw.decide(true); err != nil {
+				return 0, err
+			}
+		}
+		return len(p), nil
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(p)
+	}
+	return cw.w.Write(p)
+}
+
+// Flush sends what was written so far. Responses flushed before MinSize
+// bytes are streamed, and compressed when their type allows.
+func (cw *responseWriter) Flush() {
+	if cw.status == 0 {
+		return
+	}
+	if !cw.decided {
+		cw.decide(true)
+	}
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+	http.NewResponseController(cw.w).Flush()
+}
+
+// decide writes the header, compressing the response when size allows and
+// its type and headers do, then writes the buffered body.
+func (cw *responseWriter) decide(size bool) error {
+	cw.decided = true
+	h := cw.Header()
+	if cw.c.compressible(h) {
+		h.Add("Vary", "Accept-Encoding")
+		if size {
+			h.Set("Content-Encoding", cw.encoding)
+			h.Del("Content-Length")
+			// The compressed body is a different representation
+			if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				h.Set("ETag", "W/"+etag)
+			}
+			cw.enc = cw.c.encoders[cw.encoding].Get().(encoder)
+			cw.enc.Reset(cw.w)
+		}
+	}
+	cw.w.WriteHeader(cw.status)
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	buf := cw.buf
+	cw.buf = nil
+	if cw.enc != nil {
+		_, err := cw.enc.Write(buf)
+		return err
+	}
+	_, err := cw.w.Write(buf)
+	return err
+}
+
+// close ends the response, sending small responses as they are.
+func (cw *responseWriter) close() {
+	if cw.status == 0 {
+		return
+	}
+	if !cw.decided {
+		cw.decide(false)
+	}
+	if cw.enc != nil {
+		if err := cw.enc.Close(); err != nil {
+			log.Errorf("Failed to finish %s response: %v", cw.encoding, err)
+		}
+		cw.enc.Reset(io.Discard)
+		cw.c.encoders[cw.encoding].Put(cw.enc)
+		cw.enc = nil
+	}
+}
+
+// decompress replaces the body of r sent with a supported Content-Encoding
+// by its decoded content, limited to maxSize bytes unless it is 0: a limit on
+// the compressed body alone lets a few kilobytes expand to gigabytes.
+func decompress(w http.ResponseWriter, r *http.Request, maxSize int64) error {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	if !Supported(encoding) || r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	var body io.ReadCloser
+	switch encoding {
+	case Gzip:
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return err
+		}
+		body = readCloser{zr, r.Body.Close}
+	case Brotli:
+		body = readCloser{brotli.NewReader(r.Body), r.Body.Close}
+	case Zstd:
+		zr, err := zstd.NewReader(r.Body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		orig := r.Body
+		body = readCloser{zr, func() error {
+			zr.Close()
+			return orig.Close()
+		}}
+	}
+	if maxSize > 0 {
+		body = http.MaxBytesReader(w, body, maxSize)
+	}
+	r.Body = body
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	r.ContentLength = -1
+	return nil
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (rc readCloser) Close() error {
+	return rc.close()
+}
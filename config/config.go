@@ -0,0 +1,486 @@
+// Package config defines the balancer's versioned configuration schema and
+// loads it from JSON, YAML or TOML files with strict, line-numbered
+// validation, environment variable expansion and layered overrides.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SchemaVersion is the configuration schema version understood by this build.
+const SchemaVersion = 1
+
+// Protocols supported when talking to upstream servers
+const (
+	ProtocolHTTP1 = "http1" // HTTP/1.1, over TLS too
+	ProtocolH2    = "h2"    // HTTP/2 over TLS only
+	ProtocolH2C   = "h2c"   // HTTP/2 over cleartext TCP with prior knowledge
+)
+
+// DNS record types the DNS discovery provider can resolve
+const (
+	RecordSRV = "srv"
+	RecordA   = "a" // A and AAAA records
+)
+
+// ValidProtocol reports whether protocol is empty (http1) or a known upstream protocol.
+func ValidProtocol(protocol string) bool {
+	switch protocol {
+	case "", ProtocolHTTP1, ProtocolH2, ProtocolH2C:
+		return true
+	}
+	return false
+}
+
+// Config is the balancer configuration. The same schema is accepted from
+// JSON, YAML and TOML files.
+type Config struct {
+	Version     int               `json:"version" yaml:"version" toml:"version"`
+	Environment string            `json:"environment" yaml:"environment" toml:"environment"` // local | external | dns | directory | endpoint
+	Balancer    BalancerConfig    `json:"balancer" yaml:"balancer" toml:"balancer"`
+	HealthCheck HealthCheckConfig `json:"health_check" yaml:"health_check" toml:"health_check"`
+	Local       LocalConfig       `json:"local" yaml:"local" toml:"local"`
+	Servers     []ServerConfig    `json:"servers" yaml:"servers" toml:"servers"`
+	ServersFile string            `json:"servers_file" yaml:"servers_file" toml:"servers_file" path:"true"`
+	Discovery   DiscoveryConfig   `json:"discovery" yaml:"discovery" toml:"discovery"`
+	Admin       AdminConfig       `json:"admin" yaml:"admin" toml:"admin"`
+	Recording   RecordingConfig   `json:"recording" yaml:"recording" toml:"recording"`
+	Split       SplitConfig       `json:"split" yaml:"split" toml:"split"`
+	Mirror      MirrorConfig      `json:"mirror" yaml:"mirror" toml:"mirror"`
+	Cache       CacheConfig       `json:"cache" yaml:"cache" toml:"cache"`
+	Compression CompressionConfig `json:"compression" yaml:"compression" toml:"compression"`
+	Auth        AuthConfig        `json:"auth" yaml:"auth" toml:"auth"`
+	Access      AccessConfig      `json:"access" yaml:"access" toml:"access"`
+	Limits      LimitsConfig      `json:"limits" yaml:"limits" toml:"limits"`
+	WAF         WAFConfig         `json:"waf" yaml:"waf" toml:"waf"`
+	Transport   TransportConfig   `json:"transport" yaml:"transport" toml:"transport"` // connections to every server, servers can override it
+	Routes      []RouteConfig     `json:"routes" yaml:"routes" toml:"routes"`
+
+	file      string         // file the config was loaded from, used in error messages
+	positions map[string]int // line of every key in the file, by path
+}
+
+type BalancerConfig struct {
+	Port          int                 `json:"port" yaml:"port" toml:"port"`
+	Method        string              `json:"method" yaml:"method" toml:"method"` // rr | wrr
+	Mode          string              `json:"mode" yaml:"mode" toml:"mode"`       // http | grpc | tcp
+	H2C           bool                `json:"h2c" yaml:"h2c" toml:"h2c"`
+	TLS           TLSConfig           `json:"tls" yaml:"tls" toml:"tls"`
+	ProxyProtocol ProxyProtocolConfig `json:"proxy_protocol" yaml:"proxy_protocol" toml:"proxy_protocol"`
+	BackendHeader string              `json:"backend_header" yaml:"backend_header" toml:"backend_header"` // response header naming the server that answered, empty to disable
+}
+
+type TLSConfig struct {
+	CertFile string `json:"cert_file" yaml:"cert_file" toml:"cert_file" path:"true"`
+	KeyFile  string `json:"key_file" yaml:"key_file" toml:"key_file" path:"true"`
+}
+
+type ProxyProtocolConfig struct {
+	Enabled        bool     `json:"enabled" yaml:"enabled" toml:"enabled"`
+	TrustedProxies []string `json:"trusted_proxies" yaml:"trusted_proxies" toml:"trusted_proxies"`
+}
+
+type HealthCheckConfig struct {
+	Interval Duration `json:"interval" yaml:"interval" toml:"interval"`
+}
+
+type LocalConfig struct {
+	Amount  int                 `json:"amount" yaml:"amount" toml:"amount"`
+	Port    int                 `json:"port" yaml:"port" toml:"port"`
+	Servers []LocalServerConfig `json:"servers" yaml:"servers" toml:"servers"` // per-server behaviour by index, the rest behave normally
+}
+
+// LocalServerConfig describes how a local dev server behaves, so health
+// checks, retries and outlier ejection can be exercised locally.
+type LocalServerConfig struct {
+	Weight        int           `json:"weight" yaml:"weight" toml:"weight"`
+	Latency       LatencyConfig `json:"latency" yaml:"latency" toml:"latency"`
+	ErrorRate     float64       `json:"error_rate" yaml:"error_rate" toml:"error_rate"` // share of requests answered with 500
+	DropRate      float64       `json:"drop_rate" yaml:"drop_rate" toml:"drop_rate"`    // share of requests whose connection is dropped
+	HealthLatency Duration      `json:"health_latency" yaml:"health_latency" toml:"health_latency"`
+	Down          bool          `json:"down" yaml:"down" toml:"down"`    // start unhealthy
+	Group         string        `json:"group" yaml:"group" toml:"group"` // group traffic is split between
+}
+
+// LatencyConfig is an artificial latency distribution.
+type LatencyConfig struct {
+	Distribution string   `json:"distribution" yaml:"distribution" toml:"distribution"` // fixed | uniform | normal | exponential
+	Mean         Duration `json:"mean" yaml:"mean" toml:"mean"`
+	Stddev       Duration `json:"stddev" yaml:"stddev" toml:"stddev"`
+	Min          Duration `json:"min" yaml:"min" toml:"min"`
+	Max          Duration `json:"max" yaml:"max" toml:"max"`
+}
+
+// ServerConfig describes a single upstream server. Static lists, servers
+// files and every discovery provider produce entries of this type.
+type ServerConfig struct {
+	Address           string          `json:"address" yaml:"address" toml:"address"`
+	Weight            int             `json:"weight" yaml:"weight" toml:"weight"`
+	Protocol          string          `json:"protocol" yaml:"protocol" toml:"protocol"`
+	SendProxyProtocol string          `json:"send_proxy_protocol" yaml:"send_proxy_protocol" toml:"send_proxy_protocol"`
+	Group             string          `json:"group" yaml:"group" toml:"group"`             // group traffic is split between, see SplitConfig
+	Transport         TransportConfig `json:"transport" yaml:"transport" toml:"transport"` // overrides the global transport settings where set
+}
+
+// TransportConfig tunes the connections to a server. Zero fields keep the
+// defaults; MaxIdleConns, MaxConns and Prewarm only apply to HTTP/1, HTTP/2
+// sends every request over a single connection.
+type TransportConfig struct {
+	MaxIdleConns int      `json:"max_idle_conns" yaml:"max_idle_conns" toml:"max_idle_conns"` // idle connections kept open, -1 to close connections after each request
+	MaxConns     int      `json:"max_conns" yaml:"max_conns" toml:"max_conns"`                // open connections at most, further requests wait for one
+	IdleTimeout  Duration `json:"idle_timeout" yaml:"idle_timeout" toml:"idle_timeout"`       // idle connections are closed after
+	KeepAlive    Duration `json:"keep_alive" yaml:"keep_alive" toml:"keep_alive"`             // TCP keep-alive probe interval, -1s to disable probes
+	DialTimeout  Duration `json:"dial_timeout" yaml:"dial_timeout" toml:"dial_timeout"`
+	Prewarm      int      `json:"prewarm" yaml:"prewarm" toml:"prewarm"` // connections opened ahead of requests and kept open
+}
+
+// Merge returns t with the fields set in o replacing its own.
+func (t TransportConfig) Merge(o TransportConfig) TransportConfig {
+	if o.MaxIdleConns != 0 {
+		t.MaxIdleConns = o.MaxIdleConns
+	}
+	if o.MaxConns != 0 {
+		t.MaxConns = o.MaxConns
+	}
+	if o.IdleTimeout != 0 {
+		t.IdleTimeout = o.IdleTimeout
+	}
+	if o.KeepAlive != 0 {
+		t.KeepAlive = o.KeepAlive
+	}
+	if o.DialTimeout != 0 {
+		t.DialTimeout = o.DialTimeout
+	}
+	if o.Prewarm != 0 {
+		t.Prewarm = o.Prewarm
+	}
+	return t
+}
+
+type DiscoveryConfig struct {
+	Interval  Duration        `json:"interval" yaml:"interval" toml:"interval"`
+	DNS       DNSConfig       `json:"dns" yaml:"dns" toml:"dns"`
+	Directory DirectoryConfig `json:"directory" yaml:"directory" toml:"directory"`
+	Endpoint  EndpointConfig  `json:"endpoint" yaml:"endpoint" toml:"endpoint"`
+}
+
+type DNSConfig struct {
+	Name       string `json:"name" yaml:"name" toml:"name"`
+	Record     string `json:"record" yaml:"record" toml:"record"` // srv | a
+	Port       int    `json:"port" yaml:"port" toml:"port"`
+	Scheme     string `json:"scheme" yaml:"scheme" toml:"scheme"`
+	Protocol   string `json:"protocol" yaml:"protocol" toml:"protocol"`
+	Nameserver string `json:"nameserver" yaml:"nameserver" toml:"nameserver"`
+}
+
+type DirectoryConfig struct {
+	Path string `json:"path" yaml:"path" toml:"path" path:"true"`
+}
+
+type EndpointConfig struct {
+	URL string `json:"url" yaml:"url" toml:"url"`
+}
+
+// AdminConfig enables the admin API used by the status and drain commands.
+type AdminConfig struct {
+	Address string `json:"address" yaml:"address" toml:"address"` // host:port, empty disables the admin API
+}
+
+// RecordingConfig writes sampled requests to a JSONL file that the bench
+// command can replay.
+type RecordingConfig struct {
+	File          string   `json:"file" yaml:"file" toml:"file" path:"true"`                   // JSONL file, empty disables recording
+	SampleRate    float64  `json:"sample_rate" yaml:"sample_rate" toml:"sample_rate"`          // share of requests recorded, (0, 1]
+	RedactHeaders []string `json:"redact_headers" yaml:"redact_headers" toml:"redact_headers"` // headers recorded as [REDACTED]
+	MaxBodySize   int      `json:"max_body_size" yaml:"max_body_size" toml:"max_body_size"`    // bytes of each body recorded, -1 to skip bodies
+	Responses     bool     `json:"responses" yaml:"responses" toml:"responses"`                // record response headers and bodies too
+}
+
+// SplitConfig splits traffic between named server groups by weight, e.g.
+// 95% to stable and 5% to canary servers. A request can force a group with
+// a header or cookie naming it.
+type SplitConfig struct {
+	Groups []GroupConfig `json:"groups" yaml:"groups" toml:"groups"`
+	Header string        `json:"header" yaml:"header" toml:"header"` // request header forcing a group, empty to disable
+	Cookie string        `json:"cookie" yaml:"cookie" toml:"cookie"` // cookie forcing a group, empty to disable
+}
+
+type GroupConfig struct {
+	Name   string `json:"name" yaml:"name" toml:"name"`
+	Weight int    `json:"weight" yaml:"weight" toml:"weight"` // share of traffic relative to the other groups, 0 for forced requests only
+}
+
+// MirrorConfig sends a copy of a share of requests to a shadow pool whose
+// responses are discarded.
+type MirrorConfig struct {
+	Servers     []ServerConfig `json:"servers" yaml:"servers" toml:"servers"`
+	Percentage  float64        `json:"percentage" yaml:"percentage" toml:"percentage"`          // share of requests mirrored in percent, 0 disables mirroring
+	MaxBodySize int            `json:"max_body_size" yaml:"max_body_size" toml:"max_body_size"` // requests with larger bodies are not mirrored
+	Timeout     Duration       `json:"timeout" yaml:"timeout" toml:"timeout"`
+	MaxInFlight int            `json:"max_in_flight" yaml:"max_in_flight" toml:"max_in_flight"` // shadow requests in flight at most, further ones are dropped
+}
+
+// CacheConfig enables the response cache in front of the servers.
+type CacheConfig struct {
+	Enabled      bool     `json:"enabled" yaml:"enabled" toml:"enabled"`
+	MaxSize      int      `json:"max_size" yaml:"max_size" toml:"max_size"`                   // bytes of responses kept in memory
+	MaxEntrySize int      `json:"max_entry_size" yaml:"max_entry_size" toml:"max_entry_size"` // larger responses are not stored
+	Dir          string   `json:"dir" yaml:"dir" toml:"dir" path:"true"`                      // directory responses are also stored in, empty for memory only
+	MaxDiskSize  int      `json:"max_disk_size" yaml:"max_disk_size" toml:"max_disk_size"`    // bytes of responses kept in dir
+	StaleIfError Duration `json:"stale_if_error" yaml:"stale_if_error" toml:"stale_if_error"` // serve expired responses this long while no server is available, unless responses set stale-if-error
+}
+
+// CompressionConfig compresses responses for clients accepting it and can
+// decompress request bodies for servers that can't.
+type CompressionConfig struct {
+	Enabled            bool     `json:"enabled" yaml:"enabled" toml:"enabled"`
+	Encodings          []string `json:"encodings" yaml:"encodings" toml:"encodings"`             // zstd, br, gzip, by preference
+	MinSize            int      `json:"min_size" yaml:"min_size" toml:"min_size"`                // smaller responses are sent as they are
+	ContentTypes       []string `json:"content_types" yaml:"content_types" toml:"content_types"` // media types, or prefixes ending in "/"
+	DecompressRequests bool     `json:"decompress_requests" yaml:"decompress_requests" toml:"decompress_requests"`
+}
+
+// AuthConfig configures the authentication methods routes can require.
+type AuthConfig struct {
+	APIKeys APIKeysConfig   `json:"api_keys" yaml:"api_keys" toml:"api_keys"`
+	Basic   BasicAuthConfig `json:"basic" yaml:"basic" toml:"basic"`
+	JWT     JWTConfig       `json:"jwt" yaml:"jwt" toml:"jwt"`
+}
+
+// APIKeysConfig looks API keys up in a file of "<subject> <key>" lines.
+type APIKeysConfig struct {
+	File   string `json:"file" yaml:"file" toml:"file" path:"true"`
+	Header string `json:"header" yaml:"header" toml:"header"`
+	Query  string `json:"query" yaml:"query" toml:"query"` // query parameter also accepted, empty for none
+}
+
+// BasicAuthConfig checks HTTP Basic credentials against a file of "<user>:<bcrypt hash>" lines.
+type BasicAuthConfig struct {
+	File  string `json:"file" yaml:"file" toml:"file" path:"true"`
+	Realm string `json:"realm" yaml:"realm" toml:"realm"`
+}
+
+// JWTConfig verifies bearer tokens with a secret (HS*) or a JWKS (RS*, PS*, ES*).
+type JWTConfig struct {
+	Secret      string   `json:"secret" yaml:"secret" toml:"secret"`
+	JWKSFile    string   `json:"jwks_file" yaml:"jwks_file" toml:"jwks_file" path:"true"`
+	JWKSURL     string   `json:"jwks_url" yaml:"jwks_url" toml:"jwks_url"`
+	JWKSRefresh Duration `json:"jwks_refresh" yaml:"jwks_refresh" toml:"jwks_refresh"`
+	Issuer      string   `json:"issuer" yaml:"issuer" toml:"issuer"`
+	Audience    []string `json:"audience" yaml:"audience" toml:"audience"` // aud has to contain one of them
+	Algorithms  []string `json:"algorithms" yaml:"algorithms" toml:"algorithms"`
+	Leeway      Duration `json:"leeway" yaml:"leeway" toml:"leeway"` // clock skew allowed for exp and nbf
+}
+
+// RouteAuthConfig requires the requests of a route to authenticate with one
+// of the listed methods. Authenticated requests can further be restricted
+// to subjects and claim values, and verified claims forwarded as headers.
+type RouteAuthConfig struct {
+	Methods  []string          `json:"methods" yaml:"methods" toml:"methods"` // api_key | basic | jwt, empty to disable authentication
+	Subjects []string          `json:"subjects" yaml:"subjects" toml:"subjects"`
+	Claims   map[string]string `json:"claims" yaml:"claims" toml:"claims"`    // required claim values, e.g. {role: admin}
+	Headers  map[string]string `json:"headers" yaml:"headers" toml:"headers"` // request headers set from claims, e.g. {sub: X-User}
+}
+
+// AccessConfig allows and denies every request by client IP. Deny rules
+// are checked first; when allow rules are set, clients have to match one of
+// them too.
+type AccessConfig struct {
+	TrustedProxies []string `json:"trusted_proxies" yaml:"trusted_proxies" toml:"trusted_proxies"` // IPs and CIDRs whose X-Forwarded-For is believed
+	GeoIPDB        string   `json:"geoip_db" yaml:"geoip_db" toml:"geoip_db" path:"true"`          // MaxMind DB file for country rules, here and in routes
+	Allow          []string `json:"allow" yaml:"allow" toml:"allow"`                               // IPs and CIDRs
+	Deny           []string `json:"deny" yaml:"deny" toml:"deny"`
+	AllowFile      string   `json:"allow_file" yaml:"allow_file" toml:"allow_file" path:"true"` // one IP or CIDR per line, reloaded when changed
+	DenyFile       string   `json:"deny_file" yaml:"deny_file" toml:"deny_file" path:"true"`
+	AllowCountries []string `json:"allow_countries" yaml:"allow_countries" toml:"allow_countries"` // ISO 3166-1 alpha-2 codes
+	DenyCountries  []string `json:"deny_countries" yaml:"deny_countries" toml:"deny_countries"`
+}
+
+// RouteAccessConfig allows and denies the requests of a route by client IP,
+// after the global access rules.
+type RouteAccessConfig struct {
+	Allow          []string `json:"allow" yaml:"allow" toml:"allow"`
+	Deny           []string `json:"deny" yaml:"deny" toml:"deny"`
+	AllowFile      string   `json:"allow_file" yaml:"allow_file" toml:"allow_file" path:"true"`
+	DenyFile       string   `json:"deny_file" yaml:"deny_file" toml:"deny_file" path:"true"`
+	AllowCountries []string `json:"allow_countries" yaml:"allow_countries" toml:"allow_countries"`
+	DenyCountries  []string `json:"deny_countries" yaml:"deny_countries" toml:"deny_countries"`
+}
+
+// LimitsConfig protects the listener from slow and oversized requests and
+// bounds the time spent waiting for servers. Zero timeouts and sizes are
+// unlimited.
+type LimitsConfig struct {
+	ReadHeaderTimeout     Duration `json:"read_header_timeout" yaml:"read_header_timeout" toml:"read_header_timeout"` // slower clients are disconnected
+	ReadTimeout           Duration `json:"read_timeout" yaml:"read_timeout" toml:"read_timeout"`                      // to receive a request body, 408 after
+	WriteTimeout          Duration `json:"write_timeout" yaml:"write_timeout" toml:"write_timeout"`                   // to send a response
+	IdleTimeout           Duration `json:"idle_timeout" yaml:"idle_timeout" toml:"idle_timeout"`                      // keep-alive connections are closed after
+	MaxHeaderBytes        int      `json:"max_header_bytes" yaml:"max_header_bytes" toml:"max_header_bytes"`          // larger request headers get 431
+	MaxBodySize           int64    `json:"max_body_size" yaml:"max_body_size" toml:"max_body_size"`                   // larger request bodies get 413
+	UpstreamTimeout       Duration `json:"upstream_timeout" yaml:"upstream_timeout" toml:"upstream_timeout"`          // for a server's whole response, 504 after
+	UpstreamHeaderTimeout Duration `json:"upstream_header_timeout" yaml:"upstream_header_timeout" toml:"upstream_header_timeout"`
+}
+
+// RouteLimitsConfig overrides the request limits for a route. Zero fields
+// keep the global limits.
+type RouteLimitsConfig struct {
+	ReadTimeout           Duration `json:"read_timeout" yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout          Duration `json:"write_timeout" yaml:"write_timeout" toml:"write_timeout"`
+	MaxBodySize           int64    `json:"max_body_size" yaml:"max_body_size" toml:"max_body_size"`
+	UpstreamTimeout       Duration `json:"upstream_timeout" yaml:"upstream_timeout" toml:"upstream_timeout"`
+	UpstreamHeaderTimeout Duration `json:"upstream_header_timeout" yaml:"upstream_header_timeout" toml:"upstream_header_timeout"`
+}
+
+// WAFConfig inspects requests with the rules of a web application firewall.
+type WAFConfig struct {
+	Enabled         bool     `json:"enabled" yaml:"enabled" toml:"enabled"`
+	RulesFile       string   `json:"rules_file" yaml:"rules_file" toml:"rules_file" path:"true"` // empty for the built-in starter rules
+	Mode            string   `json:"mode" yaml:"mode" toml:"mode"`                               // block | log | challenge | off, routes can override it
+	Threshold       int      `json:"threshold" yaml:"threshold" toml:"threshold"`                // rule score handled by the mode
+	MaxBodySize     int64    `json:"max_body_size" yaml:"max_body_size" toml:"max_body_size"`    // bytes of request bodies inspected, -1 to skip bodies
+	ChallengeSecret string   `json:"challenge_secret" yaml:"challenge_secret" toml:"challenge_secret"`
+	ChallengeTTL    Duration `json:"challenge_ttl" yaml:"challenge_ttl" toml:"challenge_ttl"`
+}
+
+// RouteWAFConfig tunes the firewall for a route.
+type RouteWAFConfig struct {
+	Mode          string   `json:"mode" yaml:"mode" toml:"mode"`                               // empty for waf.mode
+	DisabledRules []string `json:"disabled_rules" yaml:"disabled_rules" toml:"disabled_rules"` // IDs of rules causing false positives
+}
+
+// CORSConfig lets the balancer answer CORS preflight requests and set the
+// CORS headers of a route's responses, replacing those of the servers.
+type CORSConfig struct {
+	AllowedOrigins        []string `json:"allowed_origins" yaml:"allowed_origins" toml:"allowed_origins"`                         // exact, https://*.example.com or "*"; empty with no patterns disables CORS handling
+	AllowedOriginPatterns []string `json:"allowed_origin_patterns" yaml:"allowed_origin_patterns" toml:"allowed_origin_patterns"` // regular expressions matching whole origins
+	AllowedMethods        []string `json:"allowed_methods" yaml:"allowed_methods" toml:"allowed_methods"`
+	AllowedHeaders        []string `json:"allowed_headers" yaml:"allowed_headers" toml:"allowed_headers"` // "*" allows any request header
+	ExposedHeaders        []string `json:"exposed_headers" yaml:"exposed_headers" toml:"exposed_headers"`
+	AllowCredentials      bool     `json:"allow_credentials" yaml:"allow_credentials" toml:"allow_credentials"`
+	MaxAge                Duration `json:"max_age" yaml:"max_age" toml:"max_age"` // preflight answers are cached this long, 0 leaves it to the browser
+}
+
+// ForwardAuthConfig asks an external service whether the requests of a
+// route are allowed: 2xx answers let them through, others are sent back to
+// the client.
+type ForwardAuthConfig struct {
+	URL             string   `json:"url" yaml:"url" toml:"url"` // empty to disable forward auth
+	Timeout         Duration `json:"timeout" yaml:"timeout" toml:"timeout"`
+	RequestHeaders  []string `json:"request_headers" yaml:"request_headers" toml:"request_headers"`    // sent to the service, empty for all
+	ResponseHeaders []string `json:"response_headers" yaml:"response_headers" toml:"response_headers"` // copied from allowing answers onto the request
+	CacheTTL        Duration `json:"cache_ttl" yaml:"cache_ttl" toml:"cache_ttl"`                      // 0 asks the service for every request
+	CacheKey        []string `json:"cache_key" yaml:"cache_key" toml:"cache_key"`                      // request headers answers depend on, besides method, host and URI; empty for every header sent and the client address
+}
+
+// RouteConfig applies per-route behaviour to the requests it matches. Routes
+// are tried in order and the first match wins; requests matching no route
+// are forwarded as they are.
+type RouteConfig struct {
+	Name     string          `json:"name" yaml:"name" toml:"name"`
+	Match    RouteMatch      `json:"match" yaml:"match" toml:"match"`
+	Fault    FaultConfig     `json:"fault" yaml:"fault" toml:"fault"`
+	Coalesce CoalesceConfig  `json:"coalesce" yaml:"coalesce" toml:"coalesce"`
+	Auth     RouteAuthConfig `json:"auth" yaml:"auth" toml:"auth"`
+
+	ForwardAuth ForwardAuthConfig `json:"forward_auth" yaml:"forward_auth" toml:"forward_auth"`
+	Access      RouteAccessConfig `json:"access" yaml:"access" toml:"access"`
+	Limits      RouteLimitsConfig `json:"limits" yaml:"limits" toml:"limits"`
+	WAF         RouteWAFConfig    `json:"waf" yaml:"waf" toml:"waf"`
+	CORS        CORSConfig        `json:"cors" yaml:"cors" toml:"cors"`
+}
+
+// RouteMatch selects requests by path prefix, host and method. Empty fields match everything.
+type RouteMatch struct {
+	PathPrefix string   `json:"path_prefix" yaml:"path_prefix" toml:"path_prefix"`
+	Host       string   `json:"host" yaml:"host" toml:"host"`
+	Methods    []string `json:"methods" yaml:"methods" toml:"methods"`
+}
+
+// FaultConfig injects faults into a share of a route's requests for chaos
+// testing. A fault can delay the request, then abort it or reset the connection.
+type FaultConfig struct {
+	Percentage float64  `json:"percentage" yaml:"percentage" toml:"percentage"` // share of requests in percent, 0 disables faults
+	Header     string   `json:"header" yaml:"header" toml:"header"`             // only requests carrying this header, empty for all
+	Delay      Duration `json:"delay" yaml:"delay" toml:"delay"`
+	DelayMax   Duration `json:"delay_max" yaml:"delay_max" toml:"delay_max"` // random delay between delay and delay_max when set
+	Abort      int      `json:"abort" yaml:"abort" toml:"abort"`             // status code answered instead of forwarding
+	Reset      bool     `json:"reset" yaml:"reset" toml:"reset"`             // close the connection without a response
+}
+
+// CoalesceConfig collapses identical concurrent GET and HEAD requests of a
+// route into one forwarded request whose response is shared.
+type CoalesceConfig struct {
+	Enabled     bool     `json:"enabled" yaml:"enabled" toml:"enabled"`
+	Key         []string `json:"key" yaml:"key" toml:"key"`                               // host, path, query, header:<name>, cookie:<name>; host, path and query by default
+	Timeout     Duration `json:"timeout" yaml:"timeout" toml:"timeout"`                   // waiting requests are forwarded on their own after this long
+	MaxBodySize int      `json:"max_body_size" yaml:"max_body_size" toml:"max_body_size"` // larger responses aren't shared
+}
+
+// Duration accepts either a Go duration string ("10s", "1m30s") or a number
+// of seconds.
+type Duration time.Duration
+
+func (d Duration) Std() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) set(v any) error {
+	switch v := v.(type) {
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			// Plain numbers are seconds, e.g. from GOLB_* variables or flags
+			secs, numErr := strconv.ParseFloat(v, 64)
+			if numErr != nil {
+				return err
+			}
+			parsed = time.Duration(secs * float64(time.Second))
+		}
+		*d = Duration(parsed)
+	case float64:
+		*d = Duration(v * float64(time.Second))
+	case int64:
+		*d = Duration(time.Duration(v) * time.Second)
+	case int:
+		*d = Duration(time.Duration(v) * time.Second)
+	default:
+		return fmt.Errorf("invalid duration %v", v)
+	}
+	return nil
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	return d.set(v)
+}
+
+func (d *Duration) UnmarshalYAML(n *yaml.Node) error {
+	if n.Tag == "!!int" || n.Tag == "!!float" {
+		f, err := strconv.ParseFloat(n.Value, 64)
+		if err != nil {
+			return err
+		}
+		return d.set(f)
+	}
+	return d.set(n.Value)
+}
+
+func (d *Duration) UnmarshalTOML(v any) error {
+	return d.set(v)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
@@ -0,0 +1,279 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix prefixes environment variables overriding config options, e.g.
+// GOLB_BALANCER_PORT overrides balancer.port.
+const EnvPrefix = "GOLB_"
+
+const fileRefPrefix = "file://"
+
+// expandEnv replaces ${VAR} and ${VAR:-default} references in a string
+// value of a config file. "$$" is a literal "$". Referencing an unset
+// variable without a default is an error.
+func expandEnv(s string, lookup func(string) (string, bool)) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '$' || i+1 >= len(s) {
+			out.WriteByte(c)
+			continue
+		}
+		switch s[i+1] {
+		case '$':
+			out.WriteByte('$')
+			i++
+			continue
+		case '{':
+		default:
+			out.WriteByte(c)
+			continue
+		}
+		end := strings.IndexByte(s[i+2:], '}')
+		if end < 0 {
+			return "", errors.New("unterminated ${ reference")
+		}
+		name, def, hasDef := strings.Cut(s[i+2:i+2+end], ":-")
+		if !validEnvName(name) {
+			return "", fmt.Errorf("invalid variable name %q", name)
+		}
+		if v, ok := lookup(name); ok && (v != "" || !hasDef) {
+			out.WriteString(v)
+		} else if hasDef {
+			out.WriteString(def)
+		} else {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		i += 2 + end
+	}
+	return out.String(), nil
+}
+
+// expandEnvValues expands the ${VAR} references of every string value
+// decoded from file into v. Values are expanded after decoding, so
+// references in comments are left alone and values may contain quotes or
+// newlines without breaking the file's syntax.
+func expandEnvValues(v reflect.Value, file string, positions map[string]int, lookup func(string) (string, bool)) error {
+	var errs Errors
+	walkStrings(v, "", reflect.StructField{}, func(path string, _ reflect.StructField, s string) string {
+		expanded, err := expandEnv(s, lookup)
+		if err != nil {
+			errs = append(errs, &Error{File: file, Line: lookupLine(positions, path), Path: path, Msg: err.Error()})
+			return s
+		}
+		return expanded
+	})
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// walkStrings calls fn with every string value reachable from v, inside
+// nested structs, slices and maps, and replaces it with fn's result. fn also
+// gets the key path of the value and the struct field holding it.
+func walkStrings(v reflect.Value, path string, field reflect.StructField, fn func(path string, field reflect.StructField, s string) string) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			walkStrings(v.Elem(), path, field, fn)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			walkStrings(v.Field(i), joinPath(path, strings.Split(f.Tag.Get("json"), ",")[0]), f, fn)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			walkStrings(v.Index(i), fmt.Sprintf("%s[%d]", path, i), field, fn)
+		}
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String {
+			return
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			p := joinPath(path, fmt.Sprint(iter.Key()))
+			v.SetMapIndex(iter.Key(), reflect.ValueOf(fn(p, field, iter.Value().String())).Convert(v.Type().Elem()))
+		}
+	case reflect.String:
+		if v.CanSet() {
+			if s := fn(path, field, v.String()); s != v.String() {
+				v.SetString(s)
+			}
+		}
+	}
+}
+
+func validEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if r == '_' || (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') || (i > 0 && r >= '0' && r <= '9') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// configOption is a single settable leaf of the config, addressed by its key path.
+type configOption struct {
+	path  string
+	value reflect.Value
+	field reflect.StructField
+}
+
+// options lists every scalar option and string list in the config. Lists of
+// tables (servers) can only be set in the config file.
+func (c *Config) options() []configOption {
+	var res []configOption
+	var walk func(v reflect.Value, path string)
+	walk = func(v reflect.Value, path string) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			p := joinPath(path, strings.Split(f.Tag.Get("json"), ",")[0])
+			fv := v.Field(i)
+			switch {
+			case f.Type == reflect.TypeOf(Duration(0)):
+				res = append(res, configOption{p, fv, f})
+			case fv.Kind() == reflect.Struct:
+				walk(fv, p)
+			case fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() != reflect.String:
+			default:
+				res = append(res, configOption{p, fv, f})
+			}
+		}
+	}
+	walk(reflect.ValueOf(c).Elem(), "")
+	return res
+}
+
+// envName maps a key path to its environment variable.
+func envName(path string) string {
+	return EnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(path))
+}
+
+// ApplyEnv overrides options with GOLB_* environment variables.
+func (c *Config) ApplyEnv(lookup func(string) (string, bool)) error {
+	var errs Errors
+	for _, opt := range c.options() {
+		name := envName(opt.path)
+		v, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		if err := c.set(opt, v); err != nil {
+			errs = append(errs, &Error{File: name, Path: opt.path, Msg: err.Error()})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Set overrides the option at path, e.g. Set("balancer.port", "7001").
+func (c *Config) Set(path, value string) error {
+	for _, opt := range c.options() {
+		if opt.path == path {
+			return c.set(opt, value)
+		}
+	}
+	return fmt.Errorf("unknown config option %q", path)
+}
+
+func (c *Config) set(opt configOption, value string) error {
+	v := opt.value
+	switch {
+	case v.Type() == reflect.TypeOf(Duration(0)):
+		var d Duration
+		if err := d.set(value); err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(d))
+	case v.Kind() == reflect.String:
+		v.SetString(value)
+	case v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("expected a number, got %q", value)
+		}
+		v.SetInt(int64(n))
+	case v.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("expected a number, got %q", value)
+		}
+		v.SetFloat(f)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %q", value)
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("option can't be overridden")
+	}
+	// An overridden servers file replaces the servers listed in the file
+	if opt.path == "servers_file" && value != "" {
+		c.Servers = nil
+	}
+	// Keep error positions for overridden values from pointing at the file
+	delete(c.positions, opt.path)
+	return nil
+}
+
+// ResolveFiles replaces file:// references in string options with the
+// referenced file's content, so secrets can live outside the config. Lists
+// of tables such as servers and routes are resolved too. Options naming a
+// file (tagged path:"true") only lose the prefix.
+func (c *Config) ResolveFiles() error {
+	var errs Errors
+	walkStrings(reflect.ValueOf(c).Elem(), "", reflect.StructField{}, func(path string, field reflect.StructField, s string) string {
+		if !strings.HasPrefix(s, fileRefPrefix) {
+			return s
+		}
+		name := strings.TrimPrefix(s, fileRefPrefix)
+		if field.Tag.Get("path") == "true" {
+			return name
+		}
+		content, err := os.ReadFile(name)
+		if err != nil {
+			errs = append(errs, &Error{File: c.file, Line: lookupLine(c.positions, path), Path: path, Msg: err.Error()})
+			return s
+		}
+		return strings.TrimRight(string(content), "\r\n")
+	})
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
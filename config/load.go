@@ -0,0 +1,574 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Error is a single problem found in a configuration file.
+type Error struct {
+	File string
+	Line int    // 0 when the position is unknown
+	Path string // key path, e.g. servers[1].weight
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	b.WriteString(e.File)
+	if e.Line > 0 {
+		fmt.Fprintf(&b, ":%d", e.Line)
+	}
+	b.WriteString(": ")
+	if e.Path != "" {
+		b.WriteString(e.Path + ": ")
+	}
+	b.WriteString(e.Msg)
+	return b.String()
+}
+
+// Errors collects every problem found while loading a file.
+type Errors []*Error
+
+func (errs Errors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Format picks the decoder from the file extension.
+func Format(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return "json", nil
+	case ".yaml", ".yml":
+		return "yaml", nil
+	case ".toml":
+		return "toml", nil
+	}
+	return "", fmt.Errorf("%s: unsupported config format, use .json, .yaml or .toml", path)
+}
+
+// Load reads the configuration at path, applies GOLB_* environment
+// variables, resolves file:// references and validates the result.
+func Load(path string) (*Config, error) {
+	return LoadWithOverrides(path, nil)
+}
+
+// LoadWithOverrides is Load with a final layer of overrides
+// keyed by option path (e.g. from command-line flags). Precedence is
+// defaults < config file < environment variables < overrides.
+func LoadWithOverrides(path string, overrides map[string]string) (*Config, error) {
+	cfg, err := Read(path)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, cfg.finish(overrides)
+}
+
+// finish layers environment variables and overrides on top of the file,
+// resolves file:// references and validates the result.
+func (c *Config) finish(overrides map[string]string) error {
+	if err := c.ApplyEnv(os.LookupEnv); err != nil {
+		return err
+	}
+	for path, value := range overrides {
+		if err := c.Set(path, value); err != nil {
+			return err
+		}
+	}
+	if err := c.ResolveFiles(); err != nil {
+		return err
+	}
+	return c.Validate()
+}
+
+// Default returns the configuration used when no config file exists,
+// still subject to environment variables and overrides.
+func Default(overrides map[string]string) (*Config, error) {
+	cfg := &Config{file: "<defaults>"}
+	cfg.ApplyDefaults()
+	return cfg, cfg.finish(overrides)
+}
+
+// Read reads and defaults the configuration at path without
+// validating it. ${VAR} and ${VAR:-default} references in string values
+// are expanded before defaults are applied.
+func Read(path string) (*Config, error) {
+	format, err := Format(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parse(data, format, path, os.LookupEnv)
+}
+
+// Parse decodes data in the given format ("json", "yaml" or "toml")
+// and applies defaults. Unknown keys are rejected and every error carries
+// the line it refers to.
+func Parse(data []byte, format, file string) (*Config, error) {
+	return parse(data, format, file, nil)
+}
+
+// parse is Parse expanding ${VAR} references with lookup, unless it is nil.
+func parse(data []byte, format, file string, lookup func(string) (string, bool)) (*Config, error) {
+	cfg := &Config{file: file}
+	positions, err := DecodeStrict(data, format, file, cfg)
+	if err != nil {
+		return nil, err
+	}
+	cfg.positions = positions
+	if lookup != nil {
+		if err := expandEnvValues(reflect.ValueOf(cfg), file, positions, lookup); err != nil {
+			return nil, err
+		}
+	}
+	cfg.ApplyDefaults()
+	return cfg, nil
+}
+
+// LoadServersFile reads a list of servers from a .json, .yaml or .toml
+// file. TOML files list servers as [[servers]] tables.
+func LoadServersFile(path string) ([]ServerConfig, error) {
+	servers, _, _, err := readServersFile(path)
+	return servers, err
+}
+
+// ValidateServersFile checks every server of a servers file for the given
+// balancer mode, like Validate does for servers listed in the config.
+func ValidateServersFile(path, mode string) error {
+	servers, positions, prefix, err := readServersFile(path)
+	if err != nil {
+		return err
+	}
+	var errs Errors
+	for i, s := range servers {
+		for _, e := range validateServer(s, mode) {
+			p := fmt.Sprintf("%s[%d].%s", prefix, i, e.field)
+			errs = append(errs, &Error{File: path, Line: lookupLine(positions, p), Path: p, Msg: e.msg})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// readServersFile is LoadServersFile also returning the line of every key
+// and the key path of the list of servers.
+func readServersFile(path string) ([]ServerConfig, map[string]int, string, error) {
+	format, err := Format(path)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if format == "toml" {
+		var wrapper struct {
+			Servers []ServerConfig `json:"servers" toml:"servers"`
+		}
+		positions, err := DecodeStrict(data, format, path, &wrapper)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		if err := expandEnvValues(reflect.ValueOf(&wrapper), path, positions, os.LookupEnv); err != nil {
+			return nil, nil, "", err
+		}
+		return wrapper.Servers, positions, "servers", nil
+	}
+	var servers []ServerConfig
+	positions, err := DecodeStrict(data, format, path, &servers)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if err := expandEnvValues(reflect.ValueOf(&servers), path, positions, os.LookupEnv); err != nil {
+		return nil, nil, "", err
+	}
+	return servers, positions, "", nil
+}
+
+// DecodeStrict indexes the line of every key, rejects keys that don't map
+// onto v and decodes data into v.
+func DecodeStrict(data []byte, format, file string, v any) (map[string]int, error) {
+	var positions map[string]int
+	var err error
+	switch format {
+	case "json":
+		positions, err = jsonPositions(data)
+	case "yaml":
+		positions, err = yamlPositions(data)
+	case "toml":
+		positions = tomlPositions(data)
+	default:
+		return nil, fmt.Errorf("%s: unknown config format %q", file, format)
+	}
+	if err != nil {
+		return nil, syntaxError(file, data, err)
+	}
+
+	var errs Errors
+	for _, path := range sortedPaths(positions) {
+		if !knownPath(reflect.TypeOf(v), path) {
+			errs = append(errs, &Error{File: file, Line: positions[path], Path: path, Msg: "unknown field"})
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	switch format {
+	case "json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(v)
+	case "yaml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(v)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	case "toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(data), v)
+		if err == nil {
+			for _, key := range md.Undecoded() {
+				path := key.String()
+				errs = append(errs, &Error{File: file, Line: lookupLine(positions, path), Path: path, Msg: "unknown field"})
+			}
+			if len(errs) > 0 {
+				return nil, errs
+			}
+		}
+	}
+	if err != nil {
+		return nil, decodeError(file, data, positions, err)
+	}
+	return positions, nil
+}
+
+// sortedPaths returns the indexed paths ordered by line.
+func sortedPaths(positions map[string]int) []string {
+	paths := make([]string, 0, len(positions))
+	for p := range positions {
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if positions[paths[i]] != positions[paths[j]] {
+			return positions[paths[i]] < positions[paths[j]]
+		}
+		return paths[i] < paths[j]
+	})
+	return paths
+}
+
+var pathSegment = regexp.MustCompile(`\[\d+\]|[^.\[\]]+`)
+
+// knownPath reports whether a key path such as servers[0].address exists in t.
+func knownPath(t reflect.Type, path string) bool {
+	for _, seg := range pathSegment.FindAllString(path, -1) {
+		for t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		if strings.HasPrefix(seg, "[") {
+			if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+				return false
+			}
+			t = t.Elem()
+			continue
+		}
+		switch t.Kind() {
+		case reflect.Map:
+			t = t.Elem()
+		case reflect.Struct:
+			field, ok := fieldByTag(t, seg)
+			if !ok {
+				return false
+			}
+			t = field.Type
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func fieldByTag(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if tag == name {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// lookupLine returns the line of path, falling back to its closest parent.
+func lookupLine(positions map[string]int, path string) int {
+	for path != "" {
+		if line, ok := positions[path]; ok {
+			return line
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return 0
+}
+
+func lineOf(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+func syntaxError(file string, data []byte, err error) error {
+	var se *json.SyntaxError
+	if errors.As(err, &se) {
+		return Errors{{File: file, Line: lineOf(data, se.Offset), Msg: se.Error()}}
+	}
+	var pe toml.ParseError
+	if errors.As(err, &pe) {
+		return Errors{{File: file, Line: pe.Position.Line, Msg: pe.Message}}
+	}
+	return Errors{{File: file, Msg: err.Error()}}
+}
+
+func decodeError(file string, data []byte, positions map[string]int, err error) error {
+	var te *json.UnmarshalTypeError
+	if errors.As(err, &te) {
+		return Errors{{File: file, Line: lineOf(data, te.Offset), Path: te.Field, Msg: fmt.Sprintf("expected %s, got %s", te.Type, te.Value)}}
+	}
+	return syntaxError(file, data, err)
+}
+
+// jsonPositions walks the token stream and records the line of every key
+// and array element.
+func jsonPositions(data []byte) (map[string]int, error) {
+	positions := make(map[string]int)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var walk func(path string) error
+	walk = func(path string) error {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'):
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				p := joinPath(path, key.(string))
+				positions[p] = lineOf(data, dec.InputOffset())
+				if err := walk(p); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+			return err
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				p := fmt.Sprintf("%s[%d]", path, i)
+				positions[p] = lineOf(data, dec.InputOffset()+1)
+				if err := walk(p); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+			return err
+		}
+		return nil
+	}
+	if err := walk(""); err != nil {
+		return nil, err
+	}
+	return positions, nil
+}
+
+func yamlPositions(data []byte) (map[string]int, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	positions := make(map[string]int)
+	var walk func(n *yaml.Node, path string)
+	walk = func(n *yaml.Node, path string) {
+		switch n.Kind {
+		case yaml.DocumentNode:
+			for _, c := range n.Content {
+				walk(c, path)
+			}
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				p := joinPath(path, n.Content[i].Value)
+				positions[p] = n.Content[i].Line
+				walk(n.Content[i+1], p)
+			}
+		case yaml.SequenceNode:
+			for i, c := range n.Content {
+				p := fmt.Sprintf("%s[%d]", path, i)
+				positions[p] = c.Line
+				walk(c, p)
+			}
+		}
+	}
+	walk(&doc, "")
+	return positions, nil
+}
+
+var (
+	tomlArrayTable = regexp.MustCompile(`^\[\[\s*([^\]]+?)\s*\]\]`)
+	tomlTable      = regexp.MustCompile(`^\[\s*([^\]]+?)\s*\]`)
+	tomlKey        = regexp.MustCompile(`^([A-Za-z0-9_.\-"' ]+?)\s*=`)
+)
+
+// tomlPositions indexes table headers and key assignments line by line.
+// Keys inside inline tables and multi-line values fall back to their
+// parent's line.
+func tomlPositions(data []byte) map[string]int {
+	positions := make(map[string]int)
+	arrays := make(map[string]int) // number of elements seen per array table
+	table := ""
+	var value tomlValue
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		if value.open() {
+			// Continuation lines of arrays and strings hold no keys
+			value.scan(scanner.Text())
+			continue
+		}
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if m := tomlArrayTable.FindStringSubmatch(text); m != nil {
+			name := resolveTomlTable(tomlKeyPath(m[1]), arrays)
+			positions[name] = line
+			table = fmt.Sprintf("%s[%d]", name, arrays[name])
+			arrays[name]++
+			positions[table] = line
+			continue
+		}
+		if m := tomlTable.FindStringSubmatch(text); m != nil {
+			table = resolveTomlTable(tomlKeyPath(m[1]), arrays)
+			positions[table] = line
+			continue
+		}
+		if m := tomlKey.FindStringSubmatchIndex(text); m != nil {
+			positions[joinPath(table, tomlKeyPath(text[m[2]:m[3]]))] = line
+			value.scan(text[m[1]:])
+		}
+	}
+	return positions
+}
+
+// tomlValue follows a value across lines, to tell when a multi-line array
+// or string ends.
+type tomlValue struct {
+	depth int    // open brackets of arrays
+	quote string // delimiter of an open multi-line string, """ or '''
+}
+
+func (v *tomlValue) open() bool {
+	return v.depth > 0 || v.quote != ""
+}
+
+// scan reads the value part of a line, or a continuation line.
+func (v *tomlValue) scan(s string) {
+	for i := 0; i < len(s); i++ {
+		if v.quote != "" {
+			switch {
+			case v.quote == `"""` && s[i] == '\\':
+				i++
+			case strings.HasPrefix(s[i:], v.quote):
+				// Up to two quotes may end the content right before the delimiter
+				for i += 3; i < len(s) && s[i] == v.quote[0]; i++ {
+				}
+				i--
+				v.quote = ""
+			}
+			continue
+		}
+		switch c := s[i]; {
+		case strings.HasPrefix(s[i:], `"""`), strings.HasPrefix(s[i:], "'''"):
+			v.quote = s[i : i+3]
+			i += 2
+		case c == '"':
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+		case c == '\'':
+			if j := strings.IndexByte(s[i+1:], '\''); j >= 0 {
+				i += j + 1
+			} else {
+				i = len(s)
+			}
+		case c == '[':
+			v.depth++
+		case c == ']' && v.depth > 0:
+			v.depth--
+		case c == '#':
+			return
+		}
+	}
+}
+
+// resolveTomlTable points a table name at the latest element of any array
+// table it is nested in, e.g. servers.tls after [[servers]] is servers[0].tls.
+func resolveTomlTable(name string, arrays map[string]int) string {
+	parts := strings.Split(name, ".")
+	res := ""
+	for _, part := range parts {
+		res = joinPath(res, part)
+		if n, ok := arrays[res]; ok && res != name {
+			res = fmt.Sprintf("%s[%d]", res, n-1)
+		}
+	}
+	return res
+}
+
+func tomlKeyPath(key string) string {
+	parts := strings.Split(key, ".")
+	for i, p := range parts {
+		parts[i] = strings.Trim(strings.TrimSpace(p), `"'`)
+	}
+	return strings.Join(parts, ".")
+}
+
+func joinPath(parent, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
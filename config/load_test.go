@@ -0,0 +1,47 @@
+package config_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/samsyntax/go-lb/config"
+)
+
+// Lines of multi-line arrays and strings holding "=" or brackets are values,
+// not keys or tables, and don't shift the lines reported for later keys.
+func TestTOMLMultiLineValues(t *testing.T) {
+	data := `[balancer]
+port = 7000
+
+[access]
+trusted_proxies = [
+  "10.0.0.0/8", # office = trusted
+  "192.168.0.1",
+  "proxy = 10.0.0.2",
+]
+
+[auth.jwt]
+secret = """
+issuer = example
+[not_a_table]
+"""
+
+[waf]
+challenge_secret = '''
+key = "value"'''
+
+[balancer.tls]
+certfile = "cert.pem"
+`
+	_, err := config.Parse([]byte(data), "toml", "lb.toml")
+	var errs config.Errors
+	if !errors.As(err, &errs) {
+		t.Fatalf("got %v, want the unknown certfile key", err)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("got %d errors, want 1: %v", len(errs), err)
+	}
+	if e := errs[0]; e.Path != "balancer.tls.certfile" || e.Line != 22 {
+		t.Errorf("got %s at line %d, want balancer.tls.certfile at line 22", e.Path, e.Line)
+	}
+}
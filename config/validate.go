@@ -0,0 +1,830 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/samsyntax/go-lb/coalesce"
+	"github.com/samsyntax/go-lb/compress"
+	"github.com/samsyntax/go-lb/cors"
+	"github.com/samsyntax/go-lb/ipfilter"
+	"github.com/samsyntax/go-lb/proxyproto"
+	"github.com/samsyntax/go-lb/waf"
+)
+
+// ApplyDefaults fills every unset option with its default value.
+func (c *Config) ApplyDefaults() {
+	if c.Version == 0 {
+		c.Version = SchemaVersion
+	}
+	if c.Environment == "" {
+		c.Environment = "local"
+	}
+	if c.Balancer.Port == 0 {
+		c.Balancer.Port = 7000
+	}
+	if c.Balancer.Method == "" {
+		c.Balancer.Method = "rr"
+	}
+	if c.Balancer.Mode == "" {
+		c.Balancer.Mode = "http"
+	}
+	if c.HealthCheck.Interval == 0 {
+		c.HealthCheck.Interval = Duration(20 * time.Second)
+	}
+	if c.Local.Amount == 0 {
+		c.Local.Amount = 5
+	}
+	if c.Local.Port == 0 {
+		c.Local.Port = 8000
+	}
+	for i := range c.Servers {
+		if c.Servers[i].Weight == 0 {
+			c.Servers[i].Weight = 1
+		}
+	}
+	if c.Discovery.Interval == 0 {
+		c.Discovery.Interval = Duration(30 * time.Second)
+	}
+	if c.Discovery.DNS.Record == "" {
+		c.Discovery.DNS.Record = RecordSRV
+	}
+	if c.Recording.SampleRate == 0 {
+		c.Recording.SampleRate = 1
+	}
+	if c.Recording.RedactHeaders == nil {
+		c.Recording.RedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+	}
+	if c.Recording.MaxBodySize == 0 {
+		c.Recording.MaxBodySize = 64 << 10
+	}
+	if c.Mirror.MaxBodySize == 0 {
+		c.Mirror.MaxBodySize = 1 << 20
+	}
+	if c.Mirror.Timeout == 0 {
+		c.Mirror.Timeout = Duration(10 * time.Second)
+	}
+	if c.Mirror.MaxInFlight == 0 {
+		c.Mirror.MaxInFlight = 100
+	}
+	if c.Cache.MaxSize == 0 {
+		c.Cache.MaxSize = 64 << 20
+	}
+	if c.Cache.MaxEntrySize == 0 {
+		c.Cache.MaxEntrySize = 1 << 20
+	}
+	if c.Cache.MaxDiskSize == 0 {
+		c.Cache.MaxDiskSize = 1 << 30
+	}
+	if c.Compression.Encodings == nil {
+		c.Compression.Encodings = []string{"zstd", "br", "gzip"}
+	}
+	if c.Compression.MinSize == 0 {
+		c.Compression.MinSize = 1024
+	}
+	if c.Compression.ContentTypes == nil {
+		c.Compression.ContentTypes = []string{"text/", "application/json", "application/javascript", "application/xml", "application/xhtml+xml", "application/wasm", "image/svg+xml"}
+	}
+	if c.Auth.APIKeys.Header == "" {
+		c.Auth.APIKeys.Header = "X-API-Key"
+	}
+	if c.Auth.Basic.Realm == "" {
+		c.Auth.Basic.Realm = "go-lb"
+	}
+	if c.Auth.JWT.JWKSRefresh == 0 {
+		c.Auth.JWT.JWKSRefresh = Duration(time.Hour)
+	}
+	if c.Limits.ReadHeaderTimeout == 0 {
+		c.Limits.ReadHeaderTimeout = Duration(10 * time.Second)
+	}
+	if c.Limits.IdleTimeout == 0 {
+		c.Limits.IdleTimeout = Duration(2 * time.Minute)
+	}
+	if c.Limits.MaxHeaderBytes == 0 {
+		c.Limits.MaxHeaderBytes = 1 << 20
+	}
+	if c.WAF.Mode == "" {
+		c.WAF.Mode = string(waf.ModeBlock)
+	}
+	if c.WAF.Threshold == 0 {
+		c.WAF.Threshold = 5
+	}
+	if c.WAF.MaxBodySize == 0 {
+		c.WAF.MaxBodySize = 64 << 10
+	}
+	if c.WAF.ChallengeTTL == 0 {
+		c.WAF.ChallengeTTL = Duration(time.Hour)
+	}
+	for i := range c.Routes {
+		co := &c.Routes[i].Coalesce
+		if co.Timeout == 0 {
+			co.Timeout = Duration(5 * time.Second)
+		}
+		if co.MaxBodySize == 0 {
+			co.MaxBodySize = 1 << 20
+		}
+		if cs := &c.Routes[i].CORS; len(cs.AllowedOrigins) > 0 || len(cs.AllowedOriginPatterns) > 0 {
+			if len(cs.AllowedMethods) == 0 {
+				cs.AllowedMethods = cors.DefaultMethods
+			}
+			if len(cs.AllowedHeaders) == 0 {
+				cs.AllowedHeaders = cors.DefaultHeaders
+			}
+		}
+		fa := &c.Routes[i].ForwardAuth
+		if fa.Timeout == 0 {
+			fa.Timeout = Duration(5 * time.Second)
+		}
+	}
+}
+
+// Validate checks the configuration as a whole, including rules spanning
+// several fields, and reports every problem found.
+func (c *Config) Validate() error {
+	var errs Errors
+	fail := func(path, format string, args ...any) {
+		errs = append(errs, &Error{File: c.file, Line: lookupLine(c.positions, path), Path: path, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	if c.Version != SchemaVersion {
+		fail("version", "unsupported version %d, this build understands version %d", c.Version, SchemaVersion)
+	}
+
+	b := c.Balancer
+	if b.Port < 1 || b.Port > 65535 {
+		fail("balancer.port", "must be between 1 and 65535, got %d", b.Port)
+	}
+	if b.Method != "rr" && b.Method != "wrr" {
+		fail("balancer.method", "must be 'rr' or 'wrr', got %q", b.Method)
+	}
+	switch b.Mode {
+	case "http", "grpc", "tcp":
+	default:
+		fail("balancer.mode", "must be 'http', 'grpc' or 'tcp', got %q", b.Mode)
+	}
+	if (b.TLS.CertFile == "") != (b.TLS.KeyFile == "") {
+		fail("balancer.tls", "cert_file and key_file must be set together")
+	}
+	if b.Mode == "tcp" && b.TLS.CertFile != "" {
+		fail("balancer.tls", "TLS termination is not available in tcp mode")
+	}
+	if b.ProxyProtocol.Enabled && len(b.ProxyProtocol.TrustedProxies) == 0 {
+		fail("balancer.proxy_protocol.trusted_proxies", "at least one trusted proxy is required when proxy_protocol is enabled")
+	}
+	for i, p := range b.ProxyProtocol.TrustedProxies {
+		if _, err := proxyproto.ParseTrustedProxies([]string{p}); err != nil {
+			fail(fmt.Sprintf("balancer.proxy_protocol.trusted_proxies[%d]", i), "%v", err)
+		}
+	}
+
+	if b.BackendHeader != "" && !validHeaderName(b.BackendHeader) {
+		fail("balancer.backend_header", "invalid header name %q", b.BackendHeader)
+	}
+
+	if c.HealthCheck.Interval <= 0 {
+		fail("health_check.interval", "must be positive")
+	}
+
+	switch c.Environment {
+	case "local":
+		if c.Local.Amount < 1 {
+			fail("local.amount", "must be at least 1, got %d", c.Local.Amount)
+		}
+		if c.Local.Port < 1 || c.Local.Port+c.Local.Amount-1 > 65535 {
+			fail("local.port", "ports %d-%d are out of range", c.Local.Port, c.Local.Port+c.Local.Amount-1)
+		}
+		if b.Port >= c.Local.Port && b.Port < c.Local.Port+c.Local.Amount {
+			fail("local.port", "local servers on ports %d-%d overlap balancer.port %d", c.Local.Port, c.Local.Port+c.Local.Amount-1, b.Port)
+		}
+		if len(c.Local.Servers) > c.Local.Amount {
+			fail("local.servers", "lists %d servers but local.amount is %d", len(c.Local.Servers), c.Local.Amount)
+		}
+		for i, s := range c.Local.Servers {
+			path := fmt.Sprintf("local.servers[%d]", i)
+			for _, e := range validateLocalServer(s) {
+				fail(path+"."+e.field, "%s", e.msg)
+			}
+		}
+	case "external":
+		if len(c.Servers) == 0 && c.ServersFile == "" {
+			fail("servers", "environment 'external' requires servers or servers_file")
+		}
+		if len(c.Servers) > 0 && c.ServersFile != "" {
+			fail("servers_file", "servers and servers_file can't be used together")
+		}
+	case "dns":
+		if c.Discovery.DNS.Name == "" {
+			fail("discovery.dns.name", "required for environment 'dns'")
+		}
+		switch c.Discovery.DNS.Record {
+		case RecordSRV:
+		case RecordA:
+			if c.Discovery.DNS.Port == 0 {
+				fail("discovery.dns.port", "required for A/AAAA lookups")
+			}
+		default:
+			fail("discovery.dns.record", "must be 'srv' or 'a', got %q", c.Discovery.DNS.Record)
+		}
+		if !ValidProtocol(c.Discovery.DNS.Protocol) {
+			fail("discovery.dns.protocol", "unknown protocol %q", c.Discovery.DNS.Protocol)
+		} else if c.Discovery.DNS.Protocol == ProtocolH2 && c.Discovery.DNS.Scheme != "https" {
+			fail("discovery.dns.protocol", "h2 requires scheme https, use h2c for cleartext HTTP/2")
+		}
+	case "directory":
+		if c.Discovery.Directory.Path == "" {
+			fail("discovery.directory.path", "required for environment 'directory'")
+		}
+	case "endpoint":
+		if u, err := url.Parse(c.Discovery.Endpoint.URL); err != nil || u.Host == "" {
+			fail("discovery.endpoint.url", "must be an absolute URL, got %q", c.Discovery.Endpoint.URL)
+		}
+	default:
+		fail("environment", "must be one of local, external, dns, directory, endpoint, got %q", c.Environment)
+	}
+	if c.Environment != "local" && c.Environment != "external" && c.Discovery.Interval <= 0 {
+		fail("discovery.interval", "must be positive")
+	}
+
+	if c.Admin.Address != "" {
+		if _, port, err := net.SplitHostPort(c.Admin.Address); err != nil || port == "" {
+			fail("admin.address", "must be host:port, got %q", c.Admin.Address)
+		} else if port == strconv.Itoa(b.Port) {
+			fail("admin.address", "must not use balancer.port %d", b.Port)
+		}
+	}
+
+	if r := c.Recording; r.File != "" {
+		if r.SampleRate < 0 || r.SampleRate > 1 {
+			fail("recording.sample_rate", "must be between 0 and 1, got %g", r.SampleRate)
+		}
+		if r.MaxBodySize < -1 {
+			fail("recording.max_body_size", "must be -1 (no bodies) or a size in bytes, got %d", r.MaxBodySize)
+		}
+		if b.Mode == "tcp" {
+			fail("recording.file", "requests can't be recorded in tcp mode")
+		}
+	}
+
+	if sp := c.Split; len(sp.Groups) > 0 {
+		groups := make(map[string]int)
+		total := 0
+		for i, g := range sp.Groups {
+			path := fmt.Sprintf("split.groups[%d]", i)
+			if g.Name == "" {
+				fail(path+".name", "required")
+			} else if j, ok := groups[g.Name]; ok {
+				fail(path+".name", "duplicate of split.groups[%d]", j)
+			}
+			groups[g.Name] = i
+			if g.Weight < 0 {
+				fail(path+".weight", "must not be negative, got %d", g.Weight)
+			}
+			total += g.Weight
+		}
+		if total == 0 {
+			fail("split.groups", "at least one group needs a positive weight")
+		}
+		if sp.Header != "" && !validHeaderName(sp.Header) {
+			fail("split.header", "invalid header name %q", sp.Header)
+		}
+		if sp.Cookie != "" && !validHeaderName(sp.Cookie) {
+			fail("split.cookie", "invalid cookie name %q", sp.Cookie)
+		}
+		if b.Mode == "tcp" && (sp.Header != "" || sp.Cookie != "") {
+			fail("split", "header and cookie overrides are not available in tcp mode")
+		}
+		for i, s := range c.Servers {
+			if _, ok := groups[s.Group]; !ok && s.Group != "" {
+				fail(fmt.Sprintf("servers[%d].group", i), "unknown group %q, not listed in split.groups", s.Group)
+			}
+		}
+		for i, s := range c.Local.Servers {
+			if _, ok := groups[s.Group]; !ok && s.Group != "" {
+				fail(fmt.Sprintf("local.servers[%d].group", i), "unknown group %q, not listed in split.groups", s.Group)
+			}
+		}
+	} else if sp.Header != "" || sp.Cookie != "" {
+		fail("split.groups", "required when split.header or split.cookie is set")
+	}
+
+	if m := c.Mirror; m.Percentage != 0 || len(m.Servers) > 0 {
+		if m.Percentage < 0 || m.Percentage > 100 {
+			fail("mirror.percentage", "must be between 0 and 100, got %g", m.Percentage)
+		}
+		if len(m.Servers) == 0 && m.Percentage > 0 {
+			fail("mirror.servers", "at least one shadow server is required when mirroring")
+		}
+		if m.MaxBodySize < 0 {
+			fail("mirror.max_body_size", "must not be negative, got %d", m.MaxBodySize)
+		}
+		if m.Timeout <= 0 {
+			fail("mirror.timeout", "must be positive")
+		}
+		if m.MaxInFlight < 1 {
+			fail("mirror.max_in_flight", "must be at least 1, got %d", m.MaxInFlight)
+		}
+		if b.Mode == "tcp" {
+			fail("mirror", "requests can't be mirrored in tcp mode")
+		}
+		for i, s := range m.Servers {
+			for _, e := range validateServer(s, b.Mode) {
+				fail(fmt.Sprintf("mirror.servers[%d].%s", i, e.field), "%s", e.msg)
+			}
+		}
+	}
+
+	if ca := c.Cache; ca.Enabled {
+		if ca.MaxSize < 1 {
+			fail("cache.max_size", "must be positive, got %d", ca.MaxSize)
+		}
+		if ca.MaxEntrySize < 1 || ca.MaxEntrySize > ca.MaxSize {
+			fail("cache.max_entry_size", "must be between 1 and cache.max_size, got %d", ca.MaxEntrySize)
+		}
+		if ca.Dir != "" && ca.MaxDiskSize < ca.MaxEntrySize {
+			fail("cache.max_disk_size", "must be at least cache.max_entry_size, got %d", ca.MaxDiskSize)
+		}
+		if ca.StaleIfError < 0 {
+			fail("cache.stale_if_error", "must not be negative")
+		}
+		if b.Mode != "http" {
+			fail("cache", "responses can only be cached in http mode")
+		}
+	}
+
+	if cp := c.Compression; cp.Enabled {
+		if len(cp.Encodings) == 0 {
+			fail("compression.encodings", "at least one encoding is required")
+		}
+		for i, enc := range cp.Encodings {
+			if !compress.Supported(enc) {
+				fail(fmt.Sprintf("compression.encodings[%d]", i), "must be zstd, br or gzip, got %q", enc)
+			}
+		}
+		if cp.MinSize < 0 {
+			fail("compression.min_size", "must not be negative, got %d", cp.MinSize)
+		}
+		for i, t := range cp.ContentTypes {
+			if !strings.Contains(t, "/") {
+				fail(fmt.Sprintf("compression.content_types[%d]", i), "must be a media type such as application/json or a prefix such as text/, got %q", t)
+			}
+		}
+		if b.Mode == "tcp" {
+			fail("compression", "responses can't be compressed in tcp mode")
+		}
+	}
+
+	au := c.Auth
+	if !validHeaderName(au.APIKeys.Header) {
+		fail("auth.api_keys.header", "invalid header name %q", au.APIKeys.Header)
+	}
+	if j := au.JWT; j.Secret != "" || j.JWKSFile != "" || j.JWKSURL != "" {
+		if j.JWKSFile != "" && j.JWKSURL != "" {
+			fail("auth.jwt.jwks_url", "can't be combined with auth.jwt.jwks_file")
+		}
+		if u, err := url.Parse(j.JWKSURL); j.JWKSURL != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+			fail("auth.jwt.jwks_url", "must be an http or https URL, got %q", j.JWKSURL)
+		}
+		if j.JWKSRefresh <= 0 {
+			fail("auth.jwt.jwks_refresh", "must be positive")
+		}
+		if j.Leeway < 0 {
+			fail("auth.jwt.leeway", "must not be negative")
+		}
+		for i, alg := range j.Algorithms {
+			switch {
+			case !slices.Contains(jwtAlgorithms, alg):
+				fail(fmt.Sprintf("auth.jwt.algorithms[%d]", i), "must be one of %s, got %q", strings.Join(jwtAlgorithms, ", "), alg)
+			case strings.HasPrefix(alg, "HS") && j.Secret == "":
+				fail(fmt.Sprintf("auth.jwt.algorithms[%d]", i), "%s requires auth.jwt.secret", alg)
+			case !strings.HasPrefix(alg, "HS") && j.JWKSFile == "" && j.JWKSURL == "":
+				fail(fmt.Sprintf("auth.jwt.algorithms[%d]", i), "%s requires auth.jwt.jwks_file or auth.jwt.jwks_url", alg)
+			}
+		}
+	} else if j.Issuer != "" || len(j.Audience) > 0 || len(j.Algorithms) > 0 {
+		fail("auth.jwt", "a secret, jwks_file or jwks_url is required")
+	}
+	configured := map[string]bool{
+		"api_key": au.APIKeys.File != "",
+		"basic":   au.Basic.File != "",
+		"jwt":     au.JWT.Secret != "" || au.JWT.JWKSFile != "" || au.JWT.JWKSURL != "",
+	}
+
+	ac := c.Access
+	for i, p := range ac.TrustedProxies {
+		if _, err := ipfilter.ParsePrefix(p); err != nil {
+			fail(fmt.Sprintf("access.trusted_proxies[%d]", i), "must be an IP or CIDR range, got %q", p)
+		}
+	}
+	if len(ac.TrustedProxies) > 0 && b.Mode == "tcp" {
+		fail("access.trusted_proxies", "X-Forwarded-For isn't read in tcp mode, use PROXY protocol instead")
+	}
+	for _, e := range validateAccess(RouteAccessConfig{
+		Allow: ac.Allow, Deny: ac.Deny, AllowFile: ac.AllowFile, DenyFile: ac.DenyFile,
+		AllowCountries: ac.AllowCountries, DenyCountries: ac.DenyCountries,
+	}, ac.GeoIPDB != "") {
+		fail("access."+e.field, "%s", e.msg)
+	}
+
+	lc := c.Limits
+	if lc.ReadHeaderTimeout < 0 {
+		fail("limits.read_header_timeout", "must not be negative")
+	}
+	if lc.IdleTimeout < 0 {
+		fail("limits.idle_timeout", "must not be negative")
+	}
+	if lc.MaxHeaderBytes < 0 {
+		fail("limits.max_header_bytes", "must not be negative, got %d", lc.MaxHeaderBytes)
+	}
+	for _, e := range validateLimits(RouteLimitsConfig{
+		ReadTimeout: lc.ReadTimeout, WriteTimeout: lc.WriteTimeout, MaxBodySize: lc.MaxBodySize,
+		UpstreamTimeout: lc.UpstreamTimeout, UpstreamHeaderTimeout: lc.UpstreamHeaderTimeout,
+	}) {
+		fail("limits."+e.field, "%s", e.msg)
+	}
+
+	for _, e := range validateTransport(c.Transport) {
+		fail("transport."+e.field, "%s", e.msg)
+	}
+
+	wc := c.WAF
+	if wc.Enabled {
+		if !waf.ValidMode(wc.Mode) {
+			fail("waf.mode", "must be block, log, challenge or off, got %q", wc.Mode)
+		}
+		if wc.Threshold < 0 {
+			fail("waf.threshold", "must be positive, got %d", wc.Threshold)
+		}
+		if wc.MaxBodySize < -1 {
+			fail("waf.max_body_size", "must be -1 or more, got %d", wc.MaxBodySize)
+		}
+		if wc.ChallengeTTL < 0 {
+			fail("waf.challenge_ttl", "must not be negative")
+		}
+		if b.Mode == "tcp" {
+			fail("waf", "requests can't be inspected in tcp mode")
+		}
+	}
+
+	names := make(map[string]int)
+	for i, r := range c.Routes {
+		path := fmt.Sprintf("routes[%d]", i)
+		for _, e := range validateRoute(r) {
+			fail(path+"."+e.field, "%s", e.msg)
+		}
+		if j, ok := names[r.Name]; ok && r.Name != "" {
+			fail(path+".name", "duplicate of routes[%d]", j)
+		}
+		names[r.Name] = i
+		if b.Mode == "tcp" {
+			fail(path, "routes are not available in tcp mode")
+		}
+		for j, m := range r.Auth.Methods {
+			section, known := authSections[m]
+			switch {
+			case !known:
+				fail(fmt.Sprintf("%s.auth.methods[%d]", path, j), "must be api_key, basic or jwt, got %q", m)
+			case !configured[m]:
+				fail(fmt.Sprintf("%s.auth.methods[%d]", path, j), "%s is not configured in auth.%s", m, section)
+			}
+		}
+		if len(r.Auth.Methods) == 0 && (len(r.Auth.Subjects) > 0 || len(r.Auth.Claims) > 0 || len(r.Auth.Headers) > 0) {
+			fail(path+".auth.methods", "required when subjects, claims or headers are set")
+		}
+		for _, e := range validateAccess(r.Access, ac.GeoIPDB != "") {
+			fail(path+".access."+e.field, "%s", e.msg)
+		}
+		for _, e := range validateLimits(r.Limits) {
+			fail(path+".limits."+e.field, "%s", e.msg)
+		}
+		for _, e := range validateCORS(r.CORS) {
+			fail(path+".cors."+e.field, "%s", e.msg)
+		}
+		if rw := r.WAF; rw.Mode != "" || len(rw.DisabledRules) > 0 {
+			if !wc.Enabled {
+				fail(path+".waf", "requires waf.enabled")
+			} else if rw.Mode != "" && !waf.ValidMode(rw.Mode) {
+				fail(path+".waf.mode", "must be block, log, challenge or off, got %q", rw.Mode)
+			}
+		}
+		for claim, header := range r.Auth.Headers {
+			if !validHeaderName(header) {
+				fail(fmt.Sprintf("%s.auth.headers.%s", path, claim), "invalid header name %q", header)
+			}
+		}
+	}
+
+	seen := make(map[string]int)
+	for i, s := range c.Servers {
+		path := fmt.Sprintf("servers[%d]", i)
+		for _, e := range validateServer(s, b.Mode) {
+			fail(path+"."+e.field, "%s", e.msg)
+		}
+		if j, ok := seen[s.Address]; ok && s.Address != "" {
+			fail(path+".address", "duplicate of servers[%d]", j)
+		}
+		seen[s.Address] = i
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+type fieldError struct {
+	field string
+	msg   string
+}
+
+// validateServer checks a single server entry for the given balancer mode.
+func validateServer(s ServerConfig, mode string) []fieldError {
+	var errs []fieldError
+	var scheme string
+	if s.Address == "" {
+		errs = append(errs, fieldError{"address", "required"})
+	} else if u, err := url.Parse(s.Address); err != nil || u.Host == "" {
+		errs = append(errs, fieldError{"address", fmt.Sprintf("must be an absolute URL such as http://host:port, got %q", s.Address)})
+	} else {
+		scheme = u.Scheme
+	}
+	if s.Weight < 0 {
+		errs = append(errs, fieldError{"weight", fmt.Sprintf("must not be negative, got %d", s.Weight)})
+	}
+	if !ValidProtocol(s.Protocol) {
+		errs = append(errs, fieldError{"protocol", fmt.Sprintf("must be 'http1', 'h2' or 'h2c', got %q", s.Protocol)})
+	} else if s.Protocol == ProtocolH2 && scheme == "http" {
+		// h2 only speaks HTTP/2 over TLS, an http:// server would fail every request
+		errs = append(errs, fieldError{"protocol", "h2 requires an https:// address, use h2c for cleartext HTTP/2"})
+	}
+	if !proxyproto.ValidVersion(s.SendProxyProtocol) {
+		errs = append(errs, fieldError{"send_proxy_protocol", fmt.Sprintf("must be 'v1' or 'v2', got %q", s.SendProxyProtocol)})
+	} else if s.SendProxyProtocol != "" && mode != "tcp" {
+		errs = append(errs, fieldError{"send_proxy_protocol", "only supported in tcp mode"})
+	}
+	for _, e := range validateTransport(s.Transport) {
+		errs = append(errs, fieldError{"transport." + e.field, e.msg})
+	}
+	return errs
+}
+
+// validateTransport checks transport settings, global or of a server.
+func validateTransport(t TransportConfig) []fieldError {
+	var errs []fieldError
+	if t.MaxIdleConns < -1 {
+		errs = append(errs, fieldError{"max_idle_conns", fmt.Sprintf("must be -1 or more, got %d", t.MaxIdleConns)})
+	}
+	if t.MaxConns < 0 {
+		errs = append(errs, fieldError{"max_conns", fmt.Sprintf("must not be negative, got %d", t.MaxConns)})
+	}
+	if t.IdleTimeout < 0 {
+		errs = append(errs, fieldError{"idle_timeout", "must not be negative"})
+	}
+	if t.DialTimeout < 0 {
+		errs = append(errs, fieldError{"dial_timeout", "must not be negative"})
+	}
+	switch {
+	case t.Prewarm < 0:
+		errs = append(errs, fieldError{"prewarm", fmt.Sprintf("must not be negative, got %d", t.Prewarm)})
+	case t.Prewarm > 0 && t.MaxIdleConns == -1:
+		errs = append(errs, fieldError{"prewarm", "connections can't be kept open with max_idle_conns -1"})
+	case t.MaxIdleConns > 0 && t.Prewarm > t.MaxIdleConns:
+		errs = append(errs, fieldError{"prewarm", fmt.Sprintf("must not exceed max_idle_conns (%d)", t.MaxIdleConns)})
+	case t.MaxConns > 0 && t.Prewarm > t.MaxConns:
+		errs = append(errs, fieldError{"prewarm", fmt.Sprintf("must not exceed max_conns (%d)", t.MaxConns)})
+	}
+	return errs
+}
+
+// Validate checks a single server entry on its own, e.g. one returned by a
+// discovery provider.
+func (s ServerConfig) Validate() error {
+	if errs := validateServer(s, ""); len(errs) > 0 {
+		return fmt.Errorf("%s: %s", errs[0].field, errs[0].msg)
+	}
+	return nil
+}
+
+func validateLocalServer(s LocalServerConfig) []fieldError {
+	var errs []fieldError
+	if s.Weight < 0 {
+		errs = append(errs, fieldError{"weight", fmt.Sprintf("must not be negative, got %d", s.Weight)})
+	}
+	if s.ErrorRate < 0 || s.ErrorRate > 1 {
+		errs = append(errs, fieldError{"error_rate", fmt.Sprintf("must be between 0 and 1, got %g", s.ErrorRate)})
+	}
+	if s.DropRate < 0 || s.DropRate > 1 {
+		errs = append(errs, fieldError{"drop_rate", fmt.Sprintf("must be between 0 and 1, got %g", s.DropRate)})
+	}
+	if s.HealthLatency < 0 {
+		errs = append(errs, fieldError{"health_latency", "must not be negative"})
+	}
+	l := s.Latency
+	if l.Mean < 0 || l.Stddev < 0 || l.Min < 0 || l.Max < 0 {
+		errs = append(errs, fieldError{"latency", "durations must not be negative"})
+	}
+	switch l.Distribution {
+	case "", "fixed", "normal", "exponential":
+	case "uniform":
+		if l.Max < l.Min {
+			errs = append(errs, fieldError{"latency.max", "must not be below latency.min"})
+		}
+	default:
+		errs = append(errs, fieldError{"latency.distribution", fmt.Sprintf("must be 'fixed', 'uniform', 'normal' or 'exponential', got %q", l.Distribution)})
+	}
+	return errs
+}
+
+func validateRoute(r RouteConfig) []fieldError {
+	var errs []fieldError
+	if r.Match.PathPrefix != "" && !strings.HasPrefix(r.Match.PathPrefix, "/") {
+		errs = append(errs, fieldError{"match.path_prefix", fmt.Sprintf("must start with /, got %q", r.Match.PathPrefix)})
+	}
+	for i, m := range r.Match.Methods {
+		if !validHeaderName(m) {
+			errs = append(errs, fieldError{fmt.Sprintf("match.methods[%d]", i), fmt.Sprintf("invalid method %q", m)})
+		}
+	}
+	f := r.Fault
+	if f.Percentage < 0 || f.Percentage > 100 {
+		errs = append(errs, fieldError{"fault.percentage", fmt.Sprintf("must be between 0 and 100, got %g", f.Percentage)})
+	}
+	if f.Header != "" && !validHeaderName(f.Header) {
+		errs = append(errs, fieldError{"fault.header", fmt.Sprintf("invalid header name %q", f.Header)})
+	}
+	if f.Delay < 0 {
+		errs = append(errs, fieldError{"fault.delay", "must not be negative"})
+	}
+	if f.DelayMax != 0 && f.DelayMax < f.Delay {
+		errs = append(errs, fieldError{"fault.delay_max", "must not be below fault.delay"})
+	}
+	if f.Abort != 0 && (f.Abort < 200 || f.Abort > 599) {
+		errs = append(errs, fieldError{"fault.abort", fmt.Sprintf("must be a status code between 200 and 599, got %d", f.Abort)})
+	}
+	if f.Abort != 0 && f.Reset {
+		errs = append(errs, fieldError{"fault.reset", "can't be combined with fault.abort"})
+	}
+	if f.Percentage > 0 && f.Delay == 0 && f.Abort == 0 && !f.Reset {
+		errs = append(errs, fieldError{"fault", "percentage is set but no delay, abort or reset is configured"})
+	}
+	if co := r.Coalesce; co.Enabled {
+		for i, part := range co.Key {
+			if !coalesce.ValidKeyPart(part) {
+				errs = append(errs, fieldError{fmt.Sprintf("coalesce.key[%d]", i), fmt.Sprintf("must be host, path, query, header:<name> or cookie:<name>, got %q", part)})
+			}
+		}
+		if co.Timeout <= 0 {
+			errs = append(errs, fieldError{"coalesce.timeout", "must be positive"})
+		}
+		if co.MaxBodySize < 1 {
+			errs = append(errs, fieldError{"coalesce.max_body_size", fmt.Sprintf("must be positive, got %d", co.MaxBodySize)})
+		}
+	}
+	if fa := r.ForwardAuth; fa.URL != "" {
+		if u, err := url.Parse(fa.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fieldError{"forward_auth.url", fmt.Sprintf("must be an http or https URL, got %q", fa.URL)})
+		}
+		if fa.Timeout <= 0 {
+			errs = append(errs, fieldError{"forward_auth.timeout", "must be positive"})
+		}
+		if fa.CacheTTL < 0 {
+			errs = append(errs, fieldError{"forward_auth.cache_ttl", "must not be negative"})
+		}
+		headers := []struct {
+			field string
+			names []string
+		}{{"request_headers", fa.RequestHeaders}, {"response_headers", fa.ResponseHeaders}, {"cache_key", fa.CacheKey}}
+		for _, h := range headers {
+			for i, name := range h.names {
+				if !validHeaderName(name) {
+					errs = append(errs, fieldError{fmt.Sprintf("forward_auth.%s[%d]", h.field, i), fmt.Sprintf("invalid header name %q", name)})
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// validateAccess checks IP access rules. Country rules need a GeoIP database.
+func validateAccess(a RouteAccessConfig, geoIP bool) []fieldError {
+	var errs []fieldError
+	lists := []struct {
+		field string
+		list  []string
+	}{{"allow", a.Allow}, {"deny", a.Deny}}
+	for _, l := range lists {
+		for i, s := range l.list {
+			if _, err := ipfilter.ParsePrefix(s); err != nil {
+				errs = append(errs, fieldError{fmt.Sprintf("%s[%d]", l.field, i), fmt.Sprintf("must be an IP or CIDR range, got %q", s)})
+			}
+		}
+	}
+	countries := []struct {
+		field string
+		list  []string
+	}{{"allow_countries", a.AllowCountries}, {"deny_countries", a.DenyCountries}}
+	for _, l := range countries {
+		for i, code := range l.list {
+			if len(code) != 2 || strings.IndexFunc(strings.ToUpper(code), func(r rune) bool { return r < 'A' || r > 'Z' }) >= 0 {
+				errs = append(errs, fieldError{fmt.Sprintf("%s[%d]", l.field, i), fmt.Sprintf("must be a two-letter country code, got %q", code)})
+			}
+		}
+		if len(l.list) > 0 && !geoIP {
+			errs = append(errs, fieldError{l.field, "requires access.geoip_db"})
+		}
+	}
+	return errs
+}
+
+// validateLimits checks request limits that can be set globally and per route.
+func validateLimits(l RouteLimitsConfig) []fieldError {
+	var errs []fieldError
+	durations := []struct {
+		field string
+		d     Duration
+	}{
+		{"read_timeout", l.ReadTimeout},
+		{"write_timeout", l.WriteTimeout},
+		{"upstream_timeout", l.UpstreamTimeout},
+		{"upstream_header_timeout", l.UpstreamHeaderTimeout},
+	}
+	for _, d := range durations {
+		if d.d < 0 {
+			errs = append(errs, fieldError{d.field, "must not be negative"})
+		}
+	}
+	if l.MaxBodySize < 0 {
+		errs = append(errs, fieldError{"max_body_size", fmt.Sprintf("must not be negative, got %d", l.MaxBodySize)})
+	}
+	if l.UpstreamTimeout > 0 && l.UpstreamHeaderTimeout > l.UpstreamTimeout {
+		errs = append(errs, fieldError{"upstream_header_timeout", "must not exceed upstream_timeout"})
+	}
+	return errs
+}
+
+// validateCORS checks the CORS settings of a route.
+func validateCORS(c CORSConfig) []fieldError {
+	var errs []fieldError
+	if len(c.AllowedOrigins) == 0 && len(c.AllowedOriginPatterns) == 0 {
+		if len(c.AllowedMethods) > 0 || len(c.AllowedHeaders) > 0 || len(c.ExposedHeaders) > 0 || c.AllowCredentials || c.MaxAge != 0 {
+			errs = append(errs, fieldError{"allowed_origins", "required when other cors options are set"})
+		}
+		return errs
+	}
+	for i, o := range c.AllowedOrigins {
+		if o == "*" {
+			if c.AllowCredentials {
+				errs = append(errs, fieldError{fmt.Sprintf("allowed_origins[%d]", i), "credentials can't be allowed for any origin, list the origins instead"})
+			}
+			continue
+		}
+		if err := cors.ValidOrigin(o); err != nil {
+			errs = append(errs, fieldError{fmt.Sprintf("allowed_origins[%d]", i), err.Error()})
+		}
+	}
+	for i, p := range c.AllowedOriginPatterns {
+		if _, err := regexp.Compile(p); err != nil {
+			errs = append(errs, fieldError{fmt.Sprintf("allowed_origin_patterns[%d]", i), fmt.Sprintf("invalid regular expression: %v", err)})
+		}
+	}
+	for i, m := range c.AllowedMethods {
+		if m != "*" && !validHeaderName(m) {
+			errs = append(errs, fieldError{fmt.Sprintf("allowed_methods[%d]", i), fmt.Sprintf("invalid method %q", m)})
+		}
+	}
+	for i, h := range c.AllowedHeaders {
+		if h != "*" && !validHeaderName(h) {
+			errs = append(errs, fieldError{fmt.Sprintf("allowed_headers[%d]", i), fmt.Sprintf("invalid header name %q", h)})
+		}
+	}
+	for i, h := range c.ExposedHeaders {
+		if !validHeaderName(h) {
+			errs = append(errs, fieldError{fmt.Sprintf("exposed_headers[%d]", i), fmt.Sprintf("invalid header name %q", h)})
+		}
+	}
+	if c.MaxAge < 0 {
+		errs = append(errs, fieldError{"max_age", "must not be negative"})
+	}
+	return errs
+}
+
+// authSections are the auth sections configuring each authentication method.
+var authSections = map[string]string{"api_key": "api_keys", "basic": "basic", "jwt": "jwt"}
+
+// jwtAlgorithms are the supported JWT signing algorithms.
+var jwtAlgorithms = []string{"HS256", "HS384", "HS512", "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// validHeaderName reports whether name is a valid HTTP header field name.
+func validHeaderName(name string) bool {
+	for _, c := range name {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return name != ""
+}
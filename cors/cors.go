@@ -0,0 +1,306 @@
+// Package cors lets the balancer own Cross-Origin Resource Sharing for the
+// servers behind it: preflight requests are answered without reaching the
+// servers, and the CORS headers of responses are replaced by the configured
+// ones, so servers implementing CORS inconsistently can't contradict them.
+package cors
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultMethods are the methods allowed when Options.AllowedMethods is empty.
+var DefaultMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+
+// DefaultHeaders are the request headers allowed when Options.AllowedHeaders is empty.
+var DefaultHeaders = []string{"Accept", "Content-Type", "X-Requested-With"}
+
+// Options configures a CORS policy.
+type Options struct {
+	AllowedOrigins        []string      // exact origins, wildcard subdomains such as https://*.example.com, or "*" for any
+	AllowedOriginPatterns []string      // regular expressions matching whole origins
+	AllowedMethods        []string      // DefaultMethods when empty, "*" for any
+	AllowedHeaders        []string      // request headers; DefaultHeaders when empty, "*" for any
+	ExposedHeaders        []string      // response headers scripts can read besides the safelisted ones
+	AllowCredentials      bool          // let requests carry cookies and credentials
+	MaxAge                time.Duration // how long browsers cache preflight answers, 0 leaves it to the browser
+}
+
+// CORS applies a CORS policy.
+type CORS struct {
+	anyOrigin   bool
+	origins     []string // lowercased exact origins
+	wildcards   [][2]string
+	patterns    []*regexp.Regexp
+	methods     []string
+	anyMethod   bool
+	headers     []string // lowercased
+	anyHeader   bool
+	exposed     string
+	credentials bool
+	maxAge      string
+}
+
+// New creates a CORS policy.
+func New(opts Options) (*CORS, error) {
+	if len(opts.AllowedOrigins) == 0 && len(opts.AllowedOriginPatterns) == 0 {
+		return nil, errors.New("no allowed origins")
+	}
+	c := &CORS{credentials: opts.AllowCredentials}
+	for _, o := range opts.AllowedOrigins {
+		if o == "*" {
+			c.anyOrigin = true
+			continue
+		}
+		if err := ValidOrigin(o); err != nil {
+			return nil, err
+		}
+		o = strings.ToLower(o)
+		if prefix, suffix, ok := strings.Cut(o, "*"); ok {
+			c.wildcards = append(c.wildcards, [2]string{prefix, suffix})
+			continue
+		}
+		c.origins = append(c.origins, o)
+	}
+	if c.anyOrigin && c.credentials {
+		return nil, errors.New("credentials can't be allowed for any origin")
+	}
+	for _, p := range opts.AllowedOriginPatterns {
+		re, err := regexp.Compile("^(?:" + p + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("origin pattern: %w", err)
+		}
+		c.patterns = append(c.patterns, re)
+	}
+
+	methods := opts.AllowedMethods
+	if len(methods) == 0 {
+		methods = DefaultMethods
+	}
+	for _, m := range methods {
+		if m == "*" {
+			c.anyMethod = true
+			continue
+		}
+		c.methods = append(c.methods, strings.ToUpper(m))
+	}
+	headers := opts.AllowedHeaders
+	if len(headers) == 0 {
+		headers = DefaultHeaders
+	}
+	for _, h := range headers {
+		if h == "*" {
+			c.anyHeader = true
+			continue
+		}
+		c.headers = append(c.headers, strings.ToLower(h))
+	}
+	c.exposed = strings.Join(opts.ExposedHeaders, ", ")
+	if opts.MaxAge > 0 {
+		c.maxAge = strconv.Itoa(int(opts.MaxAge.Seconds()))
+	}
+	return c, nil
+}
+
+// ValidOrigin checks that origin is a scheme and host, with an optional
+// port, and at most a leading "*." wildcard on the host.
+func ValidOrigin(origin string) error {
+	host := origin
+	if i := strings.Index(origin, "://"); i >= 0 {
+		host = origin[i+3:]
+	}
+	if strings.Contains(host, "*") {
+		if !strings.HasPrefix(host, "*.") || strings.Count(origin, "*") > 1 {
+			return fmt.Errorf("origin %q: only a leading *. is allowed on the host, e.g. https://*.example.com", origin)
+		}
+		origin = strings.Replace(origin, "*.", "x.", 1)
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+		return fmt.Errorf("origin %q: must be a scheme and host such as https://example.com", origin)
+	}
+	return nil
+}
+
+// IsPreflight reports whether r is a CORS preflight request.
+func IsPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// allowedOrigin reports whether requests from origin are allowed.
+func (c *CORS) allowedOrigin(origin string) bool {
+	if c.anyOrigin {
+		return true
+	}
+	o := strings.ToLower(origin)
+	if slices.Contains(c.origins, o) {
+		return true
+	}
+	for _, w := range c.wildcards {
+		if len(o) > len(w[0])+len(w[1]) && strings.HasPrefix(o, w[0]) && strings.HasSuffix(o, w[1]) &&
+			!strings.ContainsAny(o[len(w[0]):len(o)-len(w[1])], "/:@") {
+			return true
+		}
+	}
+	for _, re := range c.patterns {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Serve answers preflight requests and passes other requests to next,
+// replacing the CORS headers of their responses.
+func (c *CORS) Serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	if IsPreflight(r) {
+		c.preflight(w, r)
+		return
+	}
+	next.ServeHTTP(&responseWriter{ResponseWriter: w, c: c, origin: r.Header.Get("Origin")}, r)
+}
+
+func (c *CORS) preflight(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	addVary(h, "Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers")
+	origin := r.Header.Get("Origin")
+	method := r.Header.Get("Access-Control-Request-Method")
+	requested := r.Header.Get("Access-Control-Request-Headers")
+
+	reason := ""
+	switch {
+	case !c.allowedOrigin(origin):
+		reason = "origin not allowed"
+	case !c.anyMethod && !slices.Contains(c.methods, method):
+		reason = "method not allowed"
+	case !c.allowedHeaders(requested):
+		reason = "headers not allowed"
+	}
+	if reason != "" {
+		log.WithFields(log.Fields{"origin": origin, "method": method, "headers": requested}).Debugf("CORS preflight rejected: %s", reason)
+		http.Error(w, "CORS preflight rejected: "+reason, http.StatusForbidden)
+		return
+	}
+
+	c.allowOrigin(h, origin)
+	if c.anyMethod {
+		h.Set("Access-Control-Allow-Methods", method)
+	} else {
+		h.Set("Access-Control-Allow-Methods", strings.Join(c.methods, ", "))
+	}
+	if requested != "" {
+		h.Set("Access-Control-Allow-Headers", requested)
+	}
+	if c.maxAge != "" {
+		h.Set("Access-Control-Max-Age", c.maxAge)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// allowedHeaders reports whether every header of an
+// Access-Control-Request-Headers list is allowed.
+func (c *CORS) allowedHeaders(list string) bool {
+	if c.anyHeader {
+		return true
+	}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" && !slices.Contains(c.headers, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// allowOrigin sets the headers letting origin read responses.
+func (c *CORS) allowOrigin(h http.Header, origin string) {
+	if c.anyOrigin {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// apply replaces the CORS headers of a response to a request from origin.
+func (c *CORS) apply(h http.Header, origin string) {
+	for name := range h {
+		if strings.HasPrefix(name, "Access-Control-") {
+			delete(h, name)
+		}
+	}
+	if !c.anyOrigin {
+		// The answer depends on the origin, caches have to keep them apart
+		addVary(h, "Origin")
+	}
+	if origin == "" || !c.allowedOrigin(origin) {
+		return
+	}
+	c.allowOrigin(h, origin)
+	if c.exposed != "" {
+		h.Set("Access-Control-Expose-Headers", c.exposed)
+	}
+}
+
+// addVary adds names to the Vary header unless they are listed already.
+func addVary(h http.Header, names ...string) {
+	for _, name := range names {
+		listed := false
+		for _, v := range h.Values("Vary") {
+			for _, f := range strings.Split(v, ",") {
+				if f = strings.TrimSpace(f); f == "*" || strings.EqualFold(f, name) {
+					listed = true
+				}
+			}
+		}
+		if !listed {
+			h.Add("Vary", name)
+		}
+	}
+}
+
+// responseWriter replaces the CORS headers of a response when its header is written.
+type responseWriter struct {
+	http.ResponseWriter
+	c      *CORS
+	origin string
+	wrote  bool
+}
+
+func (cw *responseWriter) WriteHeader(code int) {
+	if !cw.wrote && code >= 200 {
+		cw.wrote = true
+		cw.c.apply(cw.Header(), cw.origin)
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *responseWriter) Write(p []byte) (int, error) {
+	if !cw.wrote {
+		cw.WriteHeader(http.StatusOK)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *responseWriter) Flush() {
+	if !cw.wrote {
+		cw.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to set deadlines.
+func (cw *responseWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
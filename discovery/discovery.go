@@ -0,0 +1,291 @@
+// Package discovery provides the sources that fill a server pool: static
+// lists and servers files, DNS SRV and A/AAAA records, a directory of
+// server files and an HTTP endpoint.
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samsyntax/go-lb/config"
+	log "github.com/sirupsen/logrus"
+)
+
+var errNoServers = errors.New("discovery returned no servers")
+
+// Updater is what a discovery provider keeps in sync, usually a *pool.Pool.
+type Updater interface {
+	UpdateServers(specs []config.ServerConfig) error
+}
+
+// Discovery is a source of servers for the pool. Resolve returns the full
+// set of servers the pool should contain.
+type Discovery interface {
+	Resolve(ctx context.Context) ([]config.ServerConfig, error)
+	String() string
+}
+
+// FromConfig builds the discovery provider for cfg's environment together
+// with its polling interval. Static providers are resolved once (interval 0).
+func FromConfig(cfg *config.Config) (Discovery, time.Duration, error) {
+	interval := cfg.Discovery.Interval.Std()
+	switch cfg.Environment {
+	case "external":
+		if len(cfg.Servers) > 0 {
+			return &Static{Servers: cfg.Servers}, 0, nil
+		}
+		return &Static{Path: cfg.ServersFile}, 0, nil
+	case "dns":
+		dns := cfg.Discovery.DNS
+		return &DNS{
+			Name:     dns.Name,
+			Record:   dns.Record,
+			Port:     dns.Port,
+			Scheme:   dns.Scheme,
+			Protocol: dns.Protocol,
+			Resolver: NewResolver(dns.Nameserver),
+		}, interval, nil
+	case "directory":
+		return &Dir{Path: cfg.Discovery.Directory.Path}, interval, nil
+	case "endpoint":
+		client := &http.Client{Timeout: 10 * time.Second}
+		return &HTTP{URL: cfg.Discovery.Endpoint.URL, Client: client}, interval, nil
+	default:
+		return nil, 0, fmt.Errorf("unknown environment: %s", cfg.Environment)
+	}
+}
+
+// emptiable is implemented by providers whose empty results are a real
+// empty set, not a likely outage of the source.
+type emptiable interface {
+	AllowEmpty() bool
+}
+
+// Sync resolves d once and reconciles u with the result. Failed results
+// keep the current pool and are returned as errors, and so do empty ones
+// unless d allows them.
+func Sync(ctx context.Context, d Discovery, u Updater) error {
+	resolveCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	specs, err := d.Resolve(resolveCtx)
+	if err != nil {
+		log.WithFields(log.Fields{"discovery": d.String()}).Errorf("Discovery failed: %v", err)
+		return err
+	}
+	if len(specs) == 0 {
+		if e, ok := d.(emptiable); !ok || !e.AllowEmpty() {
+			log.WithFields(log.Fields{"discovery": d.String()}).Warn("Discovery returned no servers, keeping current pool")
+			return errNoServers
+		}
+		log.WithFields(log.Fields{"discovery": d.String()}).Warn("Discovery returned no servers, emptying pool")
+	}
+	if err := u.UpdateServers(specs); err != nil {
+		log.WithFields(log.Fields{"discovery": d.String()}).Errorf("Failed to update server pool: %v", err)
+		return err
+	}
+	return nil
+}
+
+// Run syncs u with d every interval until ctx is done.
+func Run(ctx context.Context, d Discovery, u Updater, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			Sync(ctx, d, u)
+		}
+	}
+}
+
+// Static serves a fixed list of servers, either given inline or
+// read from a .json/.yaml servers file.
+type Static struct {
+	Path    string
+	Servers []config.ServerConfig
+}
+
+func (d *Static) String() string {
+	if d.Path == "" {
+		return "static"
+	}
+	return "static:" + d.Path
+}
+
+func (d *Static) Resolve(context.Context) ([]config.ServerConfig, error) {
+	if d.Servers != nil {
+		return d.Servers, nil
+	}
+	return config.LoadServersFile(d.Path)
+}
+
+// Dir reads one server per file from a directory. Dropping a
+// .json/.yaml file in adds a server, removing it takes the server out, the
+// last one included. A directory whose every server file is invalid, e.g.
+// while they are rewritten, keeps the current pool.
+type Dir struct {
+	Path string
+}
+
+func (d *Dir) String() string {
+	return "directory:" + d.Path
+}
+
+func (d *Dir) Resolve(context.Context) ([]config.ServerConfig, error) {
+	entries, err := os.ReadDir(d.Path)
+	if err != nil {
+		return nil, err
+	}
+	var res []config.ServerConfig
+	skipped := 0
+	for _, e := range entries {
+		// Skip directories and editor/hidden files
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(d.Path, e.Name())
+		spec, err := readServerFile(path)
+		if err != nil {
+			log.WithFields(log.Fields{"file": path}).Warnf("Skipping server file: %v", err)
+			skipped++
+			continue
+		}
+		if spec == nil {
+			continue
+		}
+		res = append(res, *spec)
+	}
+	if len(res) == 0 && skipped > 0 {
+		return nil, fmt.Errorf("none of the %d server files is valid", skipped)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Address < res[j].Address })
+	return res, nil
+}
+
+// AllowEmpty lets an empty directory empty the pool.
+func (d *Dir) AllowEmpty() bool {
+	return true
+}
+
+// readServerFile reads a single server entry, nil for unsupported extensions.
+func readServerFile(path string) (*config.ServerConfig, error) {
+	format, err := config.Format(path)
+	if err != nil {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var spec config.ServerConfig
+	if _, err := config.DecodeStrict(data, format, path, &spec); err != nil {
+		return nil, err
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// HTTP polls an HTTP endpoint returning a JSON list of servers in
+// the ServerConfig schema. ETags are honoured so unchanged lists are
+// not transferred again.
+type HTTP struct {
+	URL    string
+	Client *http.Client
+
+	mu   sync.Mutex
+	etag string
+	last []config.ServerConfig
+}
+
+func (d *HTTP) String() string {
+	return "http:" + d.URL
+}
+
+func (d *HTTP) Resolve(ctx context.Context) ([]config.ServerConfig, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if d.etag != "" {
+		req.Header.Set("If-None-Match", d.etag)
+	}
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusNotModified:
+		return d.last, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	byteVal, err := io.ReadAll(io.LimitReader(res.Body, 10<<20))
+	if err != nil {
+		return nil, err
+	}
+	var entries []json.RawMessage
+	if err := json.Unmarshal(byteVal, &entries); err != nil {
+		return nil, err
+	}
+	// Entries are checked one by one like server files, so a bad one is
+	// skipped instead of failing the whole list
+	servers := make([]config.ServerConfig, 0, len(entries))
+	for i, raw := range entries {
+		spec, err := d.decodeEntry(raw)
+		if err != nil {
+			log.WithFields(log.Fields{"url": d.URL, "entry": i}).Warnf("Skipping server entry: %v", err)
+			continue
+		}
+		servers = append(servers, spec)
+	}
+	if len(servers) == 0 && len(entries) > 0 {
+		return nil, fmt.Errorf("none of the %d server entries is valid", len(entries))
+	}
+	d.etag = res.Header.Get("ETag")
+	d.last = servers
+	return servers, nil
+}
+
+// decodeEntry decodes and validates a single server of the endpoint's list.
+func (d *HTTP) decodeEntry(raw json.RawMessage) (config.ServerConfig, error) {
+	var spec config.ServerConfig
+	if _, err := config.DecodeStrict(raw, "json", "", &spec); err != nil {
+		// Lines count from the entry, not the response, and would mislead
+		var errs config.Errors
+		if !errors.As(err, &errs) {
+			return spec, err
+		}
+		msgs := make([]string, len(errs))
+		for i, e := range errs {
+			msgs[i] = e.Msg
+			if e.Path != "" {
+				msgs[i] = e.Path + ": " + e.Msg
+			}
+		}
+		return spec, errors.New(strings.Join(msgs, "; "))
+	}
+	return spec, spec.Validate()
+}
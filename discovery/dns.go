@@ -0,0 +1,101 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/samsyntax/go-lb/config"
+)
+
+// DNS resolves a DNS name into server entries.
+type DNS struct {
+	Name     string        // SRV name (_http._tcp.example.com) or host name for A/AAAA lookups
+	Record   string        // srv or a
+	Port     int           // port used with A/AAAA results
+	Scheme   string        // scheme of the generated addresses, http by default
+	Protocol string        // upstream protocol for the generated servers
+	Resolver *net.Resolver // resolver used for lookups, net.DefaultResolver when nil
+}
+
+// NewResolver returns a resolver that sends every query to nameserver
+// (host:port), e.g. a local stub resolver. An empty nameserver uses the system resolver.
+func NewResolver(nameserver string) *net.Resolver {
+	if nameserver == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, nameserver)
+		},
+	}
+}
+
+func (d *DNS) String() string {
+	return "dns:" + d.Name
+}
+
+func (d *DNS) resolver() *net.Resolver {
+	if d.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return d.Resolver
+}
+
+func (d *DNS) address(host string, port int) string {
+	scheme := d.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	return scheme + "://" + net.JoinHostPort(strings.TrimSuffix(host, "."), strconv.Itoa(port))
+}
+
+// Resolve looks the name up once and returns the servers it points to,
+// sorted by address so unchanged results compare equal.
+func (d *DNS) Resolve(ctx context.Context) ([]config.ServerConfig, error) {
+	var res []config.ServerConfig
+	switch d.Record {
+	case config.RecordSRV:
+		_, records, err := d.resolver().LookupSRV(ctx, "", "", d.Name)
+		if err != nil {
+			return nil, err
+		}
+		// Only the most preferred priority is used, the rest are fallbacks
+		best := -1
+		for _, r := range records {
+			if best == -1 || int(r.Priority) < best {
+				best = int(r.Priority)
+			}
+		}
+		for _, r := range records {
+			if int(r.Priority) != best {
+				continue
+			}
+			weight := int(r.Weight)
+			if weight == 0 {
+				weight = 1
+			}
+			res = append(res, config.ServerConfig{Address: d.address(r.Target, int(r.Port)), Weight: weight, Protocol: d.Protocol})
+		}
+	case config.RecordA:
+		if d.Port == 0 {
+			return nil, fmt.Errorf("dns discovery: port is required for A/AAAA lookups of %s", d.Name)
+		}
+		ips, err := d.resolver().LookupIPAddr(ctx, d.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			res = append(res, config.ServerConfig{Address: d.address(ip.String(), d.Port), Weight: 1, Protocol: d.Protocol})
+		}
+	default:
+		return nil, fmt.Errorf("dns discovery: unknown record type %q", d.Record)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Address < res[j].Address })
+	return res, nil
+}
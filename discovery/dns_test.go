@@ -0,0 +1,210 @@
+package discovery_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/samsyntax/go-lb/config"
+	"github.com/samsyntax/go-lb/discovery"
+	"github.com/samsyntax/go-lb/pool"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stub is a local DNS server answering SRV, A and AAAA queries from records
+// the test can change between lookups.
+type stub struct {
+	conn net.PacketConn
+
+	mu   sync.Mutex
+	srv  map[string][]dnsmessage.SRVResource
+	ipv4 map[string][][4]byte
+	ipv6 map[string][][16]byte
+}
+
+func startStub(t *testing.T) *stub {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stub{
+		conn: conn,
+		srv:  make(map[string][]dnsmessage.SRVResource),
+		ipv4: make(map[string][][4]byte),
+		ipv6: make(map[string][][16]byte),
+	}
+	t.Cleanup(func() { conn.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *stub) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *stub) setSRV(name string, records ...dnsmessage.SRVResource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.srv[name] = records
+}
+
+func (s *stub) setIPs(name string, ips ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ipv4[name], s.ipv6[name] = nil, nil
+	for _, ip := range ips {
+		parsed := net.ParseIP(ip)
+		if v4 := parsed.To4(); v4 != nil {
+			s.ipv4[name] = append(s.ipv4[name], [4]byte(v4))
+		} else {
+			s.ipv6[name] = append(s.ipv6[name], [16]byte(parsed.To16()))
+		}
+	}
+}
+
+func (s *stub) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if res, err := s.answer(buf[:n]); err == nil {
+			s.conn.WriteTo(res, from)
+		}
+	}
+}
+
+func (s *stub) answer(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, Authoritative: true})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 1}
+	name := q.Name.String()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch q.Type {
+	case dnsmessage.TypeSRV:
+		for _, r := range s.srv[name] {
+			b.SRVResource(rh, r)
+		}
+	case dnsmessage.TypeA:
+		for _, ip := range s.ipv4[name] {
+			b.AResource(rh, dnsmessage.AResource{A: ip})
+		}
+	case dnsmessage.TypeAAAA:
+		for _, ip := range s.ipv6[name] {
+			b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: ip})
+		}
+	}
+	return b.Finish()
+}
+
+func srv(target string, port, weight uint16) dnsmessage.SRVResource {
+	return dnsmessage.SRVResource{Priority: 10, Weight: weight, Port: port, Target: dnsmessage.MustNewName(target)}
+}
+
+func TestDNSSRV(t *testing.T) {
+	s := startStub(t)
+	const name = "_http._tcp.web.test."
+	s.setSRV(name, srv("a.web.test.", 8001, 5), srv("b.web.test.", 8002, 2), srv("c.web.test.", 8003, 0))
+	d := &discovery.DNS{Name: name, Record: config.RecordSRV, Resolver: discovery.NewResolver(s.addr())}
+	p := pool.New(nil, true)
+	ctx := context.Background()
+
+	if err := discovery.Sync(ctx, d, p); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{
+		"http://a.web.test:8001": 5,
+		"http://b.web.test:8002": 2,
+		"http://c.web.test:8003": 1, // weight 0 counts as 1
+	}
+	servers := p.Servers()
+	if len(servers) != len(want) {
+		t.Fatalf("got %d servers, want %d", len(servers), len(want))
+	}
+	for _, srv := range servers {
+		w, ok := want[srv.Address()]
+		if !ok {
+			t.Fatalf("unexpected server %s", srv.Address())
+		}
+		if srv.Weight() != w {
+			t.Errorf("%s: weight %d, want %d", srv.Address(), srv.Weight(), w)
+		}
+	}
+
+	// Count requests, then drop c and change b's weight
+	for i := 0; i < 16; i++ {
+		p.Next()
+	}
+	a := p.Find("http://a.web.test:8001")
+	requests := a.Requests()
+	if requests == 0 {
+		t.Fatal("no requests were counted for a")
+	}
+	s.setSRV(name, srv("a.web.test.", 8001, 5), srv("b.web.test.", 8002, 7))
+	if err := discovery.Sync(ctx, d, p); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Find("http://a.web.test:8001"); got != a || got.Requests() != requests {
+		t.Errorf("a was replaced or lost its stats: %d requests, want %d", got.Requests(), requests)
+	}
+	if got := p.Find("http://b.web.test:8002"); got == nil || got.Weight() != 7 {
+		t.Errorf("b wasn't kept with its new weight")
+	}
+	if p.Find("http://c.web.test:8003") != nil {
+		t.Errorf("c is still in the pool after its record was removed")
+	}
+}
+
+func TestDNSAddresses(t *testing.T) {
+	s := startStub(t)
+	const name = "web.test."
+	s.setIPs(name, "10.0.0.1", "10.0.0.2", "fd00::1")
+	d := &discovery.DNS{Name: name, Record: config.RecordA, Port: 8080, Resolver: discovery.NewResolver(s.addr())}
+	p := pool.New(nil, false)
+	ctx := context.Background()
+
+	if err := discovery.Sync(ctx, d, p); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080", "http://[fd00::1]:8080"} {
+		if p.Find(addr) == nil {
+			t.Errorf("%s is missing", addr)
+		}
+	}
+	for i := 0; i < 6; i++ {
+		p.Next()
+	}
+	kept := p.Find("http://10.0.0.2:8080")
+	requests := kept.Requests()
+
+	s.setIPs(name, "10.0.0.2", "fd00::1")
+	if err := discovery.Sync(ctx, d, p); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Servers()) != 2 {
+		t.Fatalf("got %d servers, want 2", len(p.Servers()))
+	}
+	if p.Find("http://10.0.0.1:8080") != nil {
+		t.Errorf("10.0.0.1 is still in the pool after its record was removed")
+	}
+	if got := p.Find("http://10.0.0.2:8080"); got != kept || got.Requests() != requests {
+		t.Errorf("10.0.0.2 was replaced or lost its stats")
+	}
+}
@@ -0,0 +1,76 @@
+// Package fault decides which requests get an injected fault for chaos
+// testing: a fixed or random delay, an aborted response with a given status
+// or a reset connection, for a share of requests and optionally only for
+// requests carrying a header.
+package fault
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Options configures a Fault.
+type Options struct {
+	Percentage float64       // share of requests in percent, (0, 100]
+	Header     string        // only requests carrying this header, empty for all
+	Delay      time.Duration // delay before the request is forwarded or aborted
+	DelayMax   time.Duration // random delay between Delay and DelayMax when set
+	Abort      int           // status code answered instead of forwarding, 0 to forward
+	Reset      bool          // close the connection without a response
+}
+
+// Fault injects the faults described by its options.
+type Fault struct {
+	opts Options
+}
+
+// New creates a fault. It returns nil when opts inject nothing, and a nil
+// Fault never injects.
+func New(opts Options) *Fault {
+	if opts.Percentage <= 0 || (opts.Delay <= 0 && opts.DelayMax <= 0 && opts.Abort == 0 && !opts.Reset) {
+		return nil
+	}
+	return &Fault{opts: opts}
+}
+
+// Injection is the fault injected into a single request.
+type Injection struct {
+	Delay time.Duration
+	Abort int
+	Reset bool
+}
+
+// String names the injected faults, e.g. "delay+abort".
+func (in Injection) String() string {
+	var kinds []string
+	if in.Delay > 0 {
+		kinds = append(kinds, "delay")
+	}
+	if in.Abort != 0 {
+		kinds = append(kinds, "abort")
+	}
+	if in.Reset {
+		kinds = append(kinds, "reset")
+	}
+	return strings.Join(kinds, "+")
+}
+
+// Decide reports whether a fault is injected into r, and which.
+func (f *Fault) Decide(r *http.Request) (Injection, bool) {
+	if f == nil {
+		return Injection{}, false
+	}
+	if f.opts.Header != "" && r.Header.Get(f.opts.Header) == "" {
+		return Injection{}, false
+	}
+	if f.opts.Percentage < 100 && rand.Float64()*100 >= f.opts.Percentage {
+		return Injection{}, false
+	}
+	in := Injection{Delay: f.opts.Delay, Abort: f.opts.Abort, Reset: f.opts.Reset}
+	if span := f.opts.DelayMax - f.opts.Delay; span > 0 {
+		in.Delay += rand.N(span)
+	}
+	return in, true
+}
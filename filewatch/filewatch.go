@@ -0,0 +1,78 @@
+// Package filewatch keeps the parsed content of files, such as credential
+// and IP lists, up to date while the balancer runs.
+package filewatch
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Interval is how often files are checked for changes.
+const Interval = 5 * time.Second
+
+// File is the parsed content of a file, parsed again when the file changes.
+// A file that fails to parse keeps its previous content.
+type File[T any] struct {
+	path  string
+	parse func(data []byte) (T, error)
+
+	mu      sync.Mutex
+	value   T
+	modTime time.Time
+	size    int64
+	checked time.Time
+}
+
+// New loads and parses the file at path.
+func New[T any](path string, parse func(data []byte) (T, error)) (*File[T], error) {
+	f := &File[T]{path: path, parse: parse}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File[T]) load() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	v, err := f.parse(data)
+	if err != nil {
+		return err
+	}
+	f.value, f.modTime, f.size = v, info.ModTime(), info.Size()
+	return nil
+}
+
+// Get returns the current content. The file is reloaded when it changed,
+// checking at most once per Interval.
+func (f *File[T]) Get() T {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if time.Since(f.checked) < Interval {
+		return f.value
+	}
+	f.checked = time.Now()
+	info, err := os.Stat(f.path)
+	if err != nil {
+		log.WithField("file", f.path).Errorf("Failed to check file, keeping its last content: %v", err)
+		return f.value
+	}
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.value
+	}
+	if err := f.load(); err != nil {
+		log.WithField("file", f.path).Errorf("Failed to reload file, keeping its last content: %v", err)
+		return f.value
+	}
+	log.WithField("file", f.path).Info("File reloaded")
+	return f.value
+}
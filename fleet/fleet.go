@@ -0,0 +1,169 @@
+// Package fleet runs local dev servers with configurable misbehaviour:
+// artificial latency, error rates, dropped connections, slow health checks
+// and an endpoint to take them down and up, so health checks, retries and
+// outlier ejection can be exercised without real backends.
+package fleet
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/samsyntax/go-lb/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// HealthPath is the health endpoint of every dev server.
+const HealthPath = "/_dev/health"
+
+// Server is a local dev server.
+type Server struct {
+	name string
+	addr string // host:port the server listens on
+	cfg  config.LocalServerConfig
+
+	mu   sync.Mutex
+	down bool
+}
+
+// Start listens on addr and serves in the background. It returns once the
+// server accepts connections, so it can be health checked right away.
+func Start(name, addr string, cfg config.LocalServerConfig) (*Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{name: name, addr: l.Addr().String(), cfg: cfg, down: cfg.Down}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+HealthPath, s.handleHealth)
+	mux.HandleFunc("GET /_dev/state", s.handleState)
+	mux.HandleFunc("POST /_dev/up", s.handleSet(false))
+	mux.HandleFunc("POST /_dev/down", s.handleSet(true))
+	mux.HandleFunc("POST /_dev/toggle", s.handleToggle)
+	mux.HandleFunc("/", s.handle)
+
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Errorf("Dev server %s on %s stopped: %v", name, s.addr, err)
+		}
+	}()
+	return s, nil
+}
+
+func (s *Server) Name() string {
+	return s.name
+}
+
+// URL returns the base URL of the server.
+func (s *Server) URL() string {
+	return "http://" + s.addr
+}
+
+// Down reports whether the server is toggled down.
+func (s *Server) Down() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.down
+}
+
+// SetDown takes the server down (every request and health check answered
+// with 503) or brings it back up.
+func (s *Server) SetDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(s.cfg.HealthLatency.Std())
+	if s.Down() {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, "ok")
+}
+
+// state is the body of the /_dev endpoints.
+type state struct {
+	Name string                   `json:"name"`
+	Down bool                     `json:"down"`
+	Cfg  config.LocalServerConfig `json:"config"`
+}
+
+func (s *Server) handleState(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state{Name: s.name, Down: s.Down(), Cfg: s.cfg})
+}
+
+func (s *Server) handleSet(down bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.SetDown(down)
+		log.WithFields(log.Fields{"down": down}).Infof("Dev server %s toggled", s.name)
+		s.handleState(w, r)
+	}
+}
+
+func (s *Server) handleToggle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.down = !s.down
+	down := s.down
+	s.mu.Unlock()
+	log.WithFields(log.Fields{"down": down}).Infof("Dev server %s toggled", s.name)
+	s.handleState(w, r)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if s.Down() {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+	if chance(s.cfg.DropRate) {
+		log.Debugf("Dev server %s dropping connection", s.name)
+		// Aborts the response and closes the connection (resets the stream on HTTP/2)
+		panic(http.ErrAbortHandler)
+	}
+	time.Sleep(Latency(s.cfg.Latency))
+	if chance(s.cfg.ErrorRate) {
+		http.Error(w, "injected error", http.StatusInternalServerError)
+		return
+	}
+	inf := fmt.Sprintf("Serving on port %s", s.addr)
+	log.Info(inf)
+	io.WriteString(w, inf)
+}
+
+func chance(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
+
+// Latency draws a delay from the distribution. Without a distribution the
+// mean is used as a fixed delay.
+func Latency(l config.LatencyConfig) time.Duration {
+	var d time.Duration
+	switch l.Distribution {
+	case "uniform":
+		d = l.Min.Std()
+		if span := l.Max.Std() - l.Min.Std(); span > 0 {
+			d += rand.N(span)
+		}
+	case "normal":
+		d = l.Mean.Std() + time.Duration(rand.NormFloat64()*float64(l.Stddev.Std()))
+	case "exponential":
+		d = time.Duration(rand.ExpFloat64() * float64(l.Mean.Std()))
+	default:
+		d = l.Mean.Std()
+	}
+	if d < l.Min.Std() {
+		d = l.Min.Std()
+	}
+	if l.Max > 0 && d > l.Max.Std() {
+		d = l.Max.Std()
+	}
+	return d
+}
@@ -0,0 +1,68 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// TrustedProxies are the proxies whose X-Forwarded-For headers are believed.
+type TrustedProxies []netip.Prefix
+
+// ParseTrustedProxies parses a list of IPs and CIDR ranges.
+func ParseTrustedProxies(list []string) (TrustedProxies, error) {
+	res := make(TrustedProxies, 0, len(list))
+	for _, s := range list {
+		p, err := ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, p)
+	}
+	return res, nil
+}
+
+func (t TrustedProxies) trusted(ip netip.Addr) bool {
+	for _, p := range t {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that sent r. When r comes from
+// a trusted proxy, X-Forwarded-For is read from right to left and the first
+// address that isn't a trusted proxy is the client; addresses further left
+// could have been made up by the client.
+func (t TrustedProxies) ClientIP(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	ip = ip.Unmap()
+	if !t.trusted(ip) {
+		return ip, true
+	}
+	values := r.Header.Values("X-Forwarded-For")
+	for i := len(values) - 1; i >= 0; i-- {
+		hops := strings.Split(values[i], ",")
+		for j := len(hops) - 1; j >= 0; j-- {
+			hop, err := netip.ParseAddr(strings.TrimSpace(hops[j]))
+			if err != nil {
+				// A malformed entry ends the chain the proxies vouch for
+				return ip, true
+			}
+			ip = hop.Unmap()
+			if !t.trusted(ip) {
+				return ip, true
+			}
+		}
+	}
+	return ip, true
+}
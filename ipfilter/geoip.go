@@ -0,0 +1,61 @@
+package ipfilter
+
+import (
+	"net/netip"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/samsyntax/go-lb/filewatch"
+	log "github.com/sirupsen/logrus"
+)
+
+// GeoIP looks up the country of addresses in a MaxMind DB file, such as
+// GeoLite2-Country or GeoLite2-City. The database is reloaded when the file
+// is replaced.
+type GeoIP struct {
+	db *filewatch.File[*maxminddb.Reader]
+}
+
+var (
+	geoIPMu sync.Mutex
+	geoIPs  = make(map[string]*GeoIP)
+)
+
+// OpenGeoIP loads the database at path. Filters opening the same path share
+// one copy of it.
+func OpenGeoIP(path string) (*GeoIP, error) {
+	geoIPMu.Lock()
+	defer geoIPMu.Unlock()
+	if g, ok := geoIPs[path]; ok {
+		return g, nil
+	}
+	db, err := filewatch.New(path, maxminddb.FromBytes)
+	if err != nil {
+		return nil, err
+	}
+	g := &GeoIP{db: db}
+	geoIPs[path] = g
+	return g, nil
+}
+
+// Country returns the ISO 3166-1 alpha-2 code of the country ip is located
+// in, or registered to when its location is unknown. It returns an empty
+// string for addresses not in the database.
+func (g *GeoIP) Country(ip netip.Addr) string {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		RegisteredCountry struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"registered_country"`
+	}
+	if err := g.db.Get().Lookup(ip.AsSlice(), &record); err != nil {
+		log.WithField("ip", ip).Errorf("GeoIP lookup failed: %v", err)
+		return ""
+	}
+	if record.Country.ISOCode != "" {
+		return record.Country.ISOCode
+	}
+	return record.RegisteredCountry.ISOCode
+}
@@ -0,0 +1,184 @@
+// Package ipfilter allows and denies requests by client IP address: by
+// IPs and CIDR ranges listed inline or in files, which are reloaded when
+// they change, and by country using a local GeoIP database. Client addresses
+// are taken from X-Forwarded-For only when the request comes from a trusted
+// proxy.
+package ipfilter
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/samsyntax/go-lb/filewatch"
+)
+
+// Options configures a Filter.
+type Options struct {
+	Allow          []string // IPs and CIDR ranges
+	Deny           []string
+	AllowFile      string // one IP or CIDR range per line
+	DenyFile       string
+	AllowCountries []string // ISO 3166-1 alpha-2 country codes, looked up in GeoIP
+	DenyCountries  []string
+	GeoIP          *GeoIP // required for country rules
+}
+
+// Filter decides which client addresses are let through. Deny rules are
+// checked first; when there are allow rules, an address has to match one of
+// them too.
+type Filter struct {
+	allow, deny                   []prefix
+	allowFile, denyFile           *filewatch.File[[]prefix]
+	allowCountries, denyCountries []string
+	geoIP                         *GeoIP
+}
+
+// prefix is a range with the rule it comes from, for logging.
+type prefix struct {
+	netip.Prefix
+	rule string
+}
+
+// New creates a filter. It returns nil when opts has no rules.
+func New(opts Options) (*Filter, error) {
+	f := &Filter{geoIP: opts.GeoIP}
+	var err error
+	if f.allow, err = parsePrefixes(opts.Allow, "allow"); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parsePrefixes(opts.Deny, "deny"); err != nil {
+		return nil, err
+	}
+	if opts.AllowFile != "" {
+		if f.allowFile, err = filewatch.New(opts.AllowFile, parseFile(opts.AllowFile, "allow")); err != nil {
+			return nil, fmt.Errorf("allow file: %w", err)
+		}
+	}
+	if opts.DenyFile != "" {
+		if f.denyFile, err = filewatch.New(opts.DenyFile, parseFile(opts.DenyFile, "deny")); err != nil {
+			return nil, fmt.Errorf("deny file: %w", err)
+		}
+	}
+	for _, c := range opts.AllowCountries {
+		f.allowCountries = append(f.allowCountries, strings.ToUpper(c))
+	}
+	for _, c := range opts.DenyCountries {
+		f.denyCountries = append(f.denyCountries, strings.ToUpper(c))
+	}
+	if (len(f.allowCountries) > 0 || len(f.denyCountries) > 0) && f.geoIP == nil {
+		return nil, errors.New("country rules require a GeoIP database")
+	}
+	if !f.hasAllow() && len(f.deny) == 0 && f.denyFile == nil && len(f.denyCountries) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+func (f *Filter) hasAllow() bool {
+	return len(f.allow) > 0 || f.allowFile != nil || len(f.allowCountries) > 0
+}
+
+// Check reports whether ip is allowed, and the rule deciding it: the deny
+// rule it matched, or the allow rule when there are allow rules.
+func (f *Filter) Check(ip netip.Addr) (rule string, allowed bool) {
+	ip = ip.Unmap()
+	if rule, ok := match(f.deny, ip); ok {
+		return rule, false
+	}
+	if f.denyFile != nil {
+		if rule, ok := match(f.denyFile.Get(), ip); ok {
+			return rule, false
+		}
+	}
+	var country string
+	if len(f.allowCountries) > 0 || len(f.denyCountries) > 0 {
+		country = f.geoIP.Country(ip)
+	}
+	if country != "" && slices.Contains(f.denyCountries, country) {
+		return "deny country " + country, false
+	}
+	if !f.hasAllow() {
+		return "", true
+	}
+	if rule, ok := match(f.allow, ip); ok {
+		return rule, true
+	}
+	if f.allowFile != nil {
+		if rule, ok := match(f.allowFile.Get(), ip); ok {
+			return rule, true
+		}
+	}
+	if country != "" && slices.Contains(f.allowCountries, country) {
+		return "allow country " + country, true
+	}
+	if country == "" && len(f.allowCountries) > 0 {
+		return "no allow rule (country unknown)", false
+	}
+	return "no allow rule", false
+}
+
+func match(prefixes []prefix, ip netip.Addr) (string, bool) {
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return p.rule, true
+		}
+	}
+	return "", false
+}
+
+// ParsePrefix parses an IP address or CIDR range. Addresses are returned as
+// single-address ranges.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return p.Masked(), nil
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	ip = ip.Unmap()
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+func parsePrefixes(list []string, rule string) ([]prefix, error) {
+	res := make([]prefix, 0, len(list))
+	for _, s := range list {
+		p, err := ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", rule, err)
+		}
+		res = append(res, prefix{p, rule + " " + s})
+	}
+	return res, nil
+}
+
+// parseFile parses a list file: one IP or CIDR range per line, with
+// comments starting with #.
+func parseFile(path, rule string) func(data []byte) ([]prefix, error) {
+	return func(data []byte) ([]prefix, error) {
+		var res []prefix
+		sc := bufio.NewScanner(bytes.NewReader(data))
+		for n := 1; sc.Scan(); n++ {
+			line, _, _ := strings.Cut(sc.Text(), "#")
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			p, err := ParsePrefix(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			res = append(res, prefix{p, fmt.Sprintf("%s %s (%s:%d)", rule, line, path, n)})
+		}
+		return res, sc.Err()
+	}
+}
@@ -3,29 +3,37 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"os"
-	"strconv"
-	"time"
+	"strings"
 
+	"github.com/samsyntax/go-lb/balancer"
+	"github.com/samsyntax/go-lb/config"
+	"github.com/samsyntax/go-lb/pool"
+	"github.com/samsyntax/go-lb/telemetry"
 	log "github.com/sirupsen/logrus"
-	"go.opentelemetry.io/otel"
 )
 
-// Define command-line flags
-var (
-	amount              = flag.Int("amount", 5, "Enter amount of local servers to be spawned")
-	method              = flag.String("method", "rr", "Load balancing method: 'rr' - Round Robin | 'wrr' - Weighted Round Robin")
-	env                 = flag.String("env", "local", "Specify whether local servers should be started or provide JSON file with addresses of external servers.")
-	path                = flag.String("path", "./servers.yaml", "Specify a path to servers config file. Either yaml or json.")
-	lbPort              = flag.Int("port", 7000, "Specify port on which load balancer is launched.")
-	serverPort          = flag.Int("srv-port", 8000, "Specify port on which local dev server is launched. (If more than 1 server is spawned, the port number will be incremented by 1 for each server, e.g., server 0 - :8000; server 1 - :8001)")
-	healthCheck         = flag.Bool("healthCheck", false, "Run health check on external servers from the list")
-	healthCheckInterval = flag.Int("hcInterval", 20, "Specify interval between running health checks on servers in the pool")
-	configPath          = flag.String("config", "./config.json", "Specify a path to balancer config file in json format")
-)
+const usage = `Usage: lb <command> [flags]
+
+Commands:
+  serve      run the load balancer (default when no command is given)
+  check      run a one-shot health check of every server in the config
+  validate   check a config file without starting the balancer
+  status     show the state of a running balancer
+  drain      stop sending new requests to a server of a running balancer
+  split      show or change the traffic split between server groups
+  cache      show response cache stats or purge cached responses
+  waf        show firewall rule hits or print the starter rules
+  bench      replay captured requests or generate load and report latency
+
+Run 'lb <command> -h' for the flags of a command.
+`
 
 func init() {
 	log.SetFormatter(&log.TextFormatter{
@@ -35,9 +43,28 @@ func init() {
 	log.SetLevel(log.TraceLevel)
 }
 
-func flagPassed(name string) bool {
+// addConfigFlags registers the flags shared by every command that loads the
+// balancer config and returns the -config flag.
+func addConfigFlags(fs *flag.FlagSet) *string {
+	fs.Int("amount", 5, "Enter amount of local servers to be spawned")
+	fs.String("method", "rr", "Load balancing method: 'rr' - Round Robin | 'wrr' - Weighted Round Robin")
+	fs.String("env", "local", "Specify whether local servers should be started or provide JSON file with addresses of external servers.")
+	fs.String("path", "./servers.yaml", "Specify a path to servers file. Either json, yaml or toml.")
+	fs.Int("port", 7000, "Specify port on which load balancer is launched.")
+	fs.Int("srv-port", 8000, "Specify port on which local dev server is launched. (If more than 1 server is spawned, the port number will be incremented by 1 for each server, e.g., server 0 - :8000; server 1 - :8001)")
+	fs.Int("hcInterval", 20, "Specify interval between running health checks on servers in the pool")
+	fs.String("tls-cert", "", "Specify a TLS certificate file. Together with -tls-key enables HTTP/2 over TLS on the balancer port")
+	fs.String("tls-key", "", "Specify a TLS private key file")
+	fs.Bool("h2c", false, "Accept cleartext HTTP/2 (h2c) on the balancer port")
+	fs.String("mode", "http", "Proxy mode: 'http' | 'grpc' - balance individual gRPC calls and use gRPC health checks | 'tcp' - forward raw TCP connections")
+	fs.Bool("proxy-protocol", false, "Accept PROXY protocol v1/v2 headers from trusted proxies on the balancer port")
+	fs.String("admin-address", "", "Serve the admin API used by the status and drain commands on host:port")
+	return fs.String("config", "./config.json", "Specify a path to balancer config file in json, yaml or toml format")
+}
+
+func flagPassed(fs *flag.FlagSet, name string) bool {
 	found := false
-	flag.Visit(func(f *flag.Flag) {
+	fs.Visit(func(f *flag.Flag) {
 		if f.Name == name {
 			found = true
 		}
@@ -45,102 +72,120 @@ func flagPassed(name string) bool {
 	return found
 }
 
-func main() {
-	// Parse flags
-	flag.Parse()
+// flagOptions maps command-line flags to the config options they override.
+var flagOptions = map[string]string{
+	"amount":         "local.amount",
+	"method":         "balancer.method",
+	"env":            "environment",
+	"path":           "servers_file",
+	"port":           "balancer.port",
+	"srv-port":       "local.port",
+	"hcInterval":     "health_check.interval",
+	"tls-cert":       "balancer.tls.cert_file",
+	"tls-key":        "balancer.tls.key_file",
+	"h2c":            "balancer.h2c",
+	"mode":           "balancer.mode",
+	"proxy-protocol": "balancer.proxy_protocol.enabled",
+	"admin-address":  "admin.address",
+}
 
-	// Load configuration from JSON file
-	cfg, err := LoadConfig(*configPath)
-	if err != nil {
-		log.Fatalf("Error loading config file: %v", err)
-	}
+// flagOverrides collects the options set by flags passed on the command line.
+func flagOverrides(fs *flag.FlagSet) map[string]string {
+	res := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		if path, ok := flagOptions[f.Name]; ok {
+			res[path] = f.Value.String()
+		}
+	})
+	return res
+}
 
-	// Override config with flags if flags were set
-	if flagPassed("amount") {
-		cfg.Amount = *amount
+// loadConfig loads the config with precedence defaults < config file <
+// GOLB_* env vars < flags. Without a config file at the default path the
+// balancer starts from defaults.
+func loadConfig(flags *flag.FlagSet, configPath string) (*config.Config, error) {
+	overrides := flagOverrides(flags)
+	cfg, err := config.LoadWithOverrides(configPath, overrides)
+	if errors.Is(err, fs.ErrNotExist) && !flagPassed(flags, "config") {
+		log.Infof("No config file at %s, using defaults", configPath)
+		cfg, err = config.Default(overrides)
 	}
-	if flagPassed("method") {
-		cfg.Method = *method
-	}
-	if flagPassed("env") {
-		cfg.Environment = *env
+	return cfg, err
+}
+
+func main() {
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
 	}
-	if flagPassed("path") {
-		log.Infof("Flag 'path' is set to %s, but handling is not implemented in this example.", *path)
+	switch cmd {
+	case "serve":
+		os.Exit(runServe(args))
+	case "check":
+		os.Exit(runCheck(args))
+	case "validate":
+		os.Exit(runValidate(args))
+	case "status":
+		os.Exit(runStatus(args))
+	case "drain":
+		os.Exit(runDrain(args))
+	case "split":
+		os.Exit(runSplit(args))
+	case "cache":
+		os.Exit(runCache(args))
+	case "waf":
+		os.Exit(runWAF(args))
+	case "bench":
+		os.Exit(runBench(args))
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
 	}
-	if flagPassed("port") {
-		cfg.Balanceer_port = *lbPort
+}
+
+// runServe implements the serve command: it runs the balancer until it fails.
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	configPath := addConfigFlags(fs)
+	healthCheck := fs.Bool("healthCheck", false, "Deprecated: use the check command")
+	fs.Parse(args)
+
+	if *healthCheck {
+		log.Warn("-healthCheck is deprecated, use 'lb check'")
+		return checkServers(fs, *configPath, "table")
 	}
-	if flagPassed("srv-port") {
-		cfg.Servers_port = *serverPort
+
+	cfg, err := loadConfig(fs, *configPath)
+	if err != nil {
+		log.Fatalf("Error loading config:\n%v", err)
 	}
-	if flagPassed("hcInterval") {
-		cfg.Health_check_interval = *healthCheckInterval
+	listenerCfg, err := balancer.NewListenerConfig(cfg)
+	if err != nil {
+		log.Fatalf("Error configuring listener: %v", err)
 	}
 
 	// Initialize OpenTelemetry exporter
-	epInit()
 	ctx := context.Background()
-	exp, err := newOTLPExporter(ctx)
+	tp, err := telemetry.Setup(ctx, telemetry.DefaultEndpoint)
 	if err != nil {
-		log.Fatalf("Failed to initialize exporter: %v", err)
+		log.Fatalf("Failed to initialize tracing: %v", err)
 	}
-
-	tp := newTraceProvider(exp)
 	defer func() { _ = tp.Shutdown(ctx) }()
 
-	otel.SetTracerProvider(tp)
-	tracer = tp.Tracer("go-lb")
-
-	// Define LoadBalancer
-	var lb *LoadBalancer
-	var servers []*LbServer
-
-	// Check for environment
-	switch cfg.Environment {
-	case "external":
-		if len(cfg.Servers) > 0 {
-			servers, err = LoadServers(cfg.Servers)
-			if err != nil {
-				log.Errorf("Error loading external servers: %v", err)
-			}
-		} else {
-			servers, err = Loader(*path)
-			if err != nil {
-				log.Errorf("Error loading servers from path: %v", err)
-			}
-		}
-	case "local":
-		servers = Spawner(cfg.Amount, cfg.Servers_port)
-	default:
-		log.Fatalf("Unknown environment: %s", cfg.Environment)
-	}
-
-	// Check for balancing method
-	switch cfg.Method {
-	case "wrr":
-		lb = NewLoadBalancer(cfg.Balanceer_port, servers, true)
-	case "rr":
-		lb = NewLoadBalancer(cfg.Balanceer_port, servers, false)
-	default:
-		log.WithFields(log.Fields{
-			"method": cfg.Method,
-		}).Fatalf("Invalid method. Use 'rr' or 'wrr', got %s", cfg.Method)
+	// Local servers are spawned here, every other environment fills the
+	// pool from its discovery provider
+	var opts []balancer.Option
+	if cfg.Environment == "local" {
+		opts = append(opts, balancer.WithServers(Spawner(cfg.Local, pool.WithTransport(pool.TransportFromConfig(cfg.Transport)))...))
 	}
-
-	if *healthCheck && cfg.Environment == "external" {
-		lb.HealthCheck(1 * time.Second)
-		os.Exit(0)
-	} else {
-		lb.HealthCheck(time.Duration(cfg.Health_check_interval) * time.Second)
-	}
-
-	handleRedirect := func(w http.ResponseWriter, r *http.Request) {
-		ctx, span := tracer.Start(r.Context(), "HTTP GET /")
-		defer span.End()
-
-		lb.ServeProxy(w, r, ctx)
+	lb, err := balancer.NewFromConfig(cfg, opts...)
+	if err != nil {
+		log.Fatalf("Error configuring load balancer: %v", err)
 	}
+	defer lb.Close()
+	lb.Start(ctx)
 
 	// Log aggregation
 	file, err := os.OpenFile("application.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o666)
@@ -151,11 +196,13 @@ func main() {
 	multiWriter := io.MultiWriter(os.Stdout, file)
 	log.SetOutput(multiWriter)
 
-	// Serving load balancer
-	http.HandleFunc("/", handleRedirect)
-	log.WithFields(log.Fields{
-		"port":    lb.port,
-		"address": "127.0.0.1",
-	}).Print("Serving requests at\n")
-	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(lb.port), nil))
+	if cfg.Admin.Address != "" {
+		go func() {
+			log.WithFields(log.Fields{"address": cfg.Admin.Address}).Info("Serving admin API")
+			log.Errorf("Admin API stopped: %v", http.ListenAndServe(cfg.Admin.Address, lb.AdminHandler()))
+		}()
+	}
+
+	log.Fatal(lb.ListenAndServe(listenerCfg))
+	return 0
 }
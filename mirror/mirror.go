@@ -0,0 +1,289 @@
+// Package mirror copies a share of requests to a shadow pool. Shadow
+// requests are sent fire-and-forget once the primary request was served, so
+// they never add latency to it; their responses are discarded and only
+// counted, separately from the primary pool.
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/samsyntax/go-lb/pool"
+	log "github.com/sirupsen/logrus"
+)
+
+var errNoServers = errors.New("no shadow servers available")
+
+// Options configures a Mirror.
+type Options struct {
+	Percentage  float64       // share of requests mirrored in percent, (0, 100]
+	MaxBodySize int           // request bodies buffered at most, larger requests are not mirrored; 1 MiB by default
+	Timeout     time.Duration // timeout of every shadow request, 10s by default
+	MaxInFlight int           // shadow requests in flight at most, further ones are dropped; 100 by default
+}
+
+// Mirror sends copies of requests to a shadow pool.
+type Mirror struct {
+	pool     *pool.Pool
+	opts     Options
+	inFlight chan struct{}
+
+	mirrored atomic.Int64
+	skipped  atomic.Int64
+	dropped  atomic.Int64
+
+	mu       sync.Mutex
+	errors   int64
+	statuses map[int]int64
+	latency  time.Duration // sum over every answered shadow request
+	answered int64
+	maxLat   time.Duration
+}
+
+// New creates a mirror sending to the servers of p.
+func New(p *pool.Pool, opts Options) *Mirror {
+	if opts.MaxBodySize <= 0 {
+		opts.MaxBodySize = 1 << 20
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.MaxInFlight < 1 {
+		opts.MaxInFlight = 100
+	}
+	return &Mirror{
+		pool:     p,
+		opts:     opts,
+		inFlight: make(chan struct{}, opts.MaxInFlight),
+		statuses: make(map[int]int64),
+	}
+}
+
+// Pool returns the shadow pool.
+func (m *Mirror) Pool() *pool.Pool {
+	return m.pool
+}
+
+// Sample decides whether r is mirrored. Upgrade requests (e.g. WebSockets)
+// are never mirrored.
+func (m *Mirror) Sample(r *http.Request) bool {
+	if r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	return m.opts.Percentage >= 100 || rand.Float64()*100 < m.opts.Percentage
+}
+
+// Shadow is the copy of a single request.
+type Shadow struct {
+	m    *Mirror
+	req  *http.Request
+	body *bodyBuffer
+}
+
+// Capture copies r for the shadow pool. The returned request must be served
+// instead of r, so its body is buffered while the primary pool reads it, and
+// Send called once it was served.
+func (m *Mirror) Capture(r *http.Request) (*Shadow, *http.Request) {
+	s := &Shadow{m: m, req: r.Clone(context.Background())}
+	if r.Body != nil && r.Body != http.NoBody {
+		s.body = &bodyBuffer{max: m.opts.MaxBodySize}
+		r = r.Clone(r.Context())
+		r.Body = &teeBody{ReadCloser: r.Body, buf: s.body}
+	}
+	return s, r
+}
+
+// Send sends the shadow request in the background. Requests whose body was
+// too large or not read completely by the primary pool are skipped.
+func (s *Shadow) Send() {
+	m := s.m
+	req := s.req
+	if s.body != nil {
+		body, ok := s.body.bytes()
+		if !ok {
+			m.skipped.Add(1)
+			return
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	} else {
+		req.Body = http.NoBody
+	}
+	select {
+	case m.inFlight <- struct{}{}:
+	default:
+		if n := m.dropped.Add(1); n%1000 == 1 {
+			log.WithFields(log.Fields{"dropped": n}).Warn("Too many shadow requests in flight, dropping")
+		}
+		return
+	}
+	m.mirrored.Add(1)
+	go func() {
+		defer func() { <-m.inFlight }()
+		m.send(req)
+	}()
+}
+
+func (m *Mirror) send(req *http.Request) {
+	srv := m.pool.Next()
+	if srv == nil {
+		m.record("", 0, errNoServers, 0)
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), m.opts.Timeout)
+	defer cancel()
+	// Proxy errors are recorded on the attempt instead of being answered
+	ctx, attempt := pool.WithAttempt(ctx)
+	w := &discardWriter{header: http.Header{}}
+	start := time.Now()
+	srv.Serve(w, req.WithContext(ctx))
+	status := w.status
+	if status == 0 && attempt.Err == nil {
+		status = http.StatusOK
+	}
+	m.record(srv.Name(), status, attempt.Err, time.Since(start))
+}
+
+func (m *Mirror) record(server string, status int, err error, latency time.Duration) {
+	m.mu.Lock()
+	if err != nil || status >= 500 {
+		m.errors++
+	}
+	if err == nil {
+		m.statuses[status]++
+		m.answered++
+		m.latency += latency
+		m.maxLat = max(m.maxLat, latency)
+	}
+	m.mu.Unlock()
+
+	fields := log.Fields{"shadow": server, "status": status, "latency": latency}
+	if err != nil {
+		log.WithFields(fields).Warnf("Shadow request failed: %v", err)
+		return
+	}
+	log.WithFields(fields).Debug("Shadow request answered")
+}
+
+// Stats are the shadow pool's counters, reported apart from the primary pool.
+type Stats struct {
+	Percentage    float64          `json:"percentage"`
+	Mirrored      int64            `json:"mirrored"` // shadow requests sent
+	Errors        int64            `json:"errors"`   // failed shadow requests and 5xx responses
+	Skipped       int64            `json:"skipped"`  // bodies too large or not read completely
+	Dropped       int64            `json:"dropped"`  // too many shadow requests in flight
+	Statuses      map[string]int64 `json:"statuses"`
+	LatencyMeanMs float64          `json:"latency_mean_ms"`
+	LatencyMaxMs  float64          `json:"latency_max_ms"`
+	Servers       []pool.Status    `json:"servers"`
+}
+
+// Stats returns the current counters.
+func (m *Mirror) Stats() Stats {
+	st := Stats{
+		Percentage: m.opts.Percentage,
+		Mirrored:   m.mirrored.Load(),
+		Skipped:    m.skipped.Load(),
+		Dropped:    m.dropped.Load(),
+		Statuses:   map[string]int64{},
+		Servers:    []pool.Status{},
+	}
+	m.mu.Lock()
+	st.Errors = m.errors
+	for code, n := range m.statuses {
+		st.Statuses[strconv.Itoa(code)] = n
+	}
+	if m.answered > 0 {
+		st.LatencyMeanMs = ms(m.latency / time.Duration(m.answered))
+	}
+	st.LatencyMaxMs = ms(m.maxLat)
+	m.mu.Unlock()
+	for _, s := range m.pool.Servers() {
+		st.Servers = append(st.Servers, s.Status())
+	}
+	return st
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// bodyBuffer keeps a request body of up to max bytes. The transport may
+// still be reading the body when the primary response is served, so it is
+// guarded by mu.
+type bodyBuffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+	complete  bool // the whole body was read
+}
+
+func (b *bodyBuffer) write(p []byte, eof bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(p) > 0 && !b.truncated {
+		if b.buf.Len()+len(p) > b.max {
+			b.truncated = true
+			b.buf.Reset()
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	if eof {
+		b.complete = true
+	}
+}
+
+// bytes returns a copy of the body, false when it was too large or not read completely.
+func (b *bodyBuffer) bytes() ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.truncated || !b.complete {
+		return nil, false
+	}
+	return bytes.Clone(b.buf.Bytes()), true
+}
+
+// teeBody copies the request body into the shadow request as the primary pool reads it.
+type teeBody struct {
+	io.ReadCloser
+	buf *bodyBuffer
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	t.buf.write(p[:n], err == io.EOF)
+	return n, err
+}
+
+// discardWriter counts the shadow response and throws it away.
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) WriteHeader(code int) {
+	if w.status == 0 && code >= 200 {
+		w.status = code
+	}
+}
+
+func (w *discardWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return len(p), nil
+}
@@ -0,0 +1,207 @@
+package pool
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/samsyntax/go-lb/config"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// grpcOutlierThreshold is the amount of consecutive server-side failures
+// before a server is ejected.
+const grpcOutlierThreshold = 5
+
+var errGRPCRetry = errors.New("retryable grpc status")
+
+// grpcState holds the per-server state used in gRPC mode.
+type grpcState struct {
+	conn     *grpc.ClientConn // connection used for the standard health checking protocol
+	closed   bool             // set once the server left the pool, conn isn't opened again
+	failures int              // consecutive calls that ended with a server-side status
+}
+
+// Attempt is attached to the context of a proxied call that may still be
+// retried, so proxy errors are recorded instead of written to the client.
+type Attempt struct {
+	Err error
+}
+
+type attemptKey struct{}
+
+// WithAttempt returns a context marking the call as an attempt that may be retried.
+func WithAttempt(ctx context.Context) (context.Context, *Attempt) {
+	a := &Attempt{}
+	return context.WithValue(ctx, attemptKey{}, a), a
+}
+
+func attemptFrom(ctx context.Context) *Attempt {
+	a, _ := ctx.Value(attemptKey{}).(*Attempt)
+	return a
+}
+
+// IsGRPCRequest reports whether r is a gRPC call.
+func IsGRPCRequest(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// GRPCStatus reads grpc-status from a header map, which holds it either as
+// a header (trailers-only responses) or as a trailer copied by the proxy.
+func GRPCStatus(h http.Header) (codes.Code, bool) {
+	v := h.Get("Grpc-Status")
+	if v == "" {
+		v = h.Get(http.TrailerPrefix + "Grpc-Status")
+	}
+	if v == "" {
+		return codes.OK, false
+	}
+	c, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return codes.Unknown, true
+	}
+	return codes.Code(c), true
+}
+
+// grpcRetryable reports whether a call ending with code may be sent to another server.
+func grpcRetryable(code codes.Code) bool {
+	return code == codes.Unavailable
+}
+
+// grpcServerFailure reports whether code points at the server rather than the call.
+func grpcServerFailure(code codes.Code) bool {
+	switch code {
+	case codes.Unavailable, codes.Internal, codes.Unknown, codes.DataLoss:
+		return true
+	}
+	return false
+}
+
+// WriteGRPCError answers a call with a trailers-only gRPC error.
+func WriteGRPCError(w http.ResponseWriter, code codes.Code, msg string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(int(code)))
+	w.Header().Set("Grpc-Message", msg)
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcModifyResponse turns a retryable trailers-only response into a proxy
+// error while the call can still be retried, before anything reaches the client.
+func grpcModifyResponse(res *http.Response) error {
+	if attemptFrom(res.Request.Context()) == nil {
+		return nil
+	}
+	if code, ok := GRPCStatus(res.Header); ok && grpcRetryable(code) {
+		res.Body.Close()
+		return fmt.Errorf("%w: %s", errGRPCRetry, code)
+	}
+	return nil
+}
+
+// EnableGRPC reaches the server over HTTP/2 and checks it with the gRPC
+// health checking protocol.
+func (s *Server) EnableGRPC() {
+	if p := grpcProtocol(s.addr, s.protocol); p != s.protocol {
+		s.setProtocol(p)
+	}
+	s.grpc = &grpcState{}
+}
+
+// grpcProtocol returns the protocol a server at addr configured with
+// protocol is reached with in gRPC mode: HTTP/1 servers are upgraded to h2
+// or h2c by the scheme of addr.
+func grpcProtocol(addr, protocol string) string {
+	if protocol != config.ProtocolHTTP1 {
+		return protocol
+	}
+	if strings.HasPrefix(addr, "https://") {
+		return config.ProtocolH2
+	}
+	return config.ProtocolH2C
+}
+
+// healthConn returns the connection health checks are sent over, created
+// on first use. Checks of a server can overlap, so it is created under s.mu.
+func (s *Server) healthConn() (*grpc.ClientConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.grpc.conn != nil {
+		return s.grpc.conn, nil
+	}
+	if s.grpc.closed {
+		return nil, errors.New("server was removed from the pool")
+	}
+	u, err := url.Parse(s.addr)
+	if err != nil {
+		return nil, err
+	}
+	creds := insecure.NewCredentials()
+	if s.protocol == config.ProtocolH2 {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+	// NewClient doesn't connect yet, the lock is held briefly
+	conn, err := grpc.NewClient(u.Host, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	s.grpc.conn = conn
+	return conn, nil
+}
+
+// closeHealthConn closes the health check connection of a server that left
+// the pool. Checks still running fail instead of opening a new one.
+func (s *Server) closeHealthConn() {
+	if s.grpc == nil {
+		return
+	}
+	s.mu.Lock()
+	conn := s.grpc.conn
+	s.grpc.conn, s.grpc.closed = nil, true
+	s.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+func (s *Server) checkGRPCHealth() error {
+	conn, err := s.healthConn()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		return err
+	}
+	if res.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("health status %s", res.GetStatus())
+	}
+	return nil
+}
+
+// RecordGRPC feeds the outcome of a call into passive outlier detection.
+func (s *Server) RecordGRPC(code codes.Code) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !grpcServerFailure(code) {
+		s.grpc.failures = 0
+		return
+	}
+	s.grpc.failures++
+	if s.grpc.failures >= grpcOutlierThreshold && s.alive {
+		s.alive = false
+		log.WithFields(log.Fields{"[Status]": "ejected", "code": code.String()}).Warnf("Server %s - addr: %s\n", s.name, s.addr)
+	}
+}
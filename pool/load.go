@@ -0,0 +1,37 @@
+package pool
+
+import (
+	"strconv"
+
+	"github.com/samsyntax/go-lb/config"
+)
+
+// Load creates the servers described by specs, named "Server 0", "Server 1"...
+func Load(specs []config.ServerConfig) ([]*Server, error) {
+	res := make([]*Server, 0, len(specs))
+	for k, s := range specs {
+		srv, err := FromConfig(s, WithName("Server "+strconv.Itoa(k)))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, srv)
+	}
+	return res, nil
+}
+
+// LoadFile reads a servers file in json, yaml or toml format, creates its
+// servers and runs a first health check on each of them.
+func LoadFile(path string) ([]*Server, error) {
+	specs, err := config.LoadServersFile(path)
+	if err != nil {
+		return []*Server{}, err
+	}
+	res, err := Load(specs)
+	if err != nil {
+		return []*Server{}, err
+	}
+	for _, s := range res {
+		s.IsAlive()
+	}
+	return res, nil
+}
@@ -0,0 +1,290 @@
+package pool
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/samsyntax/go-lb/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// Pool is the set of servers a balancer forwards to. It is safe for
+// concurrent use and can be updated while requests are served.
+type Pool struct {
+	roundRobinCount int
+	groupCounts     map[string]*int // round robin position within every group
+	servers         []*Server
+	weighted        bool
+	grpc            bool                   // servers are reached over HTTP/2 and checked with gRPC health checks
+	tcp             bool                   // servers are checked by dialing them
+	transport       config.TransportConfig // defaults of the transport settings of added servers
+	mu              sync.Mutex
+}
+
+// New creates a pool over servers, using weighted round robin when weighted is set.
+func New(servers []*Server, weighted bool) *Pool {
+	return &Pool{
+		roundRobinCount: 0,
+		servers:         servers,
+		weighted:        weighted,
+	}
+}
+
+// EnableGRPC switches every current and future server into gRPC mode.
+func (p *Pool) EnableGRPC() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.grpc = true
+	for _, s := range p.servers {
+		s.EnableGRPC()
+	}
+}
+
+// EnableTCP switches every current and future server into TCP mode.
+func (p *Pool) EnableTCP() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tcp = true
+	for _, s := range p.servers {
+		s.EnableTCP()
+	}
+}
+
+// SetTransport sets the transport settings of servers added by
+// UpdateServers. Settings their specs have replace these.
+func (p *Pool) SetTransport(t config.TransportConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.transport = t
+}
+
+// Next picks the server for the next request, nil when the pool is empty.
+func (p *Pool) Next() *Server {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pick(p.servers, &p.roundRobinCount)
+}
+
+// NextIn picks the server for the next request among the servers of group,
+// nil when the group has no servers.
+func (p *Pool) NextIn(group string) *Server {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var servers []*Server
+	for _, s := range p.servers {
+		if s.Group() == group {
+			servers = append(servers, s)
+		}
+	}
+	if p.groupCounts == nil {
+		p.groupCounts = make(map[string]*int)
+	}
+	count, ok := p.groupCounts[group]
+	if !ok {
+		count = new(int)
+		p.groupCounts[group] = count
+	}
+	return p.pick(servers, count)
+}
+
+func (p *Pool) pick(servers []*Server, count *int) *Server {
+	if len(servers) == 0 {
+		return nil
+	}
+	if p.weighted {
+		return getWeightedServer(servers, count)
+	}
+	return getRoundRobinServer(servers, count)
+}
+
+func getWeightedServer(servers []*Server, count *int) *Server {
+	totalServers := len(servers)
+	for i := 0; i < totalServers; i++ {
+		server := servers[*count%totalServers]
+		if server.takeWeighted() {
+			return server
+		}
+		*count++
+	}
+	*count++
+	return servers[*count%totalServers]
+}
+
+func getRoundRobinServer(servers []*Server, count *int) *Server {
+	totalServers := len(servers)
+	for i := 0; i < totalServers; i++ {
+		server := servers[*count%totalServers]
+		*count++
+		if server.take() {
+			return server
+		}
+	}
+	return servers[*count%totalServers]
+}
+
+// take counts a request for s if it is in rotation. Health checks, drains
+// and gRPC outlier detection change the state concurrently, under s.mu.
+func (s *Server) take() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.alive || s.draining {
+		return false
+	}
+	s.reqAmt++
+	return true
+}
+
+// takeWeighted is take for weighted round robin: s also needs weight left
+// in the current round, otherwise its round starts over.
+func (s *Server) takeWeighted() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current < s.weight && s.alive && !s.draining {
+		s.current++
+		s.reqAmt++
+		return true
+	}
+	s.current = 0
+	return false
+}
+
+// Available reports whether any server is alive and not draining.
+func (p *Pool) Available() bool {
+	for _, s := range p.Servers() {
+		if s.Alive() && !s.Draining() {
+			return true
+		}
+	}
+	return false
+}
+
+// Servers returns a snapshot of the current pool.
+func (p *Pool) Servers() []*Server {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*Server(nil), p.servers...)
+}
+
+// UpdateServers reconciles the pool with specs. Servers whose address is
+// still present are kept as they are, so their stats and health survive,
+// unless their protocol, PROXY protocol or transport changed: those are
+// rebuilt. Servers leaving the pool have their gRPC health connection closed.
+func (p *Pool) UpdateServers(specs []config.ServerConfig) error {
+	p.mu.Lock()
+	existing := make(map[string]*Server, len(p.servers))
+	for _, s := range p.servers {
+		existing[s.addr] = s
+	}
+	grpc, tcp, transport := p.grpc, p.tcp, p.transport
+	p.mu.Unlock()
+
+	next := make([]*Server, 0, len(specs))
+	var added, kept, rebuilt int
+	for _, spec := range specs {
+		spec.Transport = transport.Merge(spec.Transport)
+		if s, ok := existing[spec.Address]; ok && !s.reconfigured(spec, grpc) {
+			s.mu.Lock()
+			s.weight = spec.Weight
+			if s.weight == 0 {
+				s.weight = 1
+			}
+			s.group = spec.Group
+			s.mu.Unlock()
+			delete(existing, spec.Address)
+			next = append(next, s)
+			kept++
+			continue
+		}
+		s, err := FromConfig(spec)
+		if err != nil {
+			return err
+		}
+		if grpc {
+			s.EnableGRPC()
+		}
+		if tcp {
+			s.EnableTCP()
+		}
+		next = append(next, s)
+		if _, ok := existing[spec.Address]; ok {
+			// Replaced by s, the old server is closed below like removed ones
+			log.WithFields(log.Fields{"server": spec.Address}).Info("Rebuilt server with its new protocol or transport")
+			rebuilt++
+			continue
+		}
+		added++
+	}
+
+	p.mu.Lock()
+	p.servers = next
+	p.mu.Unlock()
+	for addr, s := range existing {
+		s.closeHealthConn()
+		if p.Find(addr) == nil {
+			log.WithFields(log.Fields{"server": addr}).Info("Removed server from pool")
+		}
+	}
+	if added > 0 || len(existing) > 0 {
+		log.WithFields(log.Fields{"added": added, "kept": kept, "rebuilt": rebuilt, "removed": len(existing) - rebuilt}).Info("Server pool updated")
+	}
+	return nil
+}
+
+// Find returns the server with the given address or name, nil when there is none.
+func (p *Pool) Find(server string) *Server {
+	for _, s := range p.Servers() {
+		if s.addr == server || s.name == server {
+			return s
+		}
+	}
+	return nil
+}
+
+// CheckResult is the outcome of a single health check.
+type CheckResult struct {
+	Server   *Server
+	Err      error // nil when the server is healthy
+	Duration time.Duration
+}
+
+// CheckAll runs a health check on every server in the pool, waits for them
+// to finish and returns the results in pool order.
+func (p *Pool) CheckAll() []CheckResult {
+	servers := p.Servers()
+	res := make([]CheckResult, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, s *Server) {
+			defer wg.Done()
+			start := time.Now()
+			err := s.Check()
+			res[i] = CheckResult{Server: s, Err: err, Duration: time.Since(start)}
+		}(i, server)
+	}
+	wg.Wait()
+	return res
+}
+
+// HealthCheck checks every server in the pool each interval until ctx is done.
+func (p *Pool) HealthCheck(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			// Check the current pool on every tick so discovered servers are included
+			for _, server := range p.Servers() {
+				go func(s *Server) {
+					log.WithFields(log.Fields{"[ReqAmt]": s.Requests()}).Infof("Amount of requestes forwarded to %s ", s.addr)
+					s.IsAlive()
+				}(server)
+			}
+		}
+	}()
+}
@@ -0,0 +1,419 @@
+// Package pool holds the upstream servers a balancer forwards to: their
+// reverse proxies and transports, HTTP, gRPC and TCP health checks, and the
+// round robin / weighted round robin selection over the pool.
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/samsyntax/go-lb/config"
+	"github.com/samsyntax/go-lb/proxyproto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+)
+
+type ServerInterface interface {
+	Address() string
+	IsAlive() bool
+	Serve(w http.ResponseWriter, r *http.Request)
+}
+
+type Server struct {
+	addr      string                 // address of the server
+	protocol  string                 // protocol used to talk to the upstream: http1, h2 or h2c
+	proxy     *httputil.ReverseProxy // reverse porxy used to forward requests
+	name      string                 // name of the server
+	weight    int                    // weight used for weighted round robin
+	current   int                    // current counter based on weight (if weight of the server is 3 - 3 requests will be sent to this server in this iteration)
+	mu        sync.Mutex             // mutex to safely modify instances
+	alive     bool                   // status of the server (wether it's online or not)
+	reqAmt    int                    // amount of requests send to the server
+	grpc      *grpcState             // set when the server is balanced in gRPC mode
+	tcp       bool                   // set when the server is balanced in TCP mode
+	sendProxy string                 // PROXY protocol version sent to the server in TCP mode, empty to disable
+	health    string                 // path requested by HTTP health checks, the server address itself when empty
+	group     string                 // server group for traffic splitting, empty when ungrouped
+	draining  bool                   // set while the server is drained, it gets no new requests
+	active    atomic.Int64           // requests or connections in flight
+	transport TransportOptions       // tuning of the connections to the upstream
+	conns     connStats              // connections opened by the transport
+	warming   atomic.Bool            // set while connections are pre-warmed
+}
+
+// Option configures a Server created with NewServer.
+type Option func(*Server)
+
+// WithName sets the name the server is logged under, its address by default.
+func WithName(name string) Option {
+	return func(s *Server) { s.name = name }
+}
+
+// WithProtocol sets the protocol used to talk to the upstream (http1, h2 or h2c).
+func WithProtocol(protocol string) Option {
+	return func(s *Server) {
+		if protocol != "" {
+			s.protocol = protocol
+		}
+	}
+}
+
+// WithSendProxy makes TCP mode send a PROXY protocol header (v1 or v2) to the upstream.
+func WithSendProxy(version string) Option {
+	return func(s *Server) { s.sendProxy = version }
+}
+
+// WithHealthPath makes HTTP health checks request path instead of the server address itself.
+func WithHealthPath(path string) Option {
+	return func(s *Server) { s.health = path }
+}
+
+// WithTransport tunes the connections to the upstream.
+func WithTransport(opts TransportOptions) Option {
+	return func(s *Server) { s.transport = opts }
+}
+
+// WithGroup puts the server into a group traffic can be split between.
+func WithGroup(group string) Option {
+	return func(s *Server) { s.group = group }
+}
+
+// NewServer creates a server forwarding to addr. A weight below 1 is treated as 1.
+func NewServer(addr string, weight int, opts ...Option) (*Server, error) {
+	serverUrl, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("parse server address: %w", err)
+	}
+	if weight < 1 {
+		weight = 1
+	}
+	srv := &Server{
+		addr:     addr,
+		protocol: config.ProtocolHTTP1,
+		name:     addr,
+		weight:   weight,
+		alive:    true,
+	}
+	for _, opt := range opts {
+		opt(srv)
+	}
+	if !config.ValidProtocol(srv.protocol) {
+		return nil, fmt.Errorf("server %s: unknown protocol %q", addr, srv.protocol)
+	}
+	if !proxyproto.ValidVersion(srv.sendProxy) {
+		return nil, fmt.Errorf("server %s: unknown PROXY protocol version %q", addr, srv.sendProxy)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(serverUrl)
+	proxy.ModifyResponse = grpcModifyResponse
+	proxy.ErrorHandler = srv.proxyError
+	srv.proxy = proxy
+	srv.setProtocol(srv.protocol)
+	return srv, nil
+}
+
+// FromConfig creates a server from a config entry.
+func FromConfig(spec config.ServerConfig, opts ...Option) (*Server, error) {
+	opts = append([]Option{
+		WithProtocol(spec.Protocol),
+		WithSendProxy(spec.SendProxyProtocol),
+		WithGroup(spec.Group),
+		WithTransport(TransportFromConfig(spec.Transport)),
+	}, opts...)
+	return NewServer(spec.Address, spec.Weight, opts...)
+}
+
+// reconfigured reports whether spec, with the pool's transport merged in,
+// sets up s differently from how it was created. Protocol, PROXY protocol and
+// transport are fixed once the proxy is built, so such servers are rebuilt.
+func (s *Server) reconfigured(spec config.ServerConfig, grpc bool) bool {
+	protocol := spec.Protocol
+	if protocol == "" {
+		protocol = config.ProtocolHTTP1
+	}
+	if grpc {
+		protocol = grpcProtocol(s.addr, protocol)
+	}
+	return protocol != s.protocol || spec.SendProxyProtocol != s.sendProxy || TransportFromConfig(spec.Transport) != s.transport
+}
+
+func (s *Server) Address() string {
+	return s.addr
+}
+
+func (s *Server) Name() string {
+	return s.name
+}
+
+func (s *Server) Protocol() string {
+	return s.protocol
+}
+
+// SendProxy returns the PROXY protocol version sent to the server in TCP mode.
+func (s *Server) SendProxy() string {
+	return s.sendProxy
+}
+
+// Group returns the server's group, empty when it is ungrouped.
+func (s *Server) Group() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.group
+}
+
+func (s *Server) Weight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.weight
+}
+
+// Alive returns the result of the last health check without running a new one.
+func (s *Server) Alive() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.alive
+}
+
+// Requests returns the amount of requests forwarded to the server.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reqAmt
+}
+
+func (s *Server) IsAlive() bool {
+	return s.Check() == nil
+}
+
+// Check runs a health check, updates the server's status and returns why
+// the server is unhealthy, nil when it is healthy.
+func (s *Server) Check() error {
+	var err error
+	check := "http"
+	switch {
+	case s.grpc != nil:
+		check = "grpc"
+		err = s.checkGRPCHealth()
+	case s.tcp:
+		check = "tcp"
+		err = s.checkTCP()
+	default:
+		err = s.checkHTTP()
+	}
+	s.mu.Lock()
+	s.alive = err == nil
+	if s.grpc != nil && err == nil {
+		s.grpc.failures = 0
+	}
+	s.mu.Unlock()
+	if err != nil {
+		log.WithFields(log.Fields{"[Status]": "offline", "check": check}).Printf("Server %s - addr: %s\n", s.name, s.addr)
+		return err
+	}
+	log.WithFields(log.Fields{"[Status]": "online", "check": check}).Printf("Server %s - addr: %s\n", s.name, s.addr)
+	if check == "http" {
+		go s.prewarm()
+	}
+	return nil
+}
+
+func (s *Server) checkHTTP() error {
+	client := http.Client{
+		Timeout:   5 * time.Second,
+		Transport: s.proxy.Transport,
+	}
+	res, err := client.Get(s.healthTarget())
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
+
+func (s *Server) healthTarget() string {
+	if s.health == "" {
+		return s.addr
+	}
+	return strings.TrimSuffix(s.addr, "/") + s.health
+}
+
+// prewarm opens connections until the server has as many as the transport
+// asks for. It sends as many concurrent requests to the health check target
+// and only reads their responses once all of them arrived: every request
+// holds a connection of its own, idle ones are reused and the rest dialed.
+func (s *Server) prewarm() {
+	opts := s.transport.withDefaults()
+	want := min(opts.Prewarm, opts.MaxIdleConns) // more would be closed again
+	if opts.MaxConns > 0 {
+		want = min(want, opts.MaxConns)
+	}
+	if int(s.conns.open.Load()) >= want || s.protocol != config.ProtocolHTTP1 || !s.warming.CompareAndSwap(false, true) {
+		return
+	}
+	defer s.warming.Store(false)
+	client := http.Client{
+		Timeout:   5 * time.Second,
+		Transport: s.proxy.Transport,
+	}
+	var done, received sync.WaitGroup
+	done.Add(want)
+	received.Add(want)
+	for i := 0; i < want; i++ {
+		go func() {
+			defer done.Done()
+			res, err := client.Get(s.healthTarget())
+			received.Done()
+			if err != nil {
+				return
+			}
+			received.Wait()
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}()
+	}
+	done.Wait()
+	log.WithFields(log.Fields{"server": s.name, "open": s.conns.open.Load()}).Debug("Pre-warmed connections")
+}
+
+// Drain stops sending new requests to the server while requests in flight
+// complete. Drain(false) puts the server back into rotation.
+func (s *Server) Drain(drain bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.draining = drain
+}
+
+func (s *Server) Draining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// Active returns the amount of requests or connections currently in flight.
+func (s *Server) Active() int {
+	return int(s.active.Load())
+}
+
+// Status is a point-in-time view of a server, as reported by the admin API.
+type Status struct {
+	Name     string    `json:"name"`
+	Address  string    `json:"address"`
+	Protocol string    `json:"protocol"`
+	Weight   int       `json:"weight"`
+	Group    string    `json:"group,omitempty"`
+	Alive    bool      `json:"alive"`
+	Draining bool      `json:"draining"`
+	Requests int       `json:"requests"`
+	Active   int       `json:"active"`
+	Conns    ConnStats `json:"conns"`
+}
+
+func (s *Server) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	maxConns := 0
+	if s.protocol == config.ProtocolHTTP1 {
+		maxConns = s.transport.MaxConns
+	}
+	return Status{
+		Name:     s.name,
+		Address:  s.addr,
+		Protocol: s.protocol,
+		Weight:   s.weight,
+		Group:    s.group,
+		Alive:    s.alive,
+		Draining: s.draining,
+		Requests: s.reqAmt,
+		Active:   int(s.active.Load()),
+		Conns: ConnStats{
+			Open:   int(s.conns.open.Load()),
+			Max:    maxConns,
+			Dialed: s.conns.dialed.Load(),
+			Reused: s.conns.reused.Load(),
+		},
+	}
+}
+
+// Track counts a request or connection as in flight until the returned func is called.
+func (s *Server) Track() func() {
+	s.active.Add(1)
+	return func() { s.active.Add(-1) }
+}
+
+func (s *Server) Serve(w http.ResponseWriter, r *http.Request) {
+	defer s.Track()()
+	s.proxy.ServeHTTP(w, r.WithContext(s.conns.trace(r.Context())))
+}
+
+func (s *Server) setProtocol(protocol string) {
+	s.protocol = protocol
+	s.proxy.Transport = newTransport(protocol, s.transport, &s.conns)
+	if protocol != config.ProtocolHTTP1 {
+		// Flush every write immediately so streamed responses (gRPC, SSE)
+		// are not held back by the proxy's buffering.
+		s.proxy.FlushInterval = -1
+	}
+}
+
+// proxyError replaces the reverse proxy's default error handler. Failures on
+// attempts that will be retried are recorded instead of answered.
+func (s *Server) proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	if a := attemptFrom(r.Context()); a != nil {
+		a.Err = err
+		return
+	}
+	status, code := ErrorStatus(r.Context(), err)
+	entry := log.WithFields(log.Fields{"server": s.addr, "status": status})
+	if status == http.StatusBadGateway {
+		entry.Errorf("Proxy error: %v", err)
+	} else {
+		entry.Warnf("Proxy error: %v", err)
+	}
+	if status == http.StatusRequestTimeout {
+		w.Header().Set("Connection", "close")
+	}
+	if IsGRPCRequest(r) {
+		msg := "upstream unavailable"
+		if code != codes.Unavailable {
+			msg = http.StatusText(status)
+		}
+		WriteGRPCError(w, code, msg)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+var (
+	// ErrBodyTimeout is returned by request bodies the client didn't send in time.
+	ErrBodyTimeout = errors.New("request body timeout")
+	// ErrUpstreamTimeout is the cause of requests canceled because the server didn't answer in time.
+	ErrUpstreamTimeout = errors.New("upstream timeout")
+)
+
+// ErrorStatus returns the status, and the code for gRPC calls, answering a
+// request that failed with err: 413 for request bodies over their limit, 408
+// for bodies not received in time, 504 when ctx was canceled with
+// ErrUpstreamTimeout and 502 for every other failure.
+func ErrorStatus(ctx context.Context, err error) (int, codes.Code) {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge, codes.ResourceExhausted
+	case errors.Is(err, ErrBodyTimeout):
+		return http.StatusRequestTimeout, codes.DeadlineExceeded
+	case errors.Is(context.Cause(ctx), ErrUpstreamTimeout):
+		return http.StatusGatewayTimeout, codes.DeadlineExceeded
+	}
+	return http.StatusBadGateway, codes.Unavailable
+}
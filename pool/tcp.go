@@ -0,0 +1,33 @@
+package pool
+
+import (
+	"net"
+	"net/url"
+	"time"
+)
+
+// DialTimeout bounds TCP health checks and upstream dials in TCP mode.
+const DialTimeout = 5 * time.Second
+
+// HostPort returns the host:port part of a server address. Addresses may be
+// given as URLs (http://host:port, tcp://host:port) or as a bare host:port.
+func HostPort(addr string) string {
+	if u, err := url.Parse(addr); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return addr
+}
+
+// EnableTCP checks the server by dialing it instead of sending HTTP requests.
+func (s *Server) EnableTCP() {
+	s.tcp = true
+}
+
+// checkTCP checks a server in TCP mode by opening a connection to it.
+func (s *Server) checkTCP() error {
+	conn, err := net.DialTimeout("tcp", HostPort(s.addr), DialTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
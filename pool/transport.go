@@ -0,0 +1,155 @@
+package pool
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/samsyntax/go-lb/config"
+	"golang.org/x/net/http2"
+)
+
+// TransportOptions tune the connections to a server. Zero fields keep the
+// defaults, which match Go's default transport. MaxIdleConns, MaxConns and
+// Prewarm only apply to HTTP/1: HTTP/2 multiplexes requests over one connection.
+type TransportOptions struct {
+	MaxIdleConns int           // idle connections kept open, 100 by default, negative to close connections after each request
+	MaxConns     int           // open connections at most, 0 for no limit; further requests wait for a free connection
+	IdleTimeout  time.Duration // idle connections are closed after, 90s by default
+	KeepAlive    time.Duration // TCP keep-alive probe interval, 30s by default, negative to disable probes
+	DialTimeout  time.Duration // 30s by default
+	Prewarm      int           // connections opened after each successful health check, so requests find them ready
+}
+
+// TransportFromConfig converts transport settings from the config.
+func TransportFromConfig(c config.TransportConfig) TransportOptions {
+	return TransportOptions{
+		MaxIdleConns: c.MaxIdleConns,
+		MaxConns:     c.MaxConns,
+		IdleTimeout:  c.IdleTimeout.Std(),
+		KeepAlive:    c.KeepAlive.Std(),
+		DialTimeout:  c.DialTimeout.Std(),
+		Prewarm:      c.Prewarm,
+	}
+}
+
+func (o TransportOptions) withDefaults() TransportOptions {
+	if o.MaxIdleConns == 0 {
+		o.MaxIdleConns = 100
+	}
+	if o.IdleTimeout == 0 {
+		o.IdleTimeout = 90 * time.Second
+	}
+	if o.KeepAlive == 0 {
+		o.KeepAlive = 30 * time.Second
+	}
+	if o.DialTimeout == 0 {
+		o.DialTimeout = 30 * time.Second
+	}
+	return o
+}
+
+// NewUpstreamTransport returns the round tripper used by a server's reverse proxy.
+func NewUpstreamTransport(protocol string, opts TransportOptions) http.RoundTripper {
+	return newTransport(protocol, opts, nil)
+}
+
+// newTransport is NewUpstreamTransport counting the connections it opens in
+// conns, unless conns is nil.
+func newTransport(protocol string, opts TransportOptions, conns *connStats) http.RoundTripper {
+	opts = opts.withDefaults()
+	dialer := &net.Dialer{Timeout: opts.DialTimeout, KeepAlive: opts.KeepAlive}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dialer.DialContext(ctx, network, addr)
+		if err != nil || conns == nil {
+			return c, err
+		}
+		return conns.track(c), nil
+	}
+	switch protocol {
+	case config.ProtocolH2:
+		return &http2.Transport{
+			IdleConnTimeout: opts.IdleTimeout,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				c, err := dial(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				tc := tls.Client(c, cfg)
+				if err := tc.HandshakeContext(ctx); err != nil {
+					c.Close()
+					return nil, err
+				}
+				return tc, nil
+			},
+		}
+	case config.ProtocolH2C:
+		return &http2.Transport{
+			AllowHTTP:       true,
+			IdleConnTimeout: opts.IdleTimeout,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+		}
+	default:
+		// A custom dialer without ForceAttemptHTTP2 keeps TLS connections on HTTP/1.1
+		return &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dial,
+			MaxIdleConns:          max(opts.MaxIdleConns, 0),
+			MaxIdleConnsPerHost:   max(opts.MaxIdleConns, 0),
+			MaxConnsPerHost:       opts.MaxConns,
+			DisableKeepAlives:     opts.MaxIdleConns < 0,
+			IdleConnTimeout:       opts.IdleTimeout,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		}
+	}
+}
+
+// ConnStats reports the connections to a server.
+type ConnStats struct {
+	Open   int    `json:"open"`          // idle or in use
+	Max    int    `json:"max,omitempty"` // limit of open connections, 0 for none
+	Dialed uint64 `json:"dialed"`        // connections opened since the server was created
+	Reused uint64 `json:"reused"`        // requests sent over a connection opened for an earlier one
+}
+
+type connStats struct {
+	open           atomic.Int64
+	dialed, reused atomic.Uint64
+}
+
+func (cs *connStats) track(c net.Conn) net.Conn {
+	cs.open.Add(1)
+	cs.dialed.Add(1)
+	return &trackedConn{Conn: c, cs: cs}
+}
+
+// trace counts the requests of ctx sent over reused connections.
+func (cs *connStats) trace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				cs.reused.Add(1)
+			}
+		},
+	})
+}
+
+// trackedConn counts as open until it is closed.
+type trackedConn struct {
+	net.Conn
+	cs   *connStats
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { c.cs.open.Add(-1) })
+	return c.Conn.Close()
+}
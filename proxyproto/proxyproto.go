@@ -0,0 +1,289 @@
+// Package proxyproto implements the PROXY protocol (v1 and v2) used by L4
+// load balancers to pass on the original client address: a listener that
+// accepts headers from trusted sources and a writer for upstream connections.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PROXY protocol versions that can be sent to upstream servers
+const (
+	V1 = "v1"
+	V2 = "v2"
+)
+
+const proxyHeaderTimeout = 5 * time.Second
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errNotProxyHeader = errors.New("proxy protocol: missing header")
+
+// ValidVersion reports whether version is empty (disabled), v1 or v2.
+func ValidVersion(version string) bool {
+	return version == "" || version == V1 || version == V2
+}
+
+// ParseTrustedProxies turns a list of IPs and CIDRs into networks allowed to
+// send PROXY protocol headers.
+func ParseTrustedProxies(list []string) ([]*net.IPNet, error) {
+	res := make([]*net.IPNet, 0, len(list))
+	for _, item := range list {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			res = append(res, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", item, err)
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+func ipTrusted(addr net.Addr, trusted []*net.IPNet) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyListener accepts PROXY protocol v1/v2 headers from trusted sources and
+// reports the original client address as the connection's RemoteAddr.
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+// NewListener wraps l so connections from trusted networks must start with
+// a PROXY protocol header. Other connections are passed through untouched.
+func NewListener(l net.Listener, trusted []*net.IPNet) net.Listener {
+	return &proxyListener{Listener: l, trusted: trusted}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !ipTrusted(c.RemoteAddr(), l.trusted) {
+		return c, nil
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// proxyConn reads the header lazily so a slow client can't block Accept.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	src    net.Addr
+	dst    net.Addr
+	header error
+}
+
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.src, c.dst, c.header = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.header != nil {
+			log.WithFields(log.Fields{"peer": c.Conn.RemoteAddr().String()}).Warnf("Rejecting connection: %v", c.header)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.header != nil {
+		return 0, c.header
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// readProxyHeader consumes a v1 or v2 header. Nil addresses mean the sender
+// didn't relay a client (v1 UNKNOWN, v2 LOCAL) and the peer address applies.
+func readProxyHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if sig, err := r.Peek(6); err == nil && string(sig) == "PROXY " {
+		return readProxyHeaderV1(r)
+	}
+	return nil, nil, errNotProxyHeader
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	// The longest v1 header is 107 bytes including CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("proxy protocol v1: header too long")
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("proxy protocol v1: malformed header %q", line)
+	}
+	src, err := parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("proxy protocol v1: invalid address %s:%s", host, port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("proxy protocol v2: unsupported version %d", hdr[12]>>4)
+	}
+	cmd, family := hdr[12]&0x0f, hdr[13]
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	// LOCAL connections (e.g. health checks from the proxy itself) carry no client
+	if cmd == 0 {
+		return nil, nil, nil
+	}
+	if cmd != 1 {
+		return nil, nil, fmt.Errorf("proxy protocol v2: unknown command %d", cmd)
+	}
+	switch family >> 4 {
+	case 1: // AF_INET
+		if len(payload) < 12 {
+			return nil, nil, errors.New("proxy protocol v2: short ipv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))},
+			&net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}, nil
+	case 2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, nil, errors.New("proxy protocol v2: short ipv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))},
+			&net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}, nil
+	default:
+		// AF_UNSPEC and unix sockets don't carry a usable client address
+		return nil, nil, nil
+	}
+}
+
+// WriteHeader sends a PROXY protocol header describing a client
+// connection from src to dst.
+func WriteHeader(w io.Writer, version string, src, dst net.Addr) error {
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	if version == V1 {
+		if !sok || !dok {
+			_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+			return err
+		}
+		proto := "TCP4"
+		if s.IP.To4() == nil || d.IP.To4() == nil {
+			proto = "TCP6"
+		}
+		_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", proto, s.IP, d.IP, s.Port, d.Port)
+		return err
+	}
+
+	buf := bytes.NewBuffer(append([]byte{}, proxyV2Signature...))
+	if !sok || !dok {
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00}) // LOCAL, AF_UNSPEC
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+	var addrs []byte
+	family := byte(0x11) // AF_INET, STREAM
+	if s4, d4 := s.IP.To4(), d.IP.To4(); s4 != nil && d4 != nil {
+		addrs = append(append(addrs, s4...), d4...)
+	} else {
+		family = 0x21 // AF_INET6, STREAM
+		addrs = append(append(addrs, s.IP.To16()...), d.IP.To16()...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(s.Port))
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(d.Port))
+	buf.Write([]byte{0x21, family}) // version 2, PROXY
+	binary.Write(buf, binary.BigEndian, uint16(len(addrs)))
+	buf.Write(addrs)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,149 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"time"
+	"unicode/utf8"
+)
+
+// Capture records a single request while it is served.
+type Capture struct {
+	r     *Recorder
+	req   *http.Request
+	start time.Time
+	body  *limitedBuffer
+	w     *responseWriter
+}
+
+// Capture starts recording req. The returned writer and request must be used
+// to serve it, and Done called once it was served.
+func (r *Recorder) Capture(w http.ResponseWriter, req *http.Request) (*Capture, http.ResponseWriter, *http.Request) {
+	c := &Capture{r: r, req: req, start: time.Now()}
+	if r.opts.MaxBodySize >= 0 && req.Body != nil && req.Body != http.NoBody {
+		c.body = &limitedBuffer{max: r.opts.MaxBodySize}
+		req = req.Clone(req.Context())
+		req.Body = &teeBody{ReadCloser: req.Body, w: c.body}
+	}
+	c.w = &responseWriter{ResponseWriter: w}
+	if r.opts.Responses && r.opts.MaxBodySize >= 0 {
+		c.w.body = &limitedBuffer{max: r.opts.MaxBodySize}
+	}
+	return c, c.w, req
+}
+
+// Done queues the entry for the request, served by backend (empty when no
+// server was picked).
+func (c *Capture) Done(backend string) {
+	req := c.req
+	headers := c.r.headers(req.Header)
+	headers["Host"] = req.Host
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	status := c.w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	e := &Entry{
+		Time:      c.start.UTC(),
+		Method:    req.Method,
+		URL:       scheme + "://" + req.Host + req.URL.RequestURI(),
+		Path:      req.URL.RequestURI(),
+		Headers:   headers,
+		Backend:   backend,
+		Status:    status,
+		LatencyMs: float64(time.Since(c.start).Microseconds()) / 1000,
+	}
+	if c.body != nil {
+		e.Body, e.BodyEncoding = encodeBody(c.body.buf.Bytes())
+		e.BodyTruncated = c.body.truncated
+	}
+	if c.r.opts.Responses {
+		res := &Response{Headers: c.r.headers(c.w.Header())}
+		if c.w.body != nil {
+			res.Body, res.BodyEncoding = encodeBody(c.w.body.buf.Bytes())
+			res.BodyTruncated = c.w.body.truncated
+		}
+		e.Response = res
+	}
+	c.r.enqueue(e)
+}
+
+// encodeBody returns b as a string, base64 encoded when it isn't valid UTF-8.
+func encodeBody(b []byte) (string, string) {
+	if utf8.Valid(b) {
+		return string(b), ""
+	}
+	return base64.StdEncoding.EncodeToString(b), "base64"
+}
+
+// limitedBuffer keeps the first max bytes written to it and drops the rest.
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+// teeBody copies the request body into the recording as the proxy reads it.
+type teeBody struct {
+	io.ReadCloser
+	w io.Writer
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		t.w.Write(p[:n])
+	}
+	return n, err
+}
+
+// responseWriter captures the status and, optionally, the body of the response.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	body   *limitedBuffer
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	// Informational responses (1xx) are followed by the final status
+	if w.status == 0 && code >= 200 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.body != nil {
+		w.body.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush keeps streamed responses streaming while they are recorded.
+func (w *responseWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
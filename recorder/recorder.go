@@ -0,0 +1,154 @@
+// Package recorder writes sampled requests passing through the balancer to a
+// JSONL file. Every line can be replayed by the bench command, so production
+// traffic patterns can be reproduced against other backends.
+package recorder
+
+import (
+	"bufio"
+	"encoding/json"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Redacted replaces the value of redacted headers.
+const Redacted = "[REDACTED]"
+
+// queueSize bounds the entries waiting to be written. Entries are dropped
+// rather than slowing requests down when the file can't keep up.
+const queueSize = 1024
+
+// Entry is a single recorded request. Its method, path, headers and body
+// fields match the bench command's replay format.
+type Entry struct {
+	Time          time.Time         `json:"time"`
+	Method        string            `json:"method"`
+	URL           string            `json:"url"`
+	Path          string            `json:"path"` // path and query
+	Headers       map[string]string `json:"headers"`
+	Body          string            `json:"body,omitempty"`
+	BodyEncoding  string            `json:"body_encoding,omitempty"` // base64 for bodies that aren't valid UTF-8
+	BodyTruncated bool              `json:"body_truncated,omitempty"`
+	Backend       string            `json:"backend,omitempty"`
+	Status        int               `json:"status"`
+	LatencyMs     float64           `json:"latency_ms"`
+	Response      *Response         `json:"response,omitempty"`
+}
+
+// Response is the recorded response, only present when responses are recorded.
+type Response struct {
+	Headers       map[string]string `json:"headers"`
+	Body          string            `json:"body,omitempty"`
+	BodyEncoding  string            `json:"body_encoding,omitempty"`
+	BodyTruncated bool              `json:"body_truncated,omitempty"`
+}
+
+// Options configures a Recorder.
+type Options struct {
+	File          string   // JSONL file entries are appended to
+	SampleRate    float64  // share of requests recorded, (0, 1]
+	RedactHeaders []string // headers recorded as [REDACTED]
+	MaxBodySize   int      // bytes of each body recorded, -1 to skip bodies
+	Responses     bool     // record response headers and bodies too
+}
+
+// Recorder appends entries to a JSONL file from a background goroutine.
+type Recorder struct {
+	opts    Options
+	redact  map[string]bool
+	file    *os.File
+	queue   chan *Entry
+	done    chan struct{}
+	dropped atomic.Int64
+	mu      sync.RWMutex // guards queue against sends after Close
+	closed  bool
+}
+
+// New opens the recording file for appending and starts the writer.
+func New(opts Options) (*Recorder, error) {
+	f, err := os.OpenFile(opts.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{
+		opts:   opts,
+		redact: make(map[string]bool, len(opts.RedactHeaders)),
+		file:   f,
+		queue:  make(chan *Entry, queueSize),
+		done:   make(chan struct{}),
+	}
+	for _, h := range opts.RedactHeaders {
+		r.redact[http.CanonicalHeaderKey(h)] = true
+	}
+	go r.write()
+	return r, nil
+}
+
+// Sample decides whether the next request is recorded.
+func (r *Recorder) Sample() bool {
+	return r.opts.SampleRate >= 1 || rand.Float64() < r.opts.SampleRate
+}
+
+func (r *Recorder) write() {
+	defer close(r.done)
+	w := bufio.NewWriter(r.file)
+	enc := json.NewEncoder(w)
+	for e := range r.queue {
+		if err := enc.Encode(e); err != nil {
+			log.Errorf("Failed to record request: %v", err)
+		}
+		// Flush once the queue is drained so the file stays close to live
+		if len(r.queue) == 0 {
+			w.Flush()
+		}
+	}
+	w.Flush()
+}
+
+func (r *Recorder) enqueue(e *Entry) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return
+	}
+	select {
+	case r.queue <- e:
+	default:
+		if n := r.dropped.Add(1); n%1000 == 1 {
+			log.WithFields(log.Fields{"dropped": n}).Warn("Recording queue full, dropping requests")
+		}
+	}
+}
+
+// Close writes pending entries and closes the file.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.queue)
+	r.mu.Unlock()
+	<-r.done
+	return r.file.Close()
+}
+
+// headers flattens h, joining repeated values and redacting sensitive ones.
+func (r *Recorder) headers(h http.Header) map[string]string {
+	res := make(map[string]string, len(h))
+	for k, v := range h {
+		if r.redact[k] {
+			res[k] = Redacted
+			continue
+		}
+		res[k] = strings.Join(v, ", ")
+	}
+	return res
+}
@@ -2,56 +2,44 @@ package main
 
 import (
 	"fmt"
-	"io"
-	"net/http"
-	"strconv"
 
+	"github.com/samsyntax/go-lb/config"
+	"github.com/samsyntax/go-lb/fleet"
+	"github.com/samsyntax/go-lb/pool"
 	log "github.com/sirupsen/logrus"
 )
 
-func Server(port, name string, weight int) *LbServer {
-	srv := NewLbServer("http://localhost"+port, weight)
-	srv.name = name
+// defaultWeights are cycled through for local servers without a configured weight.
+var defaultWeights = []int{5, 2, 3}
 
-	mux := http.NewServeMux()
-
-	handler := func(w http.ResponseWriter, r *http.Request) {
-		inf := fmt.Sprintf("Serving on port %s", port)
-		log.Info(inf)
-		io.WriteString(w, inf)
+func Server(port int, name string, cfg config.LocalServerConfig, opts ...pool.Option) *pool.Server {
+	dev, err := fleet.Start(name, fmt.Sprintf("localhost:%d", port), cfg)
+	if err != nil {
+		log.Fatalf("Error starting server %s on port %d: %v", name, port, err)
 	}
-
-	mux.HandleFunc("/", handler)
-	log.Infof("Spawning server: %s at %s\n", srv.name, srv.addr)
-
-	go func() {
-		err := http.ListenAndServe(port, mux)
-		if err != nil {
-			fmt.Printf("Error starting server on port %s: %v\n", port, err)
-		}
-	}()
-
+	opts = append([]pool.Option{pool.WithName(name), pool.WithHealthPath(fleet.HealthPath), pool.WithGroup(cfg.Group)}, opts...)
+	srv, err := pool.NewServer(dev.URL(), cfg.Weight, opts...)
+	if err != nil {
+		log.Fatalf("Error creating server %s: %v", name, err)
+	}
+	log.WithFields(log.Fields{"weight": srv.Weight(), "group": cfg.Group, "down": dev.Down()}).Infof("Spawning server: %s at %s", srv.Name(), srv.Address())
 	return srv
-
 }
-func Spawner(amt, port int) []*LbServer {
-	servers := make([]*LbServer, 0, amt)
-	weights := []int{5, 2, 3}
-	for i := 0; i < amt; i++ {
-		k := 0
-		if i > len(weights) {
-			k = 0
+
+// Spawner starts the local dev fleet on consecutive ports. Servers that start
+// down are still part of the pool so they join once toggled up. opts apply
+// to every server.
+func Spawner(cfg config.LocalConfig, opts ...pool.Option) []*pool.Server {
+	servers := make([]*pool.Server, 0, cfg.Amount)
+	for i := 0; i < cfg.Amount; i++ {
+		var sc config.LocalServerConfig
+		if i < len(cfg.Servers) {
+			sc = cfg.Servers[i]
 		}
-		k++
-		name := fmt.Sprintf("Server %v", i+1)
-		port := ":" + strconv.Itoa(port+i)
-		srv := Server(port, name, weights[k])
-		if srv.IsAlive() {
-			servers = append(servers, srv)
-		} else {
-			continue
+		if sc.Weight == 0 {
+			sc.Weight = defaultWeights[i%len(defaultWeights)]
 		}
-
+		servers = append(servers, Server(cfg.Port+i, fmt.Sprintf("Server %v", i+1), sc, opts...))
 	}
 	return servers
 }
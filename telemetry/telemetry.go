@@ -0,0 +1,71 @@
+// Package telemetry sets up OpenTelemetry tracing for the balancer, exporting
+// spans over OTLP/HTTP.
+package telemetry
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+
+	// "go.opentelemetry.io/otel/expoters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	oteltrace "go.opentelemetry.io/otel/sdk/trace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// DefaultEndpoint is the OTLP/HTTP collector used when none is given.
+const DefaultEndpoint = "localhost:4318"
+
+// ServiceName is the service and tracer name spans are reported under.
+const ServiceName = "go-lb"
+
+// func newConsoleExporter() (oteltrace.SpanExporter, error) {
+// 	return stdouttrace.New()
+// }
+
+// NewOTLPExporter returns an exporter sending spans to endpoint (host:port)
+// without TLS. An empty endpoint uses DefaultEndpoint.
+func NewOTLPExporter(ctx context.Context, endpoint string) (oteltrace.SpanExporter, error) {
+	if endpoint == "" {
+		endpoint = DefaultEndpoint
+	}
+	insecureOpt := otlptracehttp.WithInsecure()
+
+	endpointOpt := otlptracehttp.WithEndpoint(endpoint)
+	return otlptracehttp.New(ctx, insecureOpt, endpointOpt)
+}
+
+// NewTraceProvider returns a tracer provider batching spans into exp.
+func NewTraceProvider(exp sdktrace.SpanExporter) (*sdktrace.TracerProvider, error) {
+	r, err := resource.Merge(
+		resource.Default(),
+		resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(ServiceName),
+		),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(r),
+	), nil
+}
+
+// Setup exports spans to endpoint and installs the tracer provider globally.
+// The returned provider must be shut down to flush pending spans.
+func Setup(ctx context.Context, endpoint string) (*sdktrace.TracerProvider, error) {
+	exp, err := NewOTLPExporter(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	tp, err := NewTraceProvider(exp)
+	if err != nil {
+		return nil, err
+	}
+	otel.SetTracerProvider(tp)
+	return tp, nil
+}
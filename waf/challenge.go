@@ -0,0 +1,65 @@
+package waf
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChallengeCookie holds the proof that a client passed the challenge.
+const ChallengeCookie = "lb_waf"
+
+// challengePage sets the challenge cookie from JavaScript and reloads the
+// page. Clients not running JavaScript, such as most bots, stay here.
+const challengePage = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="robots" content="noindex"><title>Checking your browser</title></head>
+<body>
+<noscript>JavaScript is required to continue.</noscript>
+<script>document.cookie = "%s=%s; path=/; max-age=%d; SameSite=Lax"; location.reload();</script>
+</body></html>
+`
+
+// WriteChallenge answers a request with the challenge page for client.
+func (f *WAF) WriteChallenge(w http.ResponseWriter, client string) {
+	token := f.challengeToken(client, time.Now().Add(f.challengeTTL))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(w, challengePage, ChallengeCookie, token, int(f.challengeTTL.Seconds()))
+}
+
+// challengeToken returns "<expiry>.<signature>", the signature binding the
+// expiry to the client address.
+func (f *WAF) challengeToken(client string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + base64.RawURLEncoding.EncodeToString(f.sign(exp, client))
+}
+
+func (f *WAF) sign(exp, client string) []byte {
+	mac := hmac.New(sha256.New, f.secret)
+	mac.Write([]byte(exp + "|" + client))
+	return mac.Sum(nil)
+}
+
+// verify reports whether r carries a valid challenge cookie for client.
+func (f *WAF) verify(r *http.Request, client string) bool {
+	c, err := r.Cookie(ChallengeCookie)
+	if err != nil {
+		return false
+	}
+	exp, sig, ok := strings.Cut(c.Value, ".")
+	if !ok {
+		return false
+	}
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return false
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	return err == nil && hmac.Equal(got, f.sign(exp, client))
+}
@@ -0,0 +1,127 @@
+package waf
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// StarterRules is the ruleset used without a rules file: common SQL
+// injection, XSS, path traversal and scanner patterns. It is a starting
+// point to copy and tune, not a complete protection.
+//
+//go:embed rules.yaml
+var StarterRules []byte
+
+// Rule actions. Rules without an action add their score to the request.
+const (
+	ActionScore = ""      // add the score, requests reaching the threshold are handled by the mode
+	ActionBlock = "block" // a match alone is handled by the mode, regardless of the score
+	ActionLog   = "log"   // matches are only counted and logged, to try out new rules
+)
+
+// Request parts rules can match. Headers are matched by their values.
+const (
+	TargetPath    = "path"
+	TargetQuery   = "query"
+	TargetHeaders = "headers" // every header
+	TargetBody    = "body"
+
+	targetHeaderPrefix = "header:" // a single header, e.g. header:User-Agent
+)
+
+// Rule matches a regular expression against parts of requests.
+type Rule struct {
+	ID          string   `yaml:"id"`
+	Description string   `yaml:"description"`
+	Targets     []string `yaml:"targets"`
+	Pattern     string   `yaml:"pattern"` // RE2 syntax, see regexp/syntax
+	Score       int      `yaml:"score"`
+	Action      string   `yaml:"action"`
+
+	re      *regexp.Regexp
+	headers []string // canonical names of header: targets
+}
+
+// ruleFile is the format of rule files.
+type ruleFile struct {
+	Rules []*Rule `yaml:"rules"`
+}
+
+// ParseRules parses and checks a rule file.
+func ParseRules(data []byte) ([]*Rule, error) {
+	var f ruleFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&f); err != nil {
+		return nil, err
+	}
+	if len(f.Rules) == 0 {
+		return nil, errors.New("no rules")
+	}
+	ids := make(map[string]bool)
+	for i, r := range f.Rules {
+		if err := r.compile(); err != nil {
+			if r.ID == "" {
+				return nil, fmt.Errorf("rules[%d]: %w", i, err)
+			}
+			return nil, fmt.Errorf("rule %s: %w", r.ID, err)
+		}
+		if ids[r.ID] {
+			return nil, fmt.Errorf("rule %s: duplicate id", r.ID)
+		}
+		ids[r.ID] = true
+	}
+	return f.Rules, nil
+}
+
+func (r *Rule) compile() error {
+	if r.ID == "" {
+		return errors.New("id is required")
+	}
+	if len(r.Targets) == 0 {
+		return errors.New("targets are required")
+	}
+	for _, t := range r.Targets {
+		switch {
+		case t == TargetPath || t == TargetQuery || t == TargetHeaders || t == TargetBody:
+		case strings.HasPrefix(t, targetHeaderPrefix) && len(t) > len(targetHeaderPrefix):
+			r.headers = append(r.headers, http.CanonicalHeaderKey(t[len(targetHeaderPrefix):]))
+		default:
+			return fmt.Errorf("unknown target %q, use path, query, headers, header:<name> or body", t)
+		}
+	}
+	switch r.Action {
+	case ActionScore:
+		if r.Score <= 0 {
+			return errors.New("score must be positive")
+		}
+	case ActionBlock, ActionLog:
+	default:
+		return fmt.Errorf("unknown action %q, use block or log", r.Action)
+	}
+	if r.Pattern == "" {
+		return errors.New("pattern is required")
+	}
+	re, err := regexp.Compile(r.Pattern)
+	if err != nil {
+		return fmt.Errorf("pattern: %w", err)
+	}
+	r.re = re
+	return nil
+}
+
+func (r *Rule) targets(t string) bool {
+	for _, rt := range r.Targets {
+		if rt == t {
+			return true
+		}
+	}
+	return false
+}
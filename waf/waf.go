@@ -0,0 +1,388 @@
+// Package waf is a lightweight web application firewall. Requests are
+// matched against regular expression rules on their path, query, headers
+// and body; the scores of the rules a request matches decide whether it is
+// blocked, challenged or only logged. Every rule counts its hits, so rules
+// causing false positives can be found and tuned.
+package waf
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/samsyntax/go-lb/filewatch"
+)
+
+// Mode is what happens to requests reaching the score threshold.
+type Mode string
+
+const (
+	ModeOff       Mode = "off"       // requests are not inspected
+	ModeBlock     Mode = "block"     // answered with 403
+	ModeLog       Mode = "log"       // forwarded and logged, to try out rules before enforcing them
+	ModeChallenge Mode = "challenge" // asked to run a JavaScript check first, browsers pass it and are let through
+)
+
+// ValidMode reports whether s names a mode.
+func ValidMode(s string) bool {
+	switch Mode(s) {
+	case ModeOff, ModeBlock, ModeLog, ModeChallenge:
+		return true
+	}
+	return false
+}
+
+// Options configures a WAF.
+type Options struct {
+	RulesFile       string        // YAML rule file reloaded when it changes, empty for StarterRules
+	Mode            Mode          // ModeBlock by default
+	Threshold       int           // score handled by the mode, 5 by default
+	MaxBodySize     int64         // bytes of text request bodies inspected, 64 KiB by default, negative to skip bodies
+	ChallengeSecret []byte        // signs challenge cookies, random when empty
+	ChallengeTTL    time.Duration // challenge cookies are valid this long, 1h by default
+}
+
+// WAF inspects requests with a set of rules.
+type WAF struct {
+	rules        func() []*Rule
+	mode         Mode
+	threshold    int
+	maxBodySize  int64
+	secret       []byte
+	challengeTTL time.Duration
+
+	mu   sync.Mutex
+	hits map[string]*atomic.Uint64 // by rule ID, kept across rule file reloads
+
+	inspected, blocked, challenged, passed, logged atomic.Uint64
+}
+
+// New loads the rules and creates a WAF.
+func New(opts Options) (*WAF, error) {
+	f := &WAF{
+		mode:         opts.Mode,
+		threshold:    opts.Threshold,
+		maxBodySize:  opts.MaxBodySize,
+		secret:       opts.ChallengeSecret,
+		challengeTTL: opts.ChallengeTTL,
+		hits:         make(map[string]*atomic.Uint64),
+	}
+	if f.mode == "" {
+		f.mode = ModeBlock
+	}
+	if !ValidMode(string(f.mode)) {
+		return nil, fmt.Errorf("unknown mode %q", f.mode)
+	}
+	if f.threshold <= 0 {
+		f.threshold = 5
+	}
+	if f.maxBodySize == 0 {
+		f.maxBodySize = 64 << 10
+	}
+	if f.challengeTTL <= 0 {
+		f.challengeTTL = time.Hour
+	}
+	if len(f.secret) == 0 {
+		f.secret = make([]byte, 32)
+		if _, err := rand.Read(f.secret); err != nil {
+			return nil, err
+		}
+	}
+	if opts.RulesFile == "" {
+		rules, err := ParseRules(StarterRules)
+		if err != nil {
+			return nil, fmt.Errorf("starter rules: %w", err)
+		}
+		f.rules = func() []*Rule { return rules }
+		return f, nil
+	}
+	file, err := filewatch.New(opts.RulesFile, ParseRules)
+	if err != nil {
+		return nil, fmt.Errorf("rules file: %w", err)
+	}
+	f.rules = file.Get
+	return f, nil
+}
+
+// Rules returns the current rules.
+func (f *WAF) Rules() []*Rule {
+	return f.rules()
+}
+
+// Mode returns the mode of routes that don't set their own.
+func (f *WAF) Mode() Mode {
+	return f.mode
+}
+
+// Policy is how the requests of a route are inspected.
+type Policy struct {
+	Mode          Mode     // empty for the WAF's mode
+	DisabledRules []string // IDs of rules skipped
+}
+
+// Action is what the WAF decided for a request.
+type Action int
+
+const (
+	Allow     Action = iota // below the threshold, possibly with rules matched
+	Log                     // reached the threshold in log mode
+	Block                   // reached the threshold in block mode
+	Challenge               // reached the threshold in challenge mode without a valid challenge cookie
+	Passed                  // reached the threshold in challenge mode, the client passed the challenge before
+)
+
+func (a Action) String() string {
+	return [...]string{"allow", "log", "block", "challenge", "passed"}[a]
+}
+
+// Match is a rule matching a request.
+type Match struct {
+	Rule   string
+	Target string // path, query, header:<name> or body
+	Value  string // the matched text, shortened
+	Score  int
+	Action string
+}
+
+// Result is the outcome of checking a request.
+type Result struct {
+	Action  Action
+	Score   int
+	Matches []Match
+}
+
+// Check inspects r with the rules p doesn't disable and decides what
+// happens to it. client is the client address challenge cookies are bound to.
+// Bodies are read up to the inspected size and put back into r.
+func (f *WAF) Check(r *http.Request, p Policy, client string) Result {
+	mode := p.Mode
+	if mode == "" {
+		mode = f.mode
+	}
+	if mode == ModeOff {
+		return Result{}
+	}
+	f.inspected.Add(1)
+
+	var res Result
+	triggered := false
+	req := &request{r: r, maxBodySize: f.maxBodySize}
+	for _, rule := range f.rules() {
+		if slices.Contains(p.DisabledRules, rule.ID) {
+			continue
+		}
+		m, ok := rule.match(req)
+		if !ok {
+			continue
+		}
+		f.counter(rule.ID).Add(1)
+		res.Matches = append(res.Matches, m)
+		switch rule.Action {
+		case ActionScore:
+			res.Score += rule.Score
+		case ActionBlock:
+			triggered = true
+		}
+	}
+	if !triggered && res.Score < f.threshold {
+		return res
+	}
+	switch mode {
+	case ModeLog:
+		res.Action = Log
+		f.logged.Add(1)
+	case ModeChallenge:
+		if f.verify(r, client) {
+			res.Action = Passed
+			f.passed.Add(1)
+		} else {
+			res.Action = Challenge
+			f.challenged.Add(1)
+		}
+	default:
+		res.Action = Block
+		f.blocked.Add(1)
+	}
+	return res
+}
+
+func (f *WAF) counter(id string) *atomic.Uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.hits[id]
+	if !ok {
+		c = new(atomic.Uint64)
+		f.hits[id] = c
+	}
+	return c
+}
+
+// Stats counts the requests inspected and what was decided for them.
+type Stats struct {
+	Inspected  uint64      `json:"inspected"`
+	Blocked    uint64      `json:"blocked"`
+	Challenged uint64      `json:"challenged"`
+	Passed     uint64      `json:"passed"` // let through with a valid challenge cookie
+	Logged     uint64      `json:"logged"` // reached the threshold in log mode
+	Rules      []RuleStats `json:"rules"`  // in rule file order
+}
+
+// RuleStats counts the requests a rule matched.
+type RuleStats struct {
+	ID   string `json:"id"`
+	Hits uint64 `json:"hits"`
+}
+
+// Stats returns the counters since the WAF was created.
+func (f *WAF) Stats() Stats {
+	st := Stats{
+		Inspected:  f.inspected.Load(),
+		Blocked:    f.blocked.Load(),
+		Challenged: f.challenged.Load(),
+		Passed:     f.passed.Load(),
+		Logged:     f.logged.Load(),
+	}
+	for _, rule := range f.rules() {
+		st.Rules = append(st.Rules, RuleStats{ID: rule.ID, Hits: f.counter(rule.ID).Load()})
+	}
+	return st
+}
+
+// request holds the decoded parts of a request, decoded when a rule first
+// needs them.
+type request struct {
+	r           *http.Request
+	maxBodySize int64
+
+	path, query string
+	body        string
+	decoded     bool
+	bodyRead    bool
+}
+
+func (req *request) decode() {
+	if req.decoded {
+		return
+	}
+	req.decoded = true
+	req.path = unescape(req.r.URL.EscapedPath(), url.PathUnescape)
+	req.query = unescape(req.r.URL.RawQuery, url.QueryUnescape)
+}
+
+// readBody reads the start of text bodies and puts it back in front of the
+// rest, so the body is still forwarded in full.
+func (req *request) readBody() string {
+	if req.bodyRead {
+		return req.body
+	}
+	req.bodyRead = true
+	r := req.r
+	if req.maxBodySize < 0 || r.Body == nil || r.Body == http.NoBody {
+		return ""
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if !inspected(mediaType) {
+		return ""
+	}
+	// Read errors, such as a body over the size limit, are left to the proxy
+	buf, _ := io.ReadAll(io.LimitReader(r.Body, req.maxBodySize))
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+	req.body = string(buf)
+	if mediaType == "application/x-www-form-urlencoded" {
+		req.body = unescape(req.body, url.QueryUnescape)
+	}
+	return req.body
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// inspected reports whether bodies of mediaType are matched. Binary uploads
+// are skipped: they are expensive to scan and prone to false positives.
+func inspected(mediaType string) bool {
+	switch {
+	case mediaType == "application/x-www-form-urlencoded", mediaType == "multipart/form-data",
+		mediaType == "application/json", mediaType == "application/xml",
+		strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	return false
+}
+
+// unescape decodes s until it no longer changes, so doubly encoded payloads
+// such as %252e%252e are matched too.
+func unescape(s string, decode func(string) (string, error)) string {
+	for i := 0; i < 3; i++ {
+		d, err := decode(s)
+		if err != nil || d == s {
+			break
+		}
+		s = d
+	}
+	return s
+}
+
+// match reports the first target of req matching the rule.
+func (rule *Rule) match(req *request) (Match, bool) {
+	m := Match{Rule: rule.ID, Score: rule.Score, Action: rule.Action}
+	try := func(target, value string) bool {
+		loc := rule.re.FindStringIndex(value)
+		if loc == nil {
+			return false
+		}
+		m.Target, m.Value = target, excerpt(value, loc)
+		return true
+	}
+	if rule.targets(TargetPath) || rule.targets(TargetQuery) {
+		req.decode()
+	}
+	if rule.targets(TargetPath) && try(TargetPath, req.path) {
+		return m, true
+	}
+	if rule.targets(TargetQuery) && try(TargetQuery, req.query) {
+		return m, true
+	}
+	if rule.targets(TargetHeaders) {
+		for name, values := range req.r.Header {
+			for _, v := range values {
+				if try(targetHeaderPrefix+name, v) {
+					return m, true
+				}
+			}
+		}
+	}
+	for _, name := range rule.headers {
+		for _, v := range req.r.Header.Values(name) {
+			if try(targetHeaderPrefix+name, v) {
+				return m, true
+			}
+		}
+	}
+	if rule.targets(TargetBody) && try(TargetBody, req.readBody()) {
+		return m, true
+	}
+	return m, false
+}
+
+// excerpt returns the match at loc in s with a little context, at most 80
+// bytes, for logging.
+func excerpt(s string, loc []int) string {
+	const around, maxLen = 16, 80
+	start, end := max(0, loc[0]-around), min(len(s), loc[1]+around)
+	if end-start > maxLen {
+		end = start + maxLen
+	}
+	return s[start:end]
+}